@@ -3,49 +3,192 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/joho/godotenv"
 	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/account"
+	"github.com/mdwiltfong/chirpy/utils/auth"
+	"github.com/mdwiltfong/chirpy/utils/avatar"
+	"github.com/mdwiltfong/chirpy/utils/export"
+	"github.com/mdwiltfong/chirpy/utils/mail"
+	"github.com/mdwiltfong/chirpy/utils/oauth"
+	"github.com/mdwiltfong/chirpy/utils/polka"
+	"github.com/mdwiltfong/chirpy/utils/totp"
 	"github.com/mdwiltfong/chirpy/utils/types"
 	"golang.org/x/crypto/bcrypt"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 )
 
 func main() {
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "list pending database migrations and exit")
+	flag.Parse()
 	godotenv.Load()
 	jwtSecret := os.Getenv("JWT_SECRET")
+	polkaKey := os.Getenv("POLKA_KEY")
+	refreshTokenKey := os.Getenv("REFRESH_TOKEN_KEY")
+	if refreshTokenKey == "" {
+		log.Print("REFRESH_TOKEN_KEY is not set, refresh tokens will be hashed without a key")
+	}
+	utils.SetRefreshTokenKey([]byte(refreshTokenKey))
+	keys, err := auth.NewKeySet(auth.KeySetOptions{
+		Algorithm:        os.Getenv("JWT_ALG"),
+		Path:             envOrDefault("JWT_KEYS_PATH", "database/jwt_keys.json"),
+		RotateEvery:      envDuration("JWT_KEY_ROTATION"),
+		MaxTokenLifetime: maxAccessTokenLifetime,
+		LegacySecret:     jwtSecret,
+	})
+	if err != nil {
+		log.Fatalf("Unable to load JWT signing keys: %s", err)
+	}
+	// JWT_SECRET only keeps tokens from before the upgrade to signing keys
+	// working until they expire, then it should be removed.
+	if jwtSecret != "" {
+		if expiry := keys.LegacyExpiry(); time.Now().Before(expiry) {
+			log.Printf("JWT_SECRET verifies access tokens issued before %s until %s, remove it after that",
+				expiry.Add(-maxAccessTokenLifetime).Format(time.RFC3339), expiry.Format(time.RFC3339))
+		} else {
+			log.Print("JWT_SECRET no longer verifies any token and can be removed")
+		}
+	}
 	const filepathRoot = "."
 	const port = "8080"
 
+	dbDriver := os.Getenv("DB_DRIVER")
+	dbPath := os.Getenv("DB_PATH")
+	if dbPath == "" {
+		dbPath = "database/database.json"
+	}
+
+	if *migrateDryRun {
+		if dbDriver != "" && dbDriver != "json" {
+			log.Fatalf("Dry-run migrations are only supported by the json driver")
+		}
+		if _, err := os.Stat(dbPath); err != nil {
+			log.Printf("%s does not exist yet and will be created at schema version %d", dbPath, utils.CurrentSchemaVersion)
+			return
+		}
+		pending, err := utils.MigrateDB(dbPath, utils.MigrateOptions{DryRun: true})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(pending) == 0 {
+			log.Printf("%s is at schema version %d", dbPath, utils.CurrentSchemaVersion)
+		}
+		for _, migration := range pending {
+			log.Printf("Pending migration to version %d: %s", migration.Version, migration.Description)
+		}
+		return
+	}
+
+	mailer, err := newMailer()
+	if err != nil {
+		log.Fatalf("Unable to set up the mailer: %s", err)
+	}
 	mux := http.NewServeMux()
-	client, _ := utils.NewDB("database/database.json")
+	client, err := utils.OpenStore(dbDriver, dbPath)
+	if err != nil {
+		log.Fatalf("Unable to open %s database at %s: %s", dbDriver, dbPath, err)
+	}
 	apiCfg := apiConfig{
-		filserverHits: 0,
-		DBClient:      client,
-		JWT_SECRET:    jwtSecret,
+		filserverHits:       0,
+		DBClient:            client,
+		JWT_SECRET:          jwtSecret,
+		POLKA_KEY:           polkaKey,
+		Keys:                keys,
+		LoginThrottle:       auth.NewLoginThrottle(auth.DefaultLoginThrottleOptions),
+		Mailer:              mailer,
+		PublicURL:           envOrDefault("PUBLIC_URL", "http://localhost:"+port),
+		BootstrapAdminEmail: os.Getenv("BOOTSTRAP_ADMIN_EMAIL"),
+		Avatars:             avatar.Avatars{Dir: envOrDefault("AVATAR_DIR", "avatars"), URLPrefix: "/avatars/"},
+		Deleter: account.Deleter{
+			Store:           client,
+			GracePeriod:     envDuration("ACCOUNT_DELETION_GRACE"),
+			AnonymizeChirps: os.Getenv("DELETED_USER_CHIRPS") == "anonymize",
+		},
+	}
+	// Avatar thumbnails go the way of their user.
+	apiCfg.Deleter.Cleanup = func(user types.User) error {
+		return apiCfg.Avatars.Remove(user.Avatar)
+	}
+	go apiCfg.Deleter.Run(accountDeletionSweepInterval, nil)
+	apiCfg.Exporter = export.Exporter{
+		Store: client,
+		Dir:   envOrDefault("EXPORT_DIR", "database/exports"),
+		TTL:   envDuration("EXPORT_TTL"),
+	}
+	go apiCfg.Exporter.Run(dataExportPurgeInterval, nil)
+	if _, _, err := auth.BootstrapAdmin(client, apiCfg.BootstrapAdminEmail); err != nil {
+		log.Printf("Unable to bootstrap the first admin: %s", err)
+	}
+	for _, action := range strings.Split(os.Getenv("REQUIRE_VERIFIED_EMAIL"), ",") {
+		switch strings.TrimSpace(action) {
+		case "login":
+			apiCfg.RequireVerifiedToLogin = true
+		case "chirp":
+			apiCfg.RequireVerifiedToChirp = true
+		}
 	}
 	mux.Handle("/app/*", http.StripPrefix("/app",
 		apiCfg.middlewareMetricInc(http.FileServer(http.Dir(filepathRoot)))))
 
 	mux.HandleFunc("GET /api/healthz", handlerReadiness)
-	mux.HandleFunc("GET /api/metrics", apiCfg.handlerMetrics)
-	mux.HandleFunc("GET /admin/metrics", apiCfg.handlerAdminMetrics)
-	mux.HandleFunc("/api/reset", apiCfg.handleReset)
+	mux.HandleFunc("GET /avatars/{file}", apiCfg.handleServeAvatar)
+	mux.HandleFunc("GET /.well-known/jwks.json", keys.ServeJWKS)
+	mux.Handle("GET /api/metrics", apiCfg.requirePermission(auth.ActionViewMetrics, apiCfg.handlerMetrics))
+	mux.Handle("GET /admin/metrics", apiCfg.requirePermission(auth.ActionViewMetrics, apiCfg.handlerAdminMetrics))
+	mux.Handle("/api/reset", apiCfg.requirePermission(auth.ActionResetMetrics, apiCfg.handleReset))
+	mux.Handle("POST /admin/users/{userId}/unlock", apiCfg.requirePermission(auth.ActionUnlockUsers, apiCfg.handleUnlockUser))
+	mux.Handle("PUT /admin/users/{userId}/role", apiCfg.requirePermission(auth.ActionManageRoles, apiCfg.handleSetRole))
+	mux.Handle("POST /admin/users/{userId}/suspension", apiCfg.requirePermission(auth.ActionSuspendUsers, apiCfg.handleSuspendUser))
+	mux.Handle("DELETE /admin/users/{userId}/suspension", apiCfg.requirePermission(auth.ActionSuspendUsers, apiCfg.handleUnsuspendUser))
 	mux.HandleFunc("POST /api/validate_chirp", apiCfg.handlerValideateChirp)
-	mux.HandleFunc("POST /api/chirps", apiCfg.handleCreateChirps)
-	mux.HandleFunc("GET /api/chirps", apiCfg.handleReadChirps)
-	mux.HandleFunc("GET /api/chirps/{chirpId}", apiCfg.handleGetChirp)
+	mux.Handle("POST /api/chirps", apiCfg.requireScope(auth.ScopeChirpsWrite, apiCfg.handleCreateChirps))
+	mux.Handle("GET /api/chirps", apiCfg.allowScope(auth.ScopeChirpsRead, apiCfg.handleReadChirps))
+	mux.Handle("GET /api/chirps/{chirpId}", apiCfg.allowScope(auth.ScopeChirpsRead, apiCfg.handleGetChirp))
+	mux.Handle("DELETE /api/chirps/{chirpId}", apiCfg.requireScope(auth.ScopeChirpsWrite, apiCfg.handleDeleteChirp))
 	mux.HandleFunc("POST /api/users", apiCfg.handleCreateUser)
-	mux.HandleFunc("PUT /api/users", apiCfg.handleUpdateUser)
+	mux.HandleFunc("POST /api/users/verify", apiCfg.handleVerifyEmail)
+	mux.Handle("PUT /api/users", apiCfg.requireScope(auth.ScopeProfileWrite, apiCfg.handleUpdateUser))
+	mux.Handle("DELETE /api/users", apiCfg.requireUser(apiCfg.handleDeleteUser))
+	mux.HandleFunc("GET /api/users/{handle}", apiCfg.handleGetProfile)
+	mux.Handle("PUT /api/users/avatar", apiCfg.requireScope(auth.ScopeProfileWrite, apiCfg.handleUploadAvatar))
+	mux.Handle("DELETE /api/users/avatar", apiCfg.requireScope(auth.ScopeProfileWrite, apiCfg.handleDeleteAvatar))
+	mux.Handle("POST /api/users/me/export", apiCfg.requireUser(apiCfg.handleCreateExport))
+	mux.Handle("GET /api/users/me/export/{exportId}", apiCfg.requireUser(apiCfg.handleGetExport))
+	mux.Handle("POST /api/tokens", apiCfg.requireUser(apiCfg.handleCreateApiToken))
+	mux.Handle("GET /api/tokens", apiCfg.requireUser(apiCfg.handleListApiTokens))
+	mux.Handle("DELETE /api/tokens/{tokenId}", apiCfg.requireUser(apiCfg.handleRevokeApiToken))
 	mux.HandleFunc("POST /api/login", apiCfg.handleLogin)
-	mux.HandleFunc("POST /api/refresh", apiCfg.handleRefresh)
-	mux.HandleFunc("POST /api/revoke", apiCfg.handleRevoke)
+	mux.HandleFunc("POST /api/login/mfa", apiCfg.handleLoginMFA)
+	mux.Handle("POST /api/mfa/totp/enroll", apiCfg.requireUser(apiCfg.handleEnrollTOTP))
+	mux.Handle("POST /api/mfa/totp/confirm", apiCfg.requireUser(apiCfg.handleConfirmTOTP))
+	mux.Handle("DELETE /api/mfa/totp", apiCfg.requireUser(apiCfg.handleDisableTOTP))
+	mux.Handle("POST /api/refresh", apiCfg.requireRefreshToken(apiCfg.handleRefresh))
+	mux.Handle("POST /api/revoke", apiCfg.requireRefreshToken(apiCfg.handleRevoke))
+	mux.Handle("GET /api/sessions", apiCfg.requireUser(apiCfg.handleListSessions))
+	mux.Handle("DELETE /api/sessions/{sessionId}", apiCfg.requireUser(apiCfg.handleDeleteSession))
+	mux.Handle("POST /api/logout-all", apiCfg.requireUser(apiCfg.handleLogoutAll))
+	mux.HandleFunc("POST /api/password-reset/request", apiCfg.handleRequestPasswordReset)
+	mux.HandleFunc("POST /api/password-reset/confirm", apiCfg.handleConfirmPasswordReset)
+	oauthServer := oauth.NewServer(client, keys, apiCfg.generateScopedJWT)
+	mux.Handle("POST /api/oauth/clients", apiCfg.requireUser(oauthServer.RegisterClient))
+	mux.Handle("GET /api/oauth/clients", apiCfg.requireUser(oauthServer.ListClients))
+	mux.Handle("GET /api/oauth/authorize", apiCfg.requireUser(oauthServer.Consent))
+	mux.Handle("POST /api/oauth/authorize", apiCfg.requireUser(oauthServer.Authorize))
+	mux.HandleFunc("POST /oauth/token", oauthServer.Token)
+	mux.HandleFunc("POST /oauth/introspect", oauthServer.Introspect)
+	mux.HandleFunc("POST /oauth/revoke", oauthServer.Revoke)
+	mux.Handle("POST /api/polka/webhooks", apiCfg.requirePolka(polka.NewWebhookHandler(client).ServeHTTP))
 	srv := &http.Server{
 		Addr:    ":" + port,
 		Handler: mux,
@@ -57,71 +200,462 @@ func main() {
 
 type apiConfig struct {
 	filserverHits int
-	DBClient      *utils.DataBaseClient
-	JWT_SECRET    string
+	DBClient      utils.Store
+	// JWT_SECRET only verifies HS256 tokens issued before Keys existed, and
+	// only until they expire, see auth.KeySet.LegacyExpiry.
+	JWT_SECRET string
+	POLKA_KEY  string
+	Keys       *auth.KeySet
+	// LoginThrottle slows down and locks out password guessing.
+	LoginThrottle *auth.LoginThrottle
+	Mailer        mail.Mailer
+	// PublicURL is where users reach the app, for links in emails.
+	PublicURL string
+	// Set from REQUIRE_VERIFIED_EMAIL, a comma separated list of "login"
+	// and "chirp", to hold those back until the user verifies their email.
+	RequireVerifiedToLogin bool
+	RequireVerifiedToChirp bool
+	// BootstrapAdminEmail, from BOOTSTRAP_ADMIN_EMAIL, is made admin once
+	// verified if there is no admin yet, see auth.BootstrapAdmin.
+	BootstrapAdminEmail string
+	// Avatars keeps thumbnails in AVATAR_DIR, next to assets/ by default.
+	Avatars avatar.Avatars
+	// Deleter takes ACCOUNT_DELETION_GRACE, a duration such as "720h", and
+	// DELETED_USER_CHIRPS, "anonymize" to keep deleted users' chirps.
+	Deleter account.Deleter
+	// Exporter keeps archives in EXPORT_DIR for EXPORT_TTL, a duration such
+	// as "48h".
+	Exporter export.Exporter
+}
+
+// accountDeletionSweepInterval is how often deletions whose grace period is
+// over are finalized.
+const accountDeletionSweepInterval = 10 * time.Minute
+
+// dataExportPurgeInterval is how often expired data exports are deleted.
+const dataExportPurgeInterval = 10 * time.Minute
+
+// newMailer picks the mailer from MAILER: "smtp" sends through SMTP_ADDR,
+// "file" appends messages to MAIL_FILE and "log" logs them. There is no
+// default, since the messages hold live verification and reset links that
+// must not end up in a log nobody meant to write them to.
+func newMailer() (mail.Mailer, error) {
+	switch mailer := os.Getenv("MAILER"); mailer {
+	case "smtp":
+		if os.Getenv("SMTP_ADDR") == "" {
+			return nil, errors.New("MAILER=smtp needs SMTP_ADDR")
+		}
+		return mail.SMTPMailer{
+			Addr:     os.Getenv("SMTP_ADDR"),
+			From:     os.Getenv("MAIL_FROM"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}, nil
+	case "file":
+		if os.Getenv("MAIL_FILE") == "" {
+			return nil, errors.New("MAILER=file needs MAIL_FILE")
+		}
+		return &mail.FileMailer{Path: os.Getenv("MAIL_FILE")}, nil
+	case "log":
+		log.Print("MAILER=log, emails and the links in them will be written to the log instead of being sent")
+		return &mail.FileMailer{}, nil
+	case "":
+		return nil, errors.New("MAILER is not set, set it to smtp, file or log")
+	default:
+		return nil, fmt.Errorf("Unknown MAILER %q, expected smtp, file or log", mailer)
+	}
+}
+
+// maxAccessTokenLifetime caps expires_in_seconds on login. Retired signing
+// keys are published for this long after rotation.
+const maxAccessTokenLifetime = time.Hour
+
+func envOrDefault(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envDuration parses a duration such as "720h" from the environment, 0 if it
+// is unset or invalid.
+func envDuration(name string) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s: %s", name, err)
+		return 0
+	}
+	return duration
+}
+
+// requireUser wraps routes that need a logged-in user. The handler finds the
+// user's ID in the auth.Principal on the request context. API tokens are not
+// accepted, so these routes are for the user themselves only.
+func (cgf *apiConfig) requireUser(handler http.HandlerFunc) http.Handler {
+	return auth.RequireAccessToken(cgf.Keys, auth.RequireActiveUser(cgf.DBClient, handler))
+}
+
+// requireScope wraps routes automation may call with an API token granted
+// scope, as well as logged-in users.
+func (cgf *apiConfig) requireScope(scope string, handler http.HandlerFunc) http.Handler {
+	return auth.RequireScope(cgf.Keys, cgf.DBClient, scope, auth.RequireActiveUser(cgf.DBClient, handler))
+}
+
+// allowScope wraps public routes, which API tokens may only call if granted
+// scope.
+func (cgf *apiConfig) allowScope(scope string, handler http.HandlerFunc) http.Handler {
+	return auth.AllowScope(cgf.Keys, cgf.DBClient, scope, auth.RequireActiveUser(cgf.DBClient, handler))
+}
+
+// requirePermission wraps staff routes, which need a logged-in user whose
+// role may take action.
+func (cgf *apiConfig) requirePermission(action string, handler http.HandlerFunc) http.Handler {
+	return auth.RequirePermission(cgf.Keys, cgf.DBClient, action, handler)
+}
+
+// requireRefreshToken wraps routes that take a refresh token as the bearer
+// token.
+func (cgf *apiConfig) requireRefreshToken(handler http.HandlerFunc) http.Handler {
+	return auth.RequireRefreshToken(cgf.DBClient, handler)
+}
+
+// requirePolka wraps routes only our payment provider may call.
+func (cgf *apiConfig) requirePolka(handler http.HandlerFunc) http.Handler {
+	return auth.RequireApiKey(map[string]string{cgf.POLKA_KEY: "polka"}, handler)
 }
 
 func (cgf *apiConfig) handleCreateChirps(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Body string `json:"Body"`
 	}
+	userId := principal(r).UserId
+	if cgf.RequireVerifiedToChirp {
+		user, err := cgf.DBClient.GetUserByID(userId)
+		if err != nil || user.IsEmailVerified == false {
+			respondWithError(w, 403, "Verify your email address before chirping")
+			return
+		}
+	}
 	// First, decode request to see if it's valid
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 	decoder.Decode(&params)
-	chirp, err := cgf.DBClient.CreateChirp(params.Body)
+	chirp, err := cgf.DBClient.CreateChirp(params.Body, userId)
 	if err != nil {
 		log.Printf("Error decoding parameters: %s", err)
 		respondWithError(w, 400, "Something went wrong")
+		return
 	}
 	respondWithJSON(w, 201, chirp)
 }
+
+// handleUpdateUser changes the fields that are sent and leaves the others as
+// they are. An empty profile field clears it.
 func (cgf *apiConfig) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email       string  `json:"email"`
+		Password    string  `json:"password"`
+		Handle      *string `json:"handle"`
+		DisplayName *string `json:"display_name"`
+		Bio         *string `json:"bio"`
+		Location    *string `json:"location"`
+		Website     *string `json:"website"`
 	}
 	// First, decode request to see if it's valid
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 	decoder.Decode(&params)
 
-	authHeader := r.Header.Get("Authorization")
-	authHeaderArr := strings.SplitAfter(authHeader, " ")
-	bearerToken := authHeaderArr[1]
-	type MyCustomClaims struct {
-		jwt.RegisteredClaims
+	if err := auth.CheckCredentialChange(principal(r), params.Email, params.Password); err != nil {
+		respondWithError(w, 403, err.Error())
+		return
 	}
-	parsedToken, err := jwt.ParseWithClaims(bearerToken, &MyCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(cgf.JWT_SECRET), nil
-	})
-
-	if err != nil {
-		respondWithError(w, 401, "Unauthorized request")
+	userId := principal(r).UserId
+	updatedUser, getErr := cgf.DBClient.GetUserByID(userId)
+	if getErr != nil {
+		log.Print(getErr.Error())
+		respondWithError(w, 401, "Unable to update user")
+		return
+	}
+	// Everything is checked before anything is stored, so a bad field
+	// doesn't leave the others half applied.
+	update := types.UserUpdate{
+		Handle:      params.Handle,
+		DisplayName: params.DisplayName,
+		Bio:         params.Bio,
+		Location:    params.Location,
+		Website:     params.Website,
+	}
+	if _, err := utils.UpdatedProfile(updatedUser.Profile, update); err != nil {
+		respondWithError(w, 400, err.Error())
 		return
 	}
-	userStrId, subjectErr := parsedToken.Claims.GetSubject()
-	if subjectErr != nil {
-		log.Print(subjectErr.Error())
-		respondWithError(w, 503, "Server error")
+	if params.Email != "" {
+		if _, err := utils.NormalizeEmail(params.Email); err != nil {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+		update.Email = &params.Email
+	}
+	if params.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(params.Password), 10)
+		if err != nil {
+			log.Print(err.Error())
+			respondWithError(w, 503, "Server error")
+			return
+		}
+		update.Password = hash
+	}
+	previousEmail := updatedUser.Email
+	updatedUser, updatingErr := cgf.DBClient.UpdateUser(userId, update)
+	if errors.Is(updatingErr, utils.ErrEmailTaken) || errors.Is(updatingErr, utils.ErrHandleTaken) {
+		respondWithError(w, 409, updatingErr.Error())
 		return
 	}
-	userId, _ := strconv.Atoi(userStrId)
-	hash, err := bcrypt.GenerateFromPassword([]byte(params.Password), 10)
-	updateUser := types.User{ID: userId, Email: params.Email, Password: hash}
-	updatedUser, updatingErr := cgf.DBClient.UpdateUser(userId, updateUser)
 	if updatingErr != nil {
 		log.Print(updatingErr.Error())
 		respondWithError(w, 401, "Unable to update user")
 		return
 	}
+	if updatedUser.Email != previousEmail {
+		go cgf.sendEmailVerification(updatedUser)
+	}
 	updatedUser.Password = nil
 	respondWithJSON(w, 200, updatedUser)
 
 }
+
+// publicProfile is everything anyone may see of a user. It must never grow
+// an email or anything else from the account.
+type publicProfile struct {
+	ID          int               `json:"id"`
+	Handle      string            `json:"handle"`
+	DisplayName string            `json:"display_name"`
+	Bio         string            `json:"bio"`
+	Location    string            `json:"location"`
+	Website     string            `json:"website"`
+	AvatarURLs  map[string]string `json:"avatar_urls,omitempty"`
+	IsChirpyRed bool              `json:"is_chirpy_red"`
+}
+
+// handleGetProfile looks users up by handle, or by ID for the authors of
+// chirps, since handles never start with a digit.
+func (cgf *apiConfig) handleGetProfile(w http.ResponseWriter, r *http.Request) {
+	handle := r.PathValue("handle")
+	var user types.User
+	var err error
+	if userId, atoiErr := strconv.Atoi(handle); atoiErr == nil {
+		user, err = cgf.DBClient.GetUserByID(userId)
+	} else {
+		user, err = cgf.DBClient.GetUserByHandle(handle)
+	}
+	// Suspended users and users on their way out are not shown.
+	if err != nil || user.IsSuspended || user.DeletionScheduledAt.IsZero() == false {
+		respondWithError(w, 404, "User not found")
+		return
+	}
+	respondWithJSON(w, 200, publicProfile{ID: user.ID, Handle: user.Handle, DisplayName: user.DisplayName, Bio: user.Bio,
+		Location: user.Location, Website: user.Website, AvatarURLs: cgf.Avatars.URLs(user.Avatar), IsChirpyRed: user.IsChirpyRed})
+}
+
+// handleUploadAvatar takes the image in the avatar field of a multipart form
+// and replaces the caller's avatar with thumbnails of it.
+func (cgf *apiConfig) handleUploadAvatar(w http.ResponseWriter, r *http.Request) {
+	// Leave room for the rest of the multipart form around the image.
+	r.Body = http.MaxBytesReader(w, r.Body, avatar.MaxUploadBytes+64<<10)
+	file, _, err := r.FormFile("avatar")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondWithError(w, 413, avatar.ErrTooLarge.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, 400, "Send the image in the avatar field of a multipart form")
+		return
+	}
+	defer file.Close()
+	img, err := avatar.Decode(file)
+	switch {
+	case errors.Is(err, avatar.ErrTooLarge):
+		respondWithError(w, 413, err.Error())
+		return
+	case errors.Is(err, avatar.ErrUnsupportedType):
+		respondWithError(w, 415, err.Error())
+		return
+	case err != nil:
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	user, err := cgf.DBClient.GetUserByID(principal(r).UserId)
+	if err != nil {
+		auth.Unauthorized(w)
+		return
+	}
+	key, err := cgf.Avatars.Save(user.ID, img)
+	if err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue saving the avatar")
+		return
+	}
+	cgf.setAvatar(w, user, key)
+}
+
+func (cgf *apiConfig) handleDeleteAvatar(w http.ResponseWriter, r *http.Request) {
+	user, err := cgf.DBClient.GetUserByID(principal(r).UserId)
+	if err != nil {
+		auth.Unauthorized(w)
+		return
+	}
+	cgf.setAvatar(w, user, "")
+}
+
+// setAvatar points user's profile at the thumbnails of key and removes the
+// ones it pointed at before.
+func (cgf *apiConfig) setAvatar(w http.ResponseWriter, user types.User, key string) {
+	profile := user.Profile
+	profile.Avatar = key
+	if _, err := cgf.DBClient.UpdateProfile(user.ID, profile); err != nil {
+		log.Print(err.Error())
+		cgf.Avatars.Remove(key)
+		respondWithError(w, 503, "There was an issue saving the avatar")
+		return
+	}
+	if err := cgf.Avatars.Remove(user.Avatar); err != nil {
+		log.Printf("Unable to remove avatar %s: %s", user.Avatar, err)
+	}
+	respondWithJSON(w, 200, struct {
+		AvatarURLs map[string]string `json:"avatar_urls"`
+	}{AvatarURLs: cgf.Avatars.URLs(key)})
+}
+
+// handleServeAvatar serves thumbnails by file name only, so nothing outside
+// the avatar directory can be reached.
+func (cgf *apiConfig) handleServeAvatar(w http.ResponseWriter, r *http.Request) {
+	name := filepath.Base(r.PathValue("file"))
+	thumbnail, err := os.Open(filepath.Join(cgf.Avatars.Dir, name))
+	if strings.HasSuffix(name, ".png") == false || err != nil {
+		respondWithError(w, 404, "Avatar not found")
+		return
+	}
+	defer thumbnail.Close()
+	info, err := thumbnail.Stat()
+	if err != nil || info.IsDir() {
+		respondWithError(w, 404, "Avatar not found")
+		return
+	}
+	// A new upload gets new file names, so these never change.
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Content-Type", "image/png")
+	http.ServeContent(w, r, name, info.ModTime(), thumbnail)
+}
+
+// handleDeleteUser schedules the deletion of the caller's account once they
+// confirm their password. Wrong passwords count against the login throttle.
+func (cgf *apiConfig) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Password == "" {
+		respondWithError(w, 400, "Invalid payload")
+		return
+	}
+	user, err := cgf.DBClient.GetUserByID(principal(r).UserId)
+	if err != nil {
+		auth.Unauthorized(w)
+		return
+	}
+	ip := clientIP(r)
+	if retryAfter := cgf.LoginThrottle.Check(user.Email, ip); retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		respondWithError(w, 429, "Too many failed login attempts, try again later")
+		return
+	}
+	if bcrypt.CompareHashAndPassword(user.Password, []byte(params.Password)) != nil {
+		cgf.LoginThrottle.Fail(user.Email, ip)
+		respondWithError(w, 401, "Incorrect password")
+		return
+	}
+	cgf.LoginThrottle.Release(user.Email, ip)
+	scheduled, err := cgf.Deleter.Schedule(user.ID, time.Now().UTC())
+	if err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue deleting the account")
+		return
+	}
+	log.Printf("SECURITY: user %d scheduled their account for deletion on %s", user.ID, scheduled.DeletionScheduledAt)
+	go cgf.sendDeletionNotice(scheduled)
+	respondWithJSON(w, 202, struct {
+		DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
+	}{DeletionScheduledAt: scheduled.DeletionScheduledAt})
+}
+
+func (cgf *apiConfig) sendDeletionNotice(user types.User) {
+	sendErr := cgf.Mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Your Chirpy account will be deleted",
+		Body: fmt.Sprintf("Your Chirpy account is scheduled to be deleted on %s.\n\n"+
+			"To keep it, log in at %s before then.\n", user.DeletionScheduledAt.Format(time.RFC1123), cgf.PublicURL),
+	})
+	if sendErr != nil {
+		log.Printf("Unable to send deletion notice to user %d: %s", user.ID, sendErr)
+	}
+}
+
+// handleCreateExport starts building an archive of the caller's data, which
+// they fetch from the Location returned once it is ready.
+func (cgf *apiConfig) handleCreateExport(w http.ResponseWriter, r *http.Request) {
+	started, err := cgf.Exporter.Start(principal(r).UserId, time.Now().UTC())
+	if err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue exporting your data")
+		return
+	}
+	w.Header().Set("Location", "/api/users/me/export/"+strconv.Itoa(started.ID))
+	respondWithJSON(w, 202, started)
+}
+
+// handleGetExport answers 202 with the export while it is being built and
+// the archive once it is ready.
+func (cgf *apiConfig) handleGetExport(w http.ResponseWriter, r *http.Request) {
+	exportId, err := strconv.Atoi(r.PathValue("exportId"))
+	if err != nil {
+		respondWithError(w, 400, "There was an issue with the provided export id")
+		return
+	}
+	found, err := cgf.DBClient.GetDataExport(exportId)
+	if err != nil || found.UserId != principal(r).UserId {
+		respondWithError(w, 404, utils.ErrDataExportNotFound.Error())
+		return
+	}
+	if found.ExpiresAt.After(time.Now().UTC()) == false {
+		respondWithError(w, 410, "Data export has expired")
+		return
+	}
+	switch found.Status {
+	case types.ExportPending:
+		respondWithJSON(w, 202, found)
+		return
+	case types.ExportFailed:
+		respondWithError(w, 500, "The data export failed, please request a new one")
+		return
+	}
+	archive, err := cgf.Exporter.Open(found)
+	if err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue reading your data export")
+		return
+	}
+	defer archive.Close()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chirpy-export-%d.zip"`, found.ID))
+	http.ServeContent(w, r, "", found.CompletedAt, archive)
+}
+
 func (cgf *apiConfig) handleCreateUser(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Email    string `json:"email"`
@@ -138,72 +672,94 @@ func (cgf *apiConfig) handleCreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	newUser, err := cgf.DBClient.CreateUsers(params.Email, hash)
+	if errors.Is(err, utils.ErrInvalidEmail) {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if errors.Is(err, utils.ErrEmailTaken) {
+		respondWithError(w, 409, err.Error())
+		return
+	}
 	if err != nil {
 		log.Print(err.Error())
 		respondWithError(w, 422, "There was an issue creating the user")
 		return
 	}
+	go cgf.sendEmailVerification(newUser)
 	respondWithJSON(w, 201, newUser)
 }
 
 func (cgf *apiConfig) handleRefresh(w http.ResponseWriter, r *http.Request) {
-	authHeader := r.Header.Get("Authorization")
-	authHeaderArr := strings.SplitAfter(authHeader, " ")
-	bearerToken := authHeaderArr[1]
-	refreshToken, getErr := cgf.DBClient.GetRefreshTokenByString(bearerToken)
-	if getErr != nil {
-		log.Print(getErr.Error())
-		respondWithError(w, 401, "There was an issue refreshing the token")
+	refreshToken := principal(r).RefreshToken
+	// Tokens issued to OAuth clients are refreshed at /oauth/token, where
+	// they stay limited to the scopes the user granted.
+	if refreshToken.ClientId != "" {
+		auth.Unauthorized(w)
 		return
 	}
-	if refreshToken.IsExpired() == true {
-		log.Printf("Refresh token: %s is expired", refreshToken.ID)
+	if refreshToken.IsExpired() == true && refreshToken.IsValid {
+		log.Printf("Refresh token: %d is expired", refreshToken.ID)
 		_, invalidateErr := cgf.DBClient.InvalidateToken(refreshToken.ID)
 		if invalidateErr != nil {
 			log.Print(invalidateErr.Error())
 		}
-		respondWithError(w, 401, "There was an issue with the token provided")
+		auth.Unauthorized(w)
+		return
+	}
+	rotated, rotateErr := cgf.DBClient.RotateRefreshToken(refreshToken.ID)
+	if errors.Is(rotateErr, utils.ErrRefreshTokenReused) {
+		log.Printf("SECURITY: refresh token %d of user %d was reused after rotation, revoked token family %d",
+			refreshToken.ID, refreshToken.UserId, refreshToken.FamilyId)
+		auth.Unauthorized(w)
+		return
+	}
+	if errors.Is(rotateErr, utils.ErrRefreshTokenInvalid) {
+		log.Printf("Refresh token: %d is invalid", refreshToken.ID)
+		auth.Unauthorized(w)
+		return
+	}
+	if rotateErr != nil {
+		log.Print(rotateErr.Error())
+		respondWithError(w, 503, "There was an issue refreshing the token")
 		return
 	}
-	if refreshToken.IsValid == false {
-		log.Printf("Refresh token: %s is invalid", refreshToken.ID)
-		respondWithError(w, 401, "There was an issue with the token provided")
+	user, err := cgf.DBClient.GetUserByID(refreshToken.UserId)
+	if err != nil {
+		auth.Unauthorized(w)
+		return
+	}
+	if user.IsSuspended {
+		respondWithError(w, 403, auth.ErrSuspended.Error())
 		return
 	}
-	accessToken, genErr := generateJWT(time.Hour, refreshToken.UserId, cgf.JWT_SECRET)
+	accessToken, genErr := cgf.generateJWT(time.Hour, user)
 	if genErr != nil {
 		log.Print(genErr.Error())
-		respondWithError(w, 401, "There was an issue generating a token")
+		respondWithError(w, 503, "There was an issue generating a token")
+		return
 	}
 	type tempStruct struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
-	result := tempStruct{Token: accessToken}
+	result := tempStruct{Token: accessToken, RefreshToken: rotated.Token}
 	respondWithJSON(w, 200, result)
 }
 
 func (cgf *apiConfig) handleRevoke(w http.ResponseWriter, r *http.Request) {
-	authHeader := r.Header.Get("Authorization")
-	authHeaderArr := strings.SplitAfter(authHeader, " ")
-	bearerToken := authHeaderArr[1]
-	refreshToken, getErr := cgf.DBClient.GetRefreshTokenByString(bearerToken)
-	if getErr != nil {
-		log.Print(getErr.Error())
-		respondWithError(w, 401, "There was an issue revoking the token")
-		return
-	}
+	refreshToken := principal(r).RefreshToken
 	if refreshToken.IsExpired() == true {
-		log.Printf("Refresh token: %s is already expired", refreshToken.ID)
-		respondWithJSON(w, 204, struct {
-		}{})
+		log.Printf("Refresh token: %d is already expired", refreshToken.ID)
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 	_, invalidateErr := cgf.DBClient.InvalidateToken(refreshToken.ID)
 	if invalidateErr != nil {
 		log.Print(invalidateErr.Error())
 		respondWithError(w, 503, "There was an issue invalidating the token")
+		return
 	}
-	respondWithJSON(w, 204, struct{}{})
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (cgf *apiConfig) handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -211,12 +767,7 @@ func (cgf *apiConfig) handleLogin(w http.ResponseWriter, r *http.Request) {
 		Email            string `json:"email"`
 		Password         string `json:"password"`
 		ExpiresInSeconds int    `json:"expires_in_seconds"`
-	}
-	type payload struct {
-		ID           int    `json:"id"`
-		Email        string `json:"email"`
-		Token        string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
+		DeviceLabel      string `json:"device_label"`
 	}
 	// First, decode request to see if it's valid
 	decoder := json.NewDecoder(r.Body)
@@ -224,69 +775,382 @@ func (cgf *apiConfig) handleLogin(w http.ResponseWriter, r *http.Request) {
 	decodeErr := decoder.Decode(&params)
 	if decodeErr != nil {
 		log.Print(decodeErr.Error())
-		respondWithError(w, 503, "Invalid payload")
+		respondWithError(w, 400, "Invalid payload")
+		return
+	}
+	ip := clientIP(r)
+	if retryAfter := cgf.LoginThrottle.Check(params.Email, ip); retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		respondWithError(w, 429, "Too many failed login attempts, try again later")
+		return
 	}
-	// Search for user
+	// Unknown emails are checked against a dummy hash so they take as long
+	// to reject as wrong passwords and get the same error.
 	user, err := cgf.DBClient.GetUserByEmail(params.Email)
+	passwordHash := dummyPasswordHash
+	if err == nil {
+		passwordHash = user.Password
+	}
+	hashErr := bcrypt.CompareHashAndPassword(passwordHash, []byte(params.Password))
+	if err != nil || hashErr != nil {
+		cgf.LoginThrottle.Fail(params.Email, ip)
+		respondWithError(w, 401, "Incorrect email or password")
+		return
+	}
+	if cgf.RequireVerifiedToLogin && user.IsEmailVerified == false {
+		cgf.LoginThrottle.Release(params.Email, ip)
+		respondWithError(w, 403, "Verify your email address before logging in")
+		return
+	}
+	mfa, err := cgf.DBClient.GetMFA(user.ID)
 	if err != nil {
+		cgf.LoginThrottle.Release(params.Email, ip)
 		log.Print(err.Error())
-		respondWithError(w, 401, err.Error())
+		respondWithError(w, 503, "There was an issue logging in")
 		return
 	}
-	//Hash pw and store it
-	pass := []byte(params.Password)
-	hashErr := bcrypt.CompareHashAndPassword(user.Password, pass)
-	if hashErr != nil {
-		log.Print(hashErr.Error())
-		respondWithError(w, 401, "Incorrect username or password")
+	if mfa.TOTPEnabled {
+		// Failures are only cleared once the second factor is in too, so
+		// guessing codes is throttled like guessing passwords.
+		cgf.LoginThrottle.Release(params.Email, ip)
+		challenge, err := cgf.DBClient.CreateOneTimeToken(user.ID, types.PurposeMFAChallenge, mfaChallengeTTL)
+		if err != nil {
+			log.Print(err.Error())
+			respondWithError(w, 503, "There was an issue logging in")
+			return
+		}
+		respondWithJSON(w, 200, struct {
+			MFARequired bool   `json:"mfa_required"`
+			MFAToken    string `json:"mfa_token"`
+		}{MFARequired: true, MFAToken: challenge.Token})
 		return
 	}
-	user.Password = nil
-	accessToken, genErr := generateJWT(time.Duration(params.ExpiresInSeconds)*time.Second, user.ID, cgf.JWT_SECRET)
+	cgf.LoginThrottle.Succeed(params.Email, ip)
+	cgf.completeLogin(w, r, user, params.ExpiresInSeconds, params.DeviceLabel)
+}
+
+// mfaChallengeTTL is how long a user has to enter their second factor after
+// their password was accepted.
+const mfaChallengeTTL = 5 * time.Minute
+
+// handleLoginMFA exchanges the mfa_token from handleLogin and a TOTP or
+// recovery code for the tokens a login without 2FA returns straight away.
+func (cgf *apiConfig) handleLoginMFA(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		MFAToken         string `json:"mfa_token"`
+		Code             string `json:"code"`
+		RecoveryCode     string `json:"recovery_code"`
+		ExpiresInSeconds int    `json:"expires_in_seconds"`
+		DeviceLabel      string `json:"device_label"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.MFAToken == "" {
+		respondWithError(w, 400, "Invalid payload")
+		return
+	}
+	// The challenge is used up by any attempt, so every guess costs a
+	// password login.
+	challenge, err := cgf.DBClient.UseOneTimeToken(params.MFAToken, types.PurposeMFAChallenge)
+	if err != nil {
+		auth.Unauthorized(w)
+		return
+	}
+	user, err := cgf.DBClient.GetUserByID(challenge.UserId)
+	if err != nil {
+		auth.Unauthorized(w)
+		return
+	}
+	ip := clientIP(r)
+	if retryAfter := cgf.LoginThrottle.Check(user.Email, ip); retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		respondWithError(w, 429, "Too many failed login attempts, try again later")
+		return
+	}
+	verifyErr := auth.VerifySecondFactor(cgf.DBClient, user.ID, params.Code, params.RecoveryCode, time.Now())
+	if errors.Is(verifyErr, utils.ErrMFACodeInvalid) {
+		cgf.LoginThrottle.Fail(user.Email, ip)
+		respondWithError(w, 401, verifyErr.Error())
+		return
+	}
+	if verifyErr != nil {
+		cgf.LoginThrottle.Release(user.Email, ip)
+		log.Print(verifyErr.Error())
+		respondWithError(w, 503, "There was an issue logging in")
+		return
+	}
+	if params.RecoveryCode != "" {
+		log.Printf("SECURITY: user %d logged in with a recovery code", user.ID)
+	}
+	cgf.LoginThrottle.Succeed(user.Email, ip)
+	cgf.completeLogin(w, r, user, params.ExpiresInSeconds, params.DeviceLabel)
+}
+
+// completeLogin issues an access token and a new session for user.
+func (cgf *apiConfig) completeLogin(w http.ResponseWriter, r *http.Request, user types.User, expiresInSeconds int, deviceLabel string) {
+	type payload struct {
+		ID              int    `json:"id"`
+		Email           string `json:"email"`
+		IsChirpyRed     bool   `json:"is_chirpy_red"`
+		IsEmailVerified bool   `json:"is_email_verified"`
+		Token           string `json:"token"`
+		RefreshToken    string `json:"refresh_token"`
+	}
+	if user.IsSuspended {
+		respondWithError(w, 403, auth.ErrSuspended.Error())
+		return
+	}
+	user, cancelled, cancelErr := cgf.Deleter.Cancel(user)
+	if cancelErr != nil {
+		log.Print(cancelErr.Error())
+		respondWithError(w, 503, "There was an issue logging in")
+		return
+	}
+	if cancelled {
+		log.Printf("User %d logged in and cancelled the deletion of their account", user.ID)
+	}
+	accessToken, genErr := cgf.generateJWT(time.Duration(expiresInSeconds)*time.Second, user)
 	if genErr != nil {
 		log.Print(genErr.Error())
 		respondWithError(w, 503, "There was an issue logging in")
 		return
 	}
-	user.Token = accessToken
-	refreshToken, generateErr := cgf.DBClient.GenerateRefreshToken(user.ID)
+	refreshToken, generateErr := cgf.DBClient.CreateSession(user.ID, sessionClient(r, deviceLabel))
 	if generateErr != nil {
+		log.Print(generateErr.Error())
 		respondWithError(w, 503, "There was an issue logging in")
+		return
 	}
-	result := payload{ID: user.ID, Email: user.Email, Token: user.Token, RefreshToken: refreshToken.Token}
+	result := payload{ID: user.ID, Email: user.Email, IsChirpyRed: user.IsChirpyRed, IsEmailVerified: user.IsEmailVerified,
+		Token: accessToken, RefreshToken: refreshToken.Token}
 	respondWithJSON(w, 200, result)
 }
-func (cgf *apiConfig) handleGetChirp(w http.ResponseWriter, r *http.Request) {
-	strChirpId := r.PathValue("chirpId")
-	chirpId, err := strconv.Atoi(strChirpId)
+
+func (cgf *apiConfig) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	user, err := cgf.DBClient.GetUserByID(principal(r).UserId)
 	if err != nil {
-		respondWithError(w, 500, "There was an issue with the provided chirp id")
+		auth.Unauthorized(w)
+		return
 	}
-	dbStruct, err := cgf.DBClient.LoadDB()
+	secret, err := totp.GenerateSecret()
 	if err != nil {
-		log.Print("Error: ", err.Error())
-		respondWithError(w, 500, "Unable to read DB")
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue enrolling")
 		return
 	}
-
-	dbChirp, err := findChirp(chirpId, dbStruct)
-	if err != nil {
-		respondWithError(w, 404, err.Error())
+	enrollErr := cgf.DBClient.EnrollTOTP(user.ID, secret)
+	if errors.Is(enrollErr, utils.ErrMFAEnabled) {
+		respondWithError(w, 409, enrollErr.Error())
 		return
 	}
-	respondWithJSON(w, 200, dbChirp)
-}
-func (cgf *apiConfig) handleReadChirps(w http.ResponseWriter, r *http.Request) {
-	chirps, err := cgf.DBClient.GetChirps()
-	if err != nil {
-		respondWithError(w, 503, err.Error())
+	if enrollErr != nil {
+		log.Print(enrollErr.Error())
+		respondWithError(w, 503, "There was an issue enrolling")
+		return
 	}
-	respondWithJSON(w, 200, chirps)
+	respondWithJSON(w, 200, struct {
+		Secret          string `json:"secret"`
+		ProvisioningURI string `json:"provisioning_uri"`
+	}{Secret: secret, ProvisioningURI: totp.ProvisioningURI(secret, "Chirpy", user.Email)})
 }
-func (cgf *apiConfig) middlewareMetricInc(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cgf.filserverHits++
-		next.ServeHTTP(w, r)
+
+// recoveryCodeCount is how many recovery codes a user gets on enrollment.
+const recoveryCodeCount = 10
+
+// handleConfirmTOTP turns 2FA on once the user proves their authenticator
+// produces the right codes, and shows the recovery codes this one time.
+func (cgf *apiConfig) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid payload")
+		return
+	}
+	userId := principal(r).UserId
+	mfa, err := cgf.DBClient.GetMFA(userId)
+	if err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue enabling two-factor authentication")
+		return
+	}
+	if mfa.TOTPEnabled {
+		respondWithError(w, 409, utils.ErrMFAEnabled.Error())
+		return
+	}
+	user, err := cgf.DBClient.GetUserByID(userId)
+	if err != nil {
+		auth.Unauthorized(w)
+		return
+	}
+	// Guesses are throttled like logins, or a stolen access token could try
+	// every code.
+	ip := clientIP(r)
+	if retryAfter := cgf.LoginThrottle.Check(user.Email, ip); retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		respondWithError(w, 429, "Too many failed login attempts, try again later")
+		return
+	}
+	verifyErr := auth.VerifySecondFactor(cgf.DBClient, userId, params.Code, "", time.Now())
+	if errors.Is(verifyErr, utils.ErrMFACodeInvalid) {
+		cgf.LoginThrottle.Fail(user.Email, ip)
+		respondWithError(w, 400, verifyErr.Error())
+		return
+	}
+	cgf.LoginThrottle.Release(user.Email, ip)
+	if verifyErr != nil {
+		log.Print(verifyErr.Error())
+		respondWithError(w, 503, "There was an issue enabling two-factor authentication")
+		return
+	}
+	codes, err := totp.GenerateRecoveryCodes(recoveryCodeCount)
+	if err == nil {
+		err = cgf.DBClient.EnableTOTP(userId, codes)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue enabling two-factor authentication")
+		return
+	}
+	log.Printf("SECURITY: user %d enabled two-factor authentication", userId)
+	respondWithJSON(w, 200, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{RecoveryCodes: codes})
+}
+
+// handleDisableTOTP turns 2FA off. It takes the password as well as a code,
+// so an access token alone can't remove the second factor.
+func (cgf *apiConfig) handleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Password == "" {
+		respondWithError(w, 400, "Invalid payload")
+		return
+	}
+	userId := principal(r).UserId
+	user, err := cgf.DBClient.GetUserByID(userId)
+	if err != nil {
+		auth.Unauthorized(w)
+		return
+	}
+	ip := clientIP(r)
+	if retryAfter := cgf.LoginThrottle.Check(user.Email, ip); retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		respondWithError(w, 429, "Too many failed login attempts, try again later")
+		return
+	}
+	if bcrypt.CompareHashAndPassword(user.Password, []byte(params.Password)) != nil {
+		cgf.LoginThrottle.Fail(user.Email, ip)
+		respondWithError(w, 401, "Incorrect password")
+		return
+	}
+	verifyErr := auth.VerifySecondFactor(cgf.DBClient, userId, params.Code, params.RecoveryCode, time.Now())
+	if errors.Is(verifyErr, utils.ErrMFACodeInvalid) {
+		cgf.LoginThrottle.Fail(user.Email, ip)
+		respondWithError(w, 400, verifyErr.Error())
+		return
+	}
+	cgf.LoginThrottle.Release(user.Email, ip)
+	if verifyErr != nil {
+		log.Print(verifyErr.Error())
+		respondWithError(w, 503, "There was an issue disabling two-factor authentication")
+		return
+	}
+	if err := cgf.DBClient.DisableTOTP(userId); err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue disabling two-factor authentication")
+		return
+	}
+	log.Printf("SECURITY: user %d disabled two-factor authentication", userId)
+	w.WriteHeader(http.StatusNoContent)
+}
+func (cgf *apiConfig) handleGetChirp(w http.ResponseWriter, r *http.Request) {
+	strChirpId := r.PathValue("chirpId")
+	chirpId, err := strconv.Atoi(strChirpId)
+	if err != nil {
+		respondWithError(w, 500, "There was an issue with the provided chirp id")
+	}
+	dbChirp, err := cgf.DBClient.GetChirp(chirpId)
+	if err != nil {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+	respondWithJSON(w, 200, dbChirp)
+}
+func (cgf *apiConfig) handleDeleteChirp(w http.ResponseWriter, r *http.Request) {
+	chirpId, err := strconv.Atoi(r.PathValue("chirpId"))
+	if err != nil {
+		respondWithError(w, 400, "There was an issue with the provided chirp id")
+		return
+	}
+	dbChirp, err := cgf.DBClient.GetChirp(chirpId)
+	if err != nil {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+	deleter := principal(r)
+	if deleter.CanDeleteChirp(dbChirp) == false {
+		respondWithError(w, 403, "You can only delete your own chirps")
+		return
+	}
+	deleteErr := cgf.DBClient.DeleteChirp(chirpId)
+	if deleteErr != nil {
+		log.Print(deleteErr.Error())
+		respondWithError(w, 404, deleteErr.Error())
+		return
+	}
+	if dbChirp.AuthorId != deleter.UserId {
+		log.Printf("SECURITY: %s %d deleted chirp %d of user %d", deleter.Role, deleter.UserId, chirpId, dbChirp.AuthorId)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cgf *apiConfig) handleReadChirps(w http.ResponseWriter, r *http.Request) {
+	query := types.ChirpQuery{Cursor: r.URL.Query().Get("cursor")}
+	if authorId := r.URL.Query().Get("author_id"); authorId != "" {
+		id, err := strconv.Atoi(authorId)
+		if err != nil || id <= 0 {
+			respondWithError(w, 400, "author_id must be a positive integer")
+			return
+		}
+		query.AuthorId = id
+	}
+	switch r.URL.Query().Get("sort") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		respondWithError(w, 400, "sort must be asc or desc")
+		return
+	}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		parsedLimit, err := strconv.Atoi(limit)
+		if err != nil || parsedLimit <= 0 || parsedLimit > utils.MaxChirpLimit {
+			respondWithError(w, 400, fmt.Sprintf("limit must be between 1 and %d", utils.MaxChirpLimit))
+			return
+		}
+		query.Limit = parsedLimit
+	}
+	page, err := cgf.DBClient.ListChirps(query)
+	if errors.Is(err, utils.ErrInvalidCursor) {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "Unable to read chirps")
+		return
+	}
+	respondWithJSON(w, 200, page)
+}
+func (cgf *apiConfig) middlewareMetricInc(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cgf.filserverHits++
+		next.ServeHTTP(w, r)
 	})
 }
 func (cgf *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request) {
@@ -337,19 +1201,386 @@ func (cgf *apiConfig) handleReset(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(body))
 }
 
+// dummyPasswordHash is compared against on logins to unknown emails.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// sessionClient describes the device a login request came from.
+func sessionClient(r *http.Request, deviceLabel string) types.SessionClient {
+	return types.SessionClient{DeviceLabel: deviceLabel, UserAgent: r.UserAgent(), IP: clientIP(r)}
+}
+
+func (cgf *apiConfig) handleUnlockUser(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.Atoi(r.PathValue("userId"))
+	if err != nil {
+		respondWithError(w, 400, "There was an issue with the provided user id")
+		return
+	}
+	user, err := cgf.DBClient.GetUserByID(userId)
+	if err != nil {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+	cgf.LoginThrottle.Unlock(user.Email)
+	log.Printf("SECURITY: %s %d unlocked logins to user %d", principal(r).Role, principal(r).UserId, user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// targetUser loads the user an admin route's {userId} names, writing the
+// error response if it can't.
+func (cgf *apiConfig) targetUser(w http.ResponseWriter, r *http.Request) (types.User, bool) {
+	userId, err := strconv.Atoi(r.PathValue("userId"))
+	if err != nil {
+		respondWithError(w, 400, "There was an issue with the provided user id")
+		return types.User{}, false
+	}
+	user, err := cgf.DBClient.GetUserByID(userId)
+	if err != nil {
+		respondWithError(w, 404, err.Error())
+		return types.User{}, false
+	}
+	return user, true
+}
+
+// handleSetRole grants or revokes a role by setting it. Admins can't change
+// their own role, so there is always an admin left. The new role applies
+// from the user's next request, whatever their access token says.
+func (cgf *apiConfig) handleSetRole(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Role string `json:"role"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || types.ValidRole(params.Role) == false {
+		respondWithError(w, 400, fmt.Sprintf("role must be one of %s, %s or %s", types.RoleUser, types.RoleModerator, types.RoleAdmin))
+		return
+	}
+	user, ok := cgf.targetUser(w, r)
+	if ok == false {
+		return
+	}
+	actor := principal(r)
+	if user.ID == actor.UserId {
+		respondWithError(w, 403, "You can't change your own role")
+		return
+	}
+	updated, err := cgf.DBClient.SetRole(user.ID, params.Role)
+	if err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue changing the role")
+		return
+	}
+	log.Printf("SECURITY: admin %d changed the role of user %d from %s to %s", actor.UserId, user.ID, user.Role, updated.Role)
+	updated.Password = nil
+	respondWithJSON(w, 200, updated)
+}
+
+// handleSuspendUser suspends a user the caller outranks and ends their
+// sessions.
+func (cgf *apiConfig) handleSuspendUser(w http.ResponseWriter, r *http.Request) {
+	cgf.setSuspended(w, r, true)
+}
+
+func (cgf *apiConfig) handleUnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	cgf.setSuspended(w, r, false)
+}
+
+func (cgf *apiConfig) setSuspended(w http.ResponseWriter, r *http.Request, isSuspended bool) {
+	user, ok := cgf.targetUser(w, r)
+	if ok == false {
+		return
+	}
+	actor := principal(r)
+	if auth.Outranks(actor.Role, user.Role) == false {
+		respondWithError(w, 403, fmt.Sprintf("A %s can't suspend a %s", actor.Role, user.Role))
+		return
+	}
+	updated, err := cgf.DBClient.SetSuspended(user.ID, isSuspended)
+	if err == nil && isSuspended {
+		err = cgf.DBClient.InvalidateUsersToken(user.ID)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue suspending the user")
+		return
+	}
+	log.Printf("SECURITY: %s %d set suspension of user %d to %t", actor.Role, actor.UserId, user.ID, isSuspended)
+	updated.Password = nil
+	respondWithJSON(w, 200, updated)
+}
+
+// passwordResetTTL is how long a password reset link works.
+const passwordResetTTL = 30 * time.Minute
+
+func (cgf *apiConfig) handleRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Email == "" {
+		respondWithError(w, 400, "Invalid payload")
+		return
+	}
+	// The response is the same whether or not the email belongs to anyone,
+	// and the email goes out after responding so timing doesn't tell either.
+	if user, err := cgf.DBClient.GetUserByEmail(params.Email); err == nil {
+		go cgf.sendPasswordReset(user)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cgf *apiConfig) sendPasswordReset(user types.User) {
+	token, err := cgf.DBClient.CreateOneTimeToken(user.ID, types.PurposePasswordReset, passwordResetTTL)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+	link := cgf.PublicURL + "/app/reset-password?token=" + token.Token
+	sendErr := cgf.Mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your Chirpy account.\n\n"+
+			"To choose a new password, open %s within %d minutes.\n\n"+
+			"If this wasn't you, you can ignore this email.\n", link, int(passwordResetTTL.Minutes())),
+	})
+	if sendErr != nil {
+		log.Printf("Unable to send password reset to user %d: %s", user.ID, sendErr)
+	}
+}
+
+func (cgf *apiConfig) handleConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Token == "" || params.Password == "" {
+		respondWithError(w, 400, "Invalid payload")
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(params.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 400, "Invalid password")
+		return
+	}
+	token, err := cgf.DBClient.UseOneTimeToken(params.Token, types.PurposePasswordReset)
+	if errors.Is(err, utils.ErrOneTimeTokenInvalid) {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue resetting the password")
+		return
+	}
+	user, err := cgf.DBClient.UpdateUser(token.UserId, types.UserUpdate{Password: hash})
+	if err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue resetting the password")
+		return
+	}
+	// Whoever knew the old password may still be logged in.
+	if err := cgf.DBClient.InvalidateUsersToken(user.ID); err != nil {
+		log.Print(err.Error())
+	}
+	cgf.LoginThrottle.Unlock(user.Email)
+	log.Printf("SECURITY: user %d reset their password, all sessions were revoked", user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// emailVerificationTTL is how long an email verification link works.
+const emailVerificationTTL = 48 * time.Hour
+
+func (cgf *apiConfig) sendEmailVerification(user types.User) {
+	token, err := cgf.DBClient.CreateOneTimeToken(user.ID, types.PurposeEmailVerification, emailVerificationTTL)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+	link := cgf.PublicURL + "/app/verify-email?token=" + token.Token
+	sendErr := cgf.Mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Verify your Chirpy email address",
+		Body: fmt.Sprintf("Welcome to Chirpy!\n\n"+
+			"To confirm this is your email address, open %s within %d hours.\n", link, int(emailVerificationTTL.Hours())),
+	})
+	if sendErr != nil {
+		log.Printf("Unable to send email verification to user %d: %s", user.ID, sendErr)
+	}
+}
+
+func (cgf *apiConfig) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Token == "" {
+		respondWithError(w, 400, "Invalid payload")
+		return
+	}
+	token, err := cgf.DBClient.UseOneTimeToken(params.Token, types.PurposeEmailVerification)
+	if errors.Is(err, utils.ErrOneTimeTokenInvalid) {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue verifying the email address")
+		return
+	}
+	user, err := cgf.DBClient.SetEmailVerified(token.UserId, true)
+	if err != nil {
+		respondWithError(w, 400, utils.ErrOneTimeTokenInvalid.Error())
+		return
+	}
+	if promoted, ok, err := auth.BootstrapAdmin(cgf.DBClient, cgf.BootstrapAdminEmail); err != nil {
+		log.Printf("Unable to bootstrap the first admin: %s", err)
+	} else if ok && promoted.ID == user.ID {
+		user = promoted
+	}
+	user.Password = nil
+	respondWithJSON(w, 200, user)
+}
+
+func (cgf *apiConfig) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := cgf.DBClient.ListSessions(principal(r).UserId)
+	if err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue listing your sessions")
+		return
+	}
+	respondWithJSON(w, 200, sessions)
+}
+
+func (cgf *apiConfig) handleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	sessionId, err := strconv.Atoi(r.PathValue("sessionId"))
+	if err != nil {
+		respondWithError(w, 400, "There was an issue with the provided session id")
+		return
+	}
+	// A session's ID is the ID of the first token in its family, which
+	// also tells us who it belongs to.
+	first, err := cgf.DBClient.GetRefreshTokenID(sessionId)
+	if err != nil || first.FamilyId != sessionId || first.UserId != principal(r).UserId {
+		respondWithError(w, 404, "Session not found")
+		return
+	}
+	if revokeErr := cgf.DBClient.RevokeRefreshTokenFamily(sessionId); revokeErr != nil {
+		log.Print(revokeErr.Error())
+		respondWithError(w, 503, "There was an issue ending the session")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cgf *apiConfig) handleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	if err := cgf.DBClient.InvalidateUsersToken(principal(r).UserId); err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue ending your sessions")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// maxApiTokenNameLength bounds the label users give their API tokens.
+const maxApiTokenNameLength = 100
+
+// handleCreateApiToken mints an API token. The token itself is only in this
+// response; afterwards only its hash is kept.
+func (cgf *apiConfig) handleCreateApiToken(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, 400, "Invalid payload")
+		return
+	}
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || len(params.Name) > maxApiTokenNameLength {
+		respondWithError(w, 400, fmt.Sprintf("Name must be between 1 and %d characters", maxApiTokenNameLength))
+		return
+	}
+	if len(params.Scopes) == 0 {
+		respondWithError(w, 400, "At least one scope is required")
+		return
+	}
+	for _, scope := range params.Scopes {
+		if auth.ValidScope(scope) == false {
+			respondWithError(w, 400, fmt.Sprintf("Unknown scope %q, expected one of %s", scope, strings.Join(auth.Scopes, ", ")))
+			return
+		}
+	}
+	if params.ExpiresInDays < 0 {
+		respondWithError(w, 400, "expires_in_days can't be negative")
+		return
+	}
+	expiresAt := time.Time{}
+	if params.ExpiresInDays > 0 {
+		expiresAt = time.Now().UTC().AddDate(0, 0, params.ExpiresInDays)
+	}
+	token, err := cgf.DBClient.CreateApiToken(principal(r).UserId, params.Name, params.Scopes, expiresAt)
+	if err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue creating the token")
+		return
+	}
+	respondWithJSON(w, 201, struct {
+		types.ApiToken
+		Token string `json:"token"`
+	}{ApiToken: token, Token: token.Token})
+}
+
+func (cgf *apiConfig) handleListApiTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := cgf.DBClient.ListApiTokens(principal(r).UserId)
+	if err != nil {
+		log.Print(err.Error())
+		respondWithError(w, 503, "There was an issue listing your tokens")
+		return
+	}
+	respondWithJSON(w, 200, tokens)
+}
+
+func (cgf *apiConfig) handleRevokeApiToken(w http.ResponseWriter, r *http.Request) {
+	tokenId, err := strconv.Atoi(r.PathValue("tokenId"))
+	if err != nil {
+		respondWithError(w, 400, "There was an issue with the provided token id")
+		return
+	}
+	revokeErr := cgf.DBClient.RevokeApiToken(principal(r).UserId, tokenId)
+	if errors.Is(revokeErr, utils.ErrApiTokenNotFound) {
+		respondWithError(w, 404, revokeErr.Error())
+		return
+	}
+	if revokeErr != nil {
+		log.Print(revokeErr.Error())
+		respondWithError(w, 503, "There was an issue revoking the token")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// principal returns who the request was authenticated as by one of the
+// require middlewares.
+func principal(r *http.Request) auth.Principal {
+	principal, _ := auth.PrincipalFromContext(r.Context())
+	return principal
+}
+
 func handlerReadiness(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(http.StatusText(http.StatusOK)))
 }
-func findChirp(chirpId int, dbstruct types.Database) (types.Chirp, error) {
-	for i, chirp := range dbstruct.Chirps {
-		if i == chirpId {
-			return chirp, nil
-		}
-	}
-	return types.Chirp{}, errors.New(fmt.Sprintf("Unable to find chirp: %v", chirpId))
-}
 func respondWithCleanedBody(w http.ResponseWriter, chirp string) {
 	profaneWords := map[string]struct{}{
 		"kerfuffle": {},
@@ -376,14 +1607,15 @@ func respondWithCleanedBody(w http.ResponseWriter, chirp string) {
 
 }
 
+// respondWithJSON writes payload as the response. Payloads can carry
+// secrets, like new API tokens and recovery codes, so they are never logged.
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	w.WriteHeader(code)
 	data, err := json.Marshal(payload)
 	if err != nil {
 		log.Print(err.Error())
 	}
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Println("Outgoing Data: ", data)
+	w.WriteHeader(code)
 	_, writeErr := w.Write(data)
 	if writeErr != nil {
 		log.Print(writeErr.Error())
@@ -404,19 +1636,30 @@ func respondWithError(w http.ResponseWriter, code int, msg string) {
 	return
 }
 
-func generateJWT(expireInSeconds time.Duration, userId int, jwtSecret string) (string, error) {
-	tempExpiresAt := jwt.NewNumericDate(time.Now().UTC().Add(time.Hour))
-	if expireInSeconds.Seconds() != 0.0 {
+func (cgf *apiConfig) generateJWT(expireInSeconds time.Duration, user types.User) (string, error) {
+	return cgf.generateScopedJWT(expireInSeconds, user, "", nil)
+}
+
+// generateScopedJWT issues an access token to an OAuth client, which only
+// carries scopes. An empty clientId issues the user's own token.
+func (cgf *apiConfig) generateScopedJWT(expireInSeconds time.Duration, user types.User, clientId string, scopes []string) (string, error) {
+	tempExpiresAt := jwt.NewNumericDate(time.Now().UTC().Add(maxAccessTokenLifetime))
+	if expireInSeconds > 0 && expireInSeconds < maxAccessTokenLifetime {
 		tempExpiresAt = jwt.NewNumericDate(time.Now().UTC().Add(time.Duration(expireInSeconds)))
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: tempExpiresAt,
-		Subject:   strconv.Itoa(userId),
-	})
-
-	signedToken, signingErr := token.SignedString([]byte(jwtSecret))
-	return signedToken, signingErr
-
+	claims := auth.AccessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "chirpy",
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: tempExpiresAt,
+			Subject:   strconv.Itoa(user.ID),
+		},
+		Role: user.Role,
+	}
+	if clientId != "" {
+		claims.Role = ""
+		claims.ClientId = clientId
+		claims.Scope = strings.Join(scopes, " ")
+	}
+	return cgf.Keys.Sign(claims)
 }
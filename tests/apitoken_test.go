@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/auth"
+)
+
+func testApiTokens(t *testing.T, store utils.Store) {
+	user, _ := store.CreateUsers("automation@example.com", []byte("hash"))
+	other, _ := store.CreateUsers("other@example.com", []byte("hash"))
+	token, err := store.CreateApiToken(user.ID, "CI", []string{auth.ScopeChirpsWrite}, time.Time{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.HasPrefix(token.Token, utils.ApiTokenMarker) == false {
+		t.Fatalf("Expected the token to start with %s, got %s", utils.ApiTokenMarker, token.Token)
+	}
+	used, err := store.UseApiToken(token.Token)
+	if err != nil || used.ID != token.ID || used.UserId != user.ID || used.LastUsedAt.IsZero() {
+		t.Fatalf("Unable to use the token: %v", err)
+	}
+	if len(used.Scopes) != 1 || used.Scopes[0] != auth.ScopeChirpsWrite {
+		t.Fatalf("Expected the granted scopes, got %v", used.Scopes)
+	}
+	if _, err := store.UseApiToken(token.Token + "x"); errors.Is(err, utils.ErrApiTokenInvalid) == false {
+		t.Fatal("Unknown tokens should be rejected")
+	}
+	tokens, err := store.ListApiTokens(user.ID)
+	if err != nil || len(tokens) != 1 || tokens[0].Token != "" || tokens[0].TokenHash == token.Token {
+		t.Fatalf("Expected one token without its plaintext, got %+v: %v", tokens, err)
+	}
+	if err := store.RevokeApiToken(other.ID, token.ID); errors.Is(err, utils.ErrApiTokenNotFound) == false {
+		t.Fatal("Users should not be able to revoke each other's tokens")
+	}
+	if err := store.RevokeApiToken(user.ID, token.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := store.UseApiToken(token.Token); errors.Is(err, utils.ErrApiTokenInvalid) == false {
+		t.Fatal("Revoked tokens should be rejected")
+	}
+	if tokens, _ := store.ListApiTokens(user.ID); len(tokens) != 0 {
+		t.Fatalf("Revoked tokens should not be listed, got %+v", tokens)
+	}
+	expired, _ := store.CreateApiToken(user.ID, "Old", []string{auth.ScopeChirpsRead}, time.Now().Add(-time.Minute))
+	if _, err := store.UseApiToken(expired.Token); errors.Is(err, utils.ErrApiTokenInvalid) == false {
+		t.Fatal("Expired tokens should be rejected")
+	}
+}
+
+func TestApiTokens(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	testApiTokens(t, dbClient)
+}
+
+func TestSQLiteApiTokens(t *testing.T) {
+	testApiTokens(t, newSQLiteClient(t))
+}
+
+func TestRequireScope(t *testing.T) {
+	store := newSQLiteClient(t)
+	keys, _ := auth.NewKeySet(auth.KeySetOptions{LegacySecret: jwtSecret})
+	user, _ := store.CreateUsers("scoped@example.com", []byte("hash"))
+	token, _ := store.CreateApiToken(user.ID, "Bot", []string{auth.ScopeChirpsWrite}, time.Time{})
+
+	recorder := &principalRecorder{}
+	handler := auth.RequireScope(keys, store, auth.ScopeChirpsWrite, recorder)
+	if resp := serve(handler, "Bearer "+token.Token); resp.Code != http.StatusOK {
+		t.Fatalf("Expected a token with the scope to get through, got %d", resp.Code)
+	}
+	if recorder.principal.UserId != user.ID || recorder.principal.ApiTokenId != token.ID {
+		t.Fatalf("Unexpected principal %+v", recorder.principal)
+	}
+	if resp := serve(auth.RequireScope(keys, store, auth.ScopeProfileWrite, recorder), "Bearer "+token.Token); resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for a token without the scope, got %d", resp.Code)
+	}
+	if resp := serve(handler, "Bearer "+signAccessToken(t, keys, user.ID, time.Minute)); resp.Code != http.StatusOK {
+		t.Fatalf("Access tokens should carry every scope, got %d", resp.Code)
+	}
+	if resp := serve(handler, ""); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without credentials, got %d", resp.Code)
+	}
+	if resp := serve(auth.RequireAccessToken(keys, recorder), "Bearer "+token.Token); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("API tokens should not pass for an access token, got %d", resp.Code)
+	}
+
+	allow := auth.AllowScope(keys, store, auth.ScopeChirpsRead, recorder)
+	if resp := serve(allow, ""); resp.Code != http.StatusOK {
+		t.Fatalf("Public routes should allow anonymous requests, got %d", resp.Code)
+	}
+	if resp := serve(allow, "Bearer "+token.Token); resp.Code != http.StatusForbidden {
+		t.Fatalf("Tokens sent to public routes should still need the scope, got %d", resp.Code)
+	}
+	if resp := serve(allow, "Bearer nonsense"); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Invalid credentials should be rejected on public routes, got %d", resp.Code)
+	}
+}
@@ -0,0 +1,148 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/auth"
+)
+
+const jwtSecret = "test-secret"
+
+func signAccessToken(t *testing.T, keys *auth.KeySet, userId int, expiresIn time.Duration) string {
+	signed, err := keys.Sign(jwt.RegisteredClaims{
+		Issuer:    "chirpy",
+		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+		Subject:   strconv.Itoa(userId),
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return signed
+}
+
+// signLegacyToken signs an HS256 token the way tokens were signed before
+// key sets, with secret and no kid.
+func signLegacyToken(t *testing.T, userId int, secret string, issuedAt time.Time, expiresAt time.Time) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    "chirpy",
+		IssuedAt:  jwt.NewNumericDate(issuedAt),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+		Subject:   strconv.Itoa(userId),
+	})
+	signed, err := token.SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return signed
+}
+
+// principalRecorder is a handler that remembers the principal it was called
+// with.
+type principalRecorder struct {
+	called    bool
+	principal auth.Principal
+}
+
+func (recorder *principalRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	recorder.called = true
+	recorder.principal, _ = auth.PrincipalFromContext(r.Context())
+	w.WriteHeader(http.StatusOK)
+}
+
+func serve(handler http.Handler, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestGetBearerToken(t *testing.T) {
+	cases := map[string]string{
+		"Bearer abc":   "abc",
+		"bearer abc":   "abc",
+		"Bearer  abc ": "abc",
+		"":             "",
+		"Bearer":       "",
+		"Bearer ":      "",
+		"ApiKey abc":   "",
+		"Basic abc":    "",
+	}
+	for header, want := range cases {
+		headers := http.Header{}
+		headers.Set("Authorization", header)
+		got, err := auth.GetBearerToken(headers)
+		if want == "" && err == nil {
+			t.Errorf("%q should be rejected, got %q", header, got)
+		}
+		if want != "" && got != want {
+			t.Errorf("%q: expected %q, got %q (%v)", header, want, got, err)
+		}
+	}
+}
+
+func TestRequireAccessToken(t *testing.T) {
+	keys, _ := auth.NewKeySet(auth.KeySetOptions{LegacySecret: jwtSecret})
+	recorder := &principalRecorder{}
+	handler := auth.RequireAccessToken(keys, recorder)
+	failures := []string{
+		"",
+		"Bearer not-a-jwt",
+		"Bearer " + signLegacyToken(t, 3, "wrong-secret", time.Now().Add(-time.Hour), time.Now().Add(time.Minute)),
+		"Bearer " + signAccessToken(t, keys, 3, -time.Hour),
+		"ApiKey " + signAccessToken(t, keys, 3, time.Hour),
+	}
+	for _, header := range failures {
+		resp := serve(handler, header)
+		if resp.Code != http.StatusUnauthorized || resp.Body.String() != `{"error":"Unauthorized"}` {
+			t.Errorf("%q: expected a uniform 401, got %d %s", header, resp.Code, resp.Body.String())
+		}
+	}
+	if recorder.called {
+		t.Fatal("Rejected requests should not reach the handler")
+	}
+	resp := serve(handler, "Bearer "+signAccessToken(t, keys, 3, time.Hour))
+	if resp.Code != http.StatusOK || recorder.principal.UserId != 3 {
+		t.Fatalf("Expected user 3 to be let through, got %d %v", resp.Code, recorder.principal)
+	}
+}
+
+func TestRequireRefreshToken(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	user, _ := dbClient.CreateUsers("refresh@example.com", []byte("hash"))
+	token, _ := dbClient.GenerateRefreshToken(user.ID)
+	recorder := &principalRecorder{}
+	handler := auth.RequireRefreshToken(dbClient, recorder)
+	if resp := serve(handler, "Bearer unknown"); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Unknown refresh tokens should be rejected, got %d", resp.Code)
+	}
+	serve(handler, "Bearer "+token.Token)
+	if recorder.principal.UserId != user.ID || recorder.principal.RefreshToken.ID != token.ID {
+		t.Fatalf("Unexpected principal %v", recorder.principal)
+	}
+}
+
+func TestRequireApiKey(t *testing.T) {
+	recorder := &principalRecorder{}
+	handler := auth.RequireApiKey(map[string]string{"key-1": "polka"}, recorder)
+	for _, header := range []string{"", "ApiKey", "ApiKey key-2", "Bearer key-1"} {
+		if resp := serve(handler, header); resp.Code != http.StatusUnauthorized {
+			t.Errorf("%q: expected 401, got %d", header, resp.Code)
+		}
+	}
+	serve(handler, "apikey key-1")
+	if recorder.principal.Service != "polka" {
+		t.Fatalf("Expected the polka service, got %v", recorder.principal)
+	}
+}
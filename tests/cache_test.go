@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+const benchmarkRecords = 2000
+
+func TestIndexesFollowUpdates(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	user, _ := dbClient.CreateUsers("old@example.com", []byte("hash"))
+	newEmail := "new@example.com"
+	dbClient.UpdateUser(user.ID, types.UserUpdate{Email: &newEmail})
+	if _, err := dbClient.GetUserByEmail("old@example.com"); err == nil {
+		t.Fatal("Old email should no longer be indexed")
+	}
+	if found, err := dbClient.GetUserByEmail("new@example.com"); err != nil || found.ID != user.ID {
+		t.Fatalf("New email should resolve to user %d: %v", user.ID, err)
+	}
+	token, _ := dbClient.GenerateRefreshToken(user.ID)
+	if found, err := dbClient.GetRefreshTokenByString(token.Token); err != nil || found.ID != token.ID {
+		t.Fatalf("Refresh token should be indexed: %v", err)
+	}
+	dbClient.Update(func(tx *utils.Tx) error {
+		utils.Remove(tx, tx.RefreshTokens, token.ID)
+		return nil
+	})
+	if _, err := dbClient.GetRefreshTokenByString(token.Token); err == nil {
+		t.Fatal("Deleted refresh token should no longer be indexed")
+	}
+}
+
+func TestLoadDBReturnsACopy(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	dbData, _ := dbClient.LoadDB()
+	dbData.Chirps[1] = types.Chirp{ID: 1, Body: "Not written"}
+	if _, err := dbClient.GetChirp(1); err == nil {
+		t.Fatal("Modifying a loaded copy should not change the resident database")
+	}
+}
+
+// seedBenchmarkDB fills the database with benchmarkRecords users, each with
+// one refresh token, in a single write.
+func seedBenchmarkDB(b *testing.B) *utils.DataBaseClient {
+	dbClient, err := utils.NewDB("../database/database.json")
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	dbData, _ := dbClient.LoadDB()
+	for id := 1; id <= benchmarkRecords; id++ {
+		dbData.Users[id] = types.User{ID: id, Email: fmt.Sprintf("user%d@example.com", id), Password: []byte("hash")}
+		dbData.RefreshTokens[id] = types.RefreshToken{ID: id, UserId: id, Token: fmt.Sprintf("token-%d", id), IsValid: true, ExpiresAt: time.Now().Add(time.Hour)}
+	}
+	if err := dbClient.WriteDB(dbData); err != nil {
+		b.Fatal(err.Error())
+	}
+	b.Cleanup(func() {
+		dbClient.Close()
+		os.Remove("../database/database.json")
+	})
+	return dbClient
+}
+
+// diskScan is the lookup path DataBaseClient used before the database was
+// cached: read and decode the whole file, then scan it.
+func diskScan(path string, match func(data types.Database) bool) error {
+	dataBytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data := types.Database{}
+	if err := json.Unmarshal(dataBytes, &data); err != nil {
+		return err
+	}
+	if match(data) == false {
+		return errors.New("Not found")
+	}
+	return nil
+}
+
+func BenchmarkGetUserByEmailDiskScan(b *testing.B) {
+	dbClient := seedBenchmarkDB(b)
+	email := fmt.Sprintf("user%d@example.com", benchmarkRecords)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := diskScan(dbClient.Path, func(data types.Database) bool {
+			for _, user := range data.Users {
+				if user.Email == email {
+					return true
+				}
+			}
+			return false
+		})
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func BenchmarkGetUserByEmailCached(b *testing.B) {
+	dbClient := seedBenchmarkDB(b)
+	email := fmt.Sprintf("user%d@example.com", benchmarkRecords)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dbClient.GetUserByEmail(email); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func BenchmarkGetRefreshTokenDiskScan(b *testing.B) {
+	dbClient := seedBenchmarkDB(b)
+	token := fmt.Sprintf("token-%d", benchmarkRecords)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := diskScan(dbClient.Path, func(data types.Database) bool {
+			for _, refreshToken := range data.RefreshTokens {
+				if refreshToken.Token == token {
+					return true
+				}
+			}
+			return false
+		})
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func BenchmarkGetRefreshTokenCached(b *testing.B) {
+	dbClient := seedBenchmarkDB(b)
+	token := fmt.Sprintf("token-%d", benchmarkRecords)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dbClient.GetRefreshTokenByString(token); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+// BenchmarkSetChirpyRed writes one user of a database holding
+// benchmarkRecords of them, which should cost no more than in an empty one.
+func BenchmarkSetChirpyRed(b *testing.B) {
+	dbClient := seedBenchmarkDB(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dbClient.SetChirpyRed(benchmarkRecords, i%2 == 0); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func BenchmarkCreateChirp(b *testing.B) {
+	dbClient := seedBenchmarkDB(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dbClient.CreateChirp("Benchmark Chirp", benchmarkRecords); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
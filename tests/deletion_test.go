@@ -0,0 +1,197 @@
+package tests
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/account"
+	"github.com/mdwiltfong/chirpy/utils/auth"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+func testAccountDeletion(t *testing.T, store utils.Store) {
+	leaving, _ := store.CreateUsers("leaving@example.com", []byte("hash"))
+	staying, _ := store.CreateUsers("staying@example.com", []byte("hash"))
+	leavingChirp, _ := store.CreateChirp("Goodbye", leaving.ID)
+	stayingChirp, _ := store.CreateChirp("Still here", staying.ID)
+	session, _ := store.CreateSession(leaving.ID, types.SessionClient{DeviceLabel: "Laptop"})
+	apiToken, _ := store.CreateApiToken(leaving.ID, "CI", []string{auth.ScopeChirpsRead}, time.Time{})
+	reset, _ := store.CreateOneTimeToken(leaving.ID, types.PurposePasswordReset, time.Hour)
+	client, _ := store.CreateOAuthClient(leaving.ID, "Leaving's App", []string{"https://app.example/cb"}, false)
+	store.EnrollTOTP(leaving.ID, "JBSWY3DPEHPK3PXP")
+	stayingSession, _ := store.CreateSession(staying.ID, types.SessionClient{})
+
+	now := time.Now().UTC()
+	cleanedUp := []int{}
+	deleter := account.Deleter{Store: store, GracePeriod: 24 * time.Hour, Cleanup: func(user types.User) error {
+		cleanedUp = append(cleanedUp, user.ID)
+		return nil
+	}}
+	scheduled, err := deleter.Schedule(leaving.ID, now)
+	if err != nil || scheduled.DeletionScheduledAt.Sub(now.Add(24*time.Hour)).Abs() > time.Second {
+		t.Fatalf("Expected the deletion a grace period from now, got %v: %v", scheduled.DeletionScheduledAt, err)
+	}
+	if sessions, _ := store.ListSessions(leaving.ID); len(sessions) != 0 {
+		t.Fatalf("Scheduling should log the user out everywhere, got %+v", sessions)
+	}
+	if again, _ := deleter.Schedule(leaving.ID, now.Add(time.Hour)); again.DeletionScheduledAt.Equal(scheduled.DeletionScheduledAt) == false {
+		t.Fatalf("Scheduling again should keep the date, got %v", again.DeletionScheduledAt)
+	}
+
+	if deleted, err := deleter.FinalizeDue(now.Add(23 * time.Hour)); err != nil || len(deleted) != 0 {
+		t.Fatalf("Nothing should be deleted during the grace period, got %v: %v", deleted, err)
+	}
+	due, err := store.ListUsersDueForDeletion(now.Add(25 * time.Hour))
+	if err != nil || len(due) != 1 || due[0].ID != leaving.ID {
+		t.Fatalf("Expected only the leaving user to be due, got %+v: %v", due, err)
+	}
+	deleted, err := deleter.FinalizeDue(now.Add(25 * time.Hour))
+	if err != nil || len(deleted) != 1 || deleted[0] != leaving.ID {
+		t.Fatalf("Expected the leaving user to be deleted, got %v: %v", deleted, err)
+	}
+	if len(cleanedUp) != 1 || cleanedUp[0] != leaving.ID {
+		t.Fatalf("Expected Cleanup to run for the deleted user, got %v", cleanedUp)
+	}
+
+	if _, err := store.GetUserByID(leaving.ID); err == nil {
+		t.Fatal("The user should be gone")
+	}
+	if _, err := store.GetUserByEmail("leaving@example.com"); err == nil {
+		t.Fatal("The email should be free again")
+	}
+	if _, err := store.GetChirp(leavingChirp.ID); err == nil {
+		t.Fatal("The user's chirps should be deleted")
+	}
+	if token, _ := store.GetRefreshTokenID(session.ID); token.IsValid {
+		t.Fatal("The user's refresh tokens should be revoked")
+	}
+	if _, err := store.UseApiToken(apiToken.Token); err == nil {
+		t.Fatal("The user's API tokens should be revoked")
+	}
+	if _, err := store.UseOneTimeToken(reset.Token, types.PurposePasswordReset); err == nil {
+		t.Fatal("The user's one-time tokens should be gone")
+	}
+	if _, err := store.GetOAuthClient(client.ClientId); err == nil {
+		t.Fatal("The user's OAuth clients should be gone")
+	}
+	if mfa, _ := store.GetMFA(leaving.ID); mfa.TOTPSecret != "" {
+		t.Fatal("The user's second factor should be gone")
+	}
+
+	if _, err := store.GetChirp(stayingChirp.ID); err != nil {
+		t.Fatal("Other users' chirps should stay")
+	}
+	if token, _ := store.GetRefreshTokenID(stayingSession.ID); token.IsValid == false {
+		t.Fatal("Other users' sessions should stay")
+	}
+	if err := store.DeleteUser(leaving.ID, false); err == nil {
+		t.Fatal("Deleting twice should fail")
+	}
+}
+
+func TestAccountDeletion(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	testAccountDeletion(t, dbClient)
+}
+
+func TestSQLiteAccountDeletion(t *testing.T) {
+	testAccountDeletion(t, newSQLiteClient(t))
+}
+
+func testAnonymizedDeletion(t *testing.T, store utils.Store) {
+	user, _ := store.CreateUsers("anonymous@example.com", []byte("hash"))
+	chirp, _ := store.CreateChirp("Keep this one", user.ID)
+	if err := store.DeleteUser(user.ID, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	kept, err := store.GetChirp(chirp.ID)
+	if err != nil || kept.AuthorId != 0 || kept.Body != chirp.Body {
+		t.Fatalf("Expected the chirp to stay without an author, got %+v: %v", kept, err)
+	}
+	page, _ := store.ListChirps(types.ChirpQuery{AuthorId: user.ID})
+	if len(page.Chirps) != 0 {
+		t.Fatalf("The chirp should no longer be listed under the user, got %+v", page.Chirps)
+	}
+}
+
+func TestAnonymizedDeletion(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	testAnonymizedDeletion(t, dbClient)
+}
+
+func TestSQLiteAnonymizedDeletion(t *testing.T) {
+	testAnonymizedDeletion(t, newSQLiteClient(t))
+}
+
+func testDeleteUserIfDue(t *testing.T, store utils.Store) {
+	user, _ := store.CreateUsers("racing@example.com", []byte("hash"))
+	now := time.Now().UTC()
+	store.SetDeletionScheduledAt(user.ID, now.Add(time.Hour))
+	if _, deleted, err := store.DeleteUserIfDue(user.ID, now, false); err != nil || deleted {
+		t.Fatalf("Users should not be deleted before their date: %v", err)
+	}
+	// A login cancelling the deletion after FinalizeDue listed the user.
+	store.SetDeletionScheduledAt(user.ID, time.Time{})
+	if _, deleted, err := store.DeleteUserIfDue(user.ID, now.Add(2*time.Hour), false); err != nil || deleted {
+		t.Fatalf("Cancelled deletions should not go ahead: %v", err)
+	}
+	if _, err := store.GetUserByID(user.ID); err != nil {
+		t.Fatalf("The user should still be there: %v", err)
+	}
+	store.SetDeletionScheduledAt(user.ID, now.Add(time.Hour))
+	found, deleted, err := store.DeleteUserIfDue(user.ID, now.Add(2*time.Hour), false)
+	if err != nil || deleted == false || found.Email != user.Email {
+		t.Fatalf("Expected the due user to be deleted, got %+v %t: %v", found, deleted, err)
+	}
+	if _, err := store.GetUserByID(user.ID); err == nil {
+		t.Fatal("The user should be gone")
+	}
+	if _, deleted, err := store.DeleteUserIfDue(user.ID, now.Add(2*time.Hour), false); err != nil || deleted {
+		t.Fatalf("Deleting a user twice should do nothing: %v", err)
+	}
+}
+
+func TestDeleteUserIfDue(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	testDeleteUserIfDue(t, dbClient)
+}
+
+func TestSQLiteDeleteUserIfDue(t *testing.T) {
+	testDeleteUserIfDue(t, newSQLiteClient(t))
+}
+
+func TestCancelDeletion(t *testing.T) {
+	store := newSQLiteClient(t)
+	keys, _ := auth.NewKeySet(auth.KeySetOptions{LegacySecret: jwtSecret})
+	user, _ := store.CreateUsers("undecided@example.com", []byte("hash"))
+	handler := auth.RequireAccessToken(keys, auth.RequireActiveUser(store, &principalRecorder{}))
+	token := "Bearer " + signRoleToken(t, keys, user.ID, types.RoleUser)
+
+	deleter := account.Deleter{Store: store, GracePeriod: time.Hour}
+	now := time.Now().UTC()
+	scheduled, _ := deleter.Schedule(user.ID, now)
+	if resp := serve(handler, token); resp.Code != http.StatusForbidden {
+		t.Fatalf("Users about to be deleted should be turned away, got %d", resp.Code)
+	}
+	kept, cancelled, err := deleter.Cancel(scheduled)
+	if err != nil || cancelled == false || kept.DeletionScheduledAt.IsZero() == false {
+		t.Fatalf("Unable to cancel the deletion: %+v %v", kept, err)
+	}
+	if _, cancelled, _ := deleter.Cancel(kept); cancelled {
+		t.Fatal("There should be nothing left to cancel")
+	}
+	if resp := serve(handler, token); resp.Code != http.StatusOK {
+		t.Fatalf("Expected the user back in, got %d", resp.Code)
+	}
+	if deleted, _ := deleter.FinalizeDue(now.Add(2 * time.Hour)); len(deleted) != 0 {
+		t.Fatalf("Cancelled deletions should not be finalized, got %v", deleted)
+	}
+}
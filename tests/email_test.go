@@ -0,0 +1,169 @@
+package tests
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	cases := map[string]string{
+		"user@example.com":           "user@example.com",
+		" User@Example.COM ":         "user@example.com",
+		"first.last@sub.example.org": "first.last@sub.example.org",
+		"":                           "",
+		"not an email":               "",
+		"user@localhost":             "",
+		"User <user@example.com>":    "",
+		"user@@example.com":          "",
+	}
+	for input, want := range cases {
+		got, err := utils.NormalizeEmail(input)
+		if want == "" && errors.Is(err, utils.ErrInvalidEmail) == false {
+			t.Errorf("%q should be rejected, got %q", input, got)
+		}
+		if want != "" && got != want {
+			t.Errorf("%q: expected %q, got %q (%v)", input, want, got, err)
+		}
+	}
+}
+
+func testUniqueEmails(t *testing.T, store utils.Store) {
+	user, err := store.CreateUsers(" Unique@Example.com", []byte("hash"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if user.Email != "unique@example.com" || user.IsEmailVerified {
+		t.Fatalf("New users should have a normalized, unverified email, got %v", user)
+	}
+	if _, err := store.CreateUsers("UNIQUE@example.com", []byte("hash")); errors.Is(err, utils.ErrEmailTaken) == false {
+		t.Fatalf("Emails should be unique regardless of case, got %v", err)
+	}
+	if _, err := store.CreateUsers("nope", []byte("hash")); errors.Is(err, utils.ErrInvalidEmail) == false {
+		t.Fatalf("Invalid emails should be rejected, got %v", err)
+	}
+	found, err := store.GetUserByEmail("Unique@EXAMPLE.com")
+	if err != nil || found.ID != user.ID {
+		t.Fatalf("Lookups should ignore case: %v", err)
+	}
+	other, _ := store.CreateUsers("other@example.com", []byte("hash"))
+	taken := "unique@example.com"
+	if _, err := store.UpdateUser(other.ID, types.UserUpdate{Email: &taken}); errors.Is(err, utils.ErrEmailTaken) == false {
+		t.Fatalf("Users should not take someone else's email, got %v", err)
+	}
+	own := "Unique@example.com"
+	if _, err := store.UpdateUser(found.ID, types.UserUpdate{Email: &own}); err != nil {
+		t.Fatalf("Users should be able to keep their own email: %v", err)
+	}
+	verified, err := store.SetEmailVerified(user.ID, true)
+	if err != nil || verified.IsEmailVerified == false {
+		t.Fatalf("Unable to verify the email: %v", err)
+	}
+}
+
+func TestUniqueEmails(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	testUniqueEmails(t, dbClient)
+}
+
+func TestSQLiteUniqueEmails(t *testing.T) {
+	testUniqueEmails(t, newSQLiteClient(t))
+}
+
+func TestMigrateDBVerifiesExistingUsers(t *testing.T) {
+	legacy := `{"version":5,"chirps":{},"users":{"1":{"id":1,"email":"Legacy@Example.com"}},"refresh_tokens":{},"one_time_tokens":{},"sequences":{"users":1}}`
+	os.WriteFile("../database/database.json", []byte(legacy), 0644)
+	defer cleanUp(t)
+	dbClient, err := utils.NewDB("../database/database.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer dbClient.Close()
+	user, err := dbClient.GetUserByEmail("legacy@example.com")
+	if err != nil || user.IsEmailVerified == false {
+		t.Fatalf("Existing users should be normalized and verified: %v", err)
+	}
+}
+
+func TestMigrateDBRefusesToMergeEmails(t *testing.T) {
+	legacy := `{"version":5,"chirps":{},"users":{"1":{"id":1,"email":"Legacy@Example.com"},"2":{"id":2,"email":"other@example.com"},` +
+		`"3":{"id":3,"email":" legacy@example.com"}},"refresh_tokens":{},"one_time_tokens":{},"sequences":{"users":3}}`
+	os.WriteFile("../database/database.json", []byte(legacy), 0644)
+	defer cleanUp(t)
+	for _, options := range []utils.MigrateOptions{{DryRun: true}, {}} {
+		_, err := utils.MigrateDB("../database/database.json", options)
+		if err == nil || strings.Contains(err.Error(), "legacy@example.com is used by users 1, 3") == false {
+			t.Fatalf("Expected the colliding users to be reported, got %v", err)
+		}
+	}
+	dataBytes, _ := os.ReadFile("../database/database.json")
+	if string(dataBytes) != legacy {
+		t.Fatal("A failed migration should leave the database file alone")
+	}
+}
+
+func TestSQLiteEmailIndexRefusesDuplicates(t *testing.T) {
+	dbClient := newSQLiteClient(t)
+	if _, err := dbClient.DB.Exec("INSERT INTO users (email, password) VALUES ('a@example.com', ''), ('a@example.com', '')"); err == nil {
+		t.Fatal("The users_email index should make emails unique")
+	}
+	// Put the database back the way an older one with duplicates would be.
+	for _, statement := range []string{
+		"DROP INDEX users_email",
+		"CREATE INDEX users_email ON users(email)",
+		"INSERT INTO users (email, password) VALUES ('a@example.com', ''), ('b@example.com', ''), ('a@example.com', '')",
+		"PRAGMA user_version = 15",
+	} {
+		if _, err := dbClient.DB.Exec(statement); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	dbClient.Close()
+	reopened, err := utils.NewSQLiteDB(sqlitePath)
+	if err == nil {
+		reopened.Close()
+		t.Fatal("Migrating a database with duplicate emails should fail")
+	}
+	if strings.Contains(err.Error(), "a@example.com is used by users 1, 3") == false {
+		t.Fatalf("Expected the colliding users to be reported, got %s", err)
+	}
+}
+
+func testUpdateUser(t *testing.T, store utils.Store) {
+	user, _ := store.CreateUsers("fields@example.com", []byte("hash"))
+	store.SetEmailVerified(user.ID, true)
+	store.SetChirpyRed(user.ID, true)
+	store.SetRole(user.ID, types.RoleModerator)
+	updated, err := store.UpdateUser(user.ID, types.UserUpdate{Password: []byte("new hash")})
+	if err != nil || string(updated.Password) != "new hash" {
+		t.Fatalf("Expected the password to change: %v", err)
+	}
+	if updated.IsChirpyRed == false || updated.Role != types.RoleModerator || updated.IsEmailVerified == false {
+		t.Fatalf("Changing the password should leave the rest of the user alone, got %+v", updated)
+	}
+	email := "Moved@Example.com"
+	updated, err = store.UpdateUser(user.ID, types.UserUpdate{Email: &email})
+	if err != nil || updated.Email != "moved@example.com" || updated.IsEmailVerified {
+		t.Fatalf("A new email should be stored normalized and unverified, got %+v %v", updated, err)
+	}
+	if found, _ := store.GetUserByID(user.ID); found.IsChirpyRed == false || string(found.Password) != "new hash" {
+		t.Fatalf("Changing the email should leave the rest of the user alone, got %+v", found)
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	testUpdateUser(t, dbClient)
+}
+
+func TestSQLiteUpdateUser(t *testing.T) {
+	testUpdateUser(t, newSQLiteClient(t))
+}
@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/auth"
+	"github.com/mdwiltfong/chirpy/utils/export"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+func testDataExports(t *testing.T, store utils.Store) {
+	user, _ := store.CreateUsers("exporter@example.com", []byte("hash"))
+	now := time.Now().UTC()
+	created, err := store.CreateDataExport(user.ID, now.Add(time.Hour))
+	if err != nil || created.Status != types.ExportPending || created.UserId != user.ID {
+		t.Fatalf("Unable to create the export: %+v %v", created, err)
+	}
+	ready, err := store.CompleteDataExport(created.ID, types.ExportReady, 1234)
+	if err != nil || ready.Status != types.ExportReady || ready.Size != 1234 || ready.CompletedAt.IsZero() {
+		t.Fatalf("Unable to complete the export: %+v %v", ready, err)
+	}
+	if _, err := store.CompleteDataExport(created.ID, types.ExportFailed, 0); err == nil {
+		t.Fatal("Only pending exports should be completed")
+	}
+	if found, err := store.GetDataExport(created.ID); err != nil || found.Status != types.ExportReady {
+		t.Fatalf("Expected the ready export, got %+v %v", found, err)
+	}
+	later, _ := store.CreateDataExport(user.ID, now.Add(3*time.Hour))
+	if exports, _ := store.ListDataExports(user.ID); len(exports) != 2 || exports[0].ID != created.ID {
+		t.Fatalf("Expected both exports in order, got %+v", exports)
+	}
+
+	expired, err := store.DeleteExpiredDataExports(now.Add(2 * time.Hour))
+	if err != nil || len(expired) != 1 || expired[0].ID != created.ID {
+		t.Fatalf("Expected the first export to expire, got %+v %v", expired, err)
+	}
+	if _, err := store.GetDataExport(created.ID); err != utils.ErrDataExportNotFound {
+		t.Fatalf("Expired exports should be gone, got %v", err)
+	}
+	store.DeleteUser(user.ID, false)
+	if _, err := store.GetDataExport(later.ID); err != utils.ErrDataExportNotFound {
+		t.Fatalf("Deleting the user should delete their exports, got %v", err)
+	}
+}
+
+func TestDataExports(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	testDataExports(t, dbClient)
+}
+
+func TestSQLiteDataExports(t *testing.T) {
+	testDataExports(t, newSQLiteClient(t))
+}
+
+func readArchive(t *testing.T, path string) map[string][]byte {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer archive.Close()
+	files := map[string][]byte{}
+	for _, file := range archive.File {
+		reader, _ := file.Open()
+		files[file.Name], _ = io.ReadAll(reader)
+		reader.Close()
+	}
+	return files
+}
+
+func TestExporterArchive(t *testing.T) {
+	store := newSQLiteClient(t)
+	user, _ := store.CreateUsers("archived@example.com", []byte("secret-hash"))
+	other, _ := store.CreateUsers("other@example.com", []byte("hash"))
+	store.CreateChirp("First, with a comma", user.ID)
+	store.CreateChirp("Second", user.ID)
+	store.CreateChirp("Not mine", other.ID)
+	store.CreateSession(user.ID, types.SessionClient{DeviceLabel: "Phone", IP: "203.0.113.7"})
+	apiToken, _ := store.CreateApiToken(user.ID, "Backup script", []string{auth.ScopeChirpsRead}, time.Time{})
+	store.CreateOAuthClient(user.ID, "My App", []string{"https://app.example/cb"}, true)
+
+	exporter := export.Exporter{Store: store, Dir: t.TempDir(), TTL: time.Hour}
+	started, err := exporter.Start(user.ID, time.Now().UTC())
+	if err != nil || started.Status != types.ExportPending {
+		t.Fatalf("Unable to start the export: %+v %v", started, err)
+	}
+	ready := started
+	for deadline := time.Now().Add(5 * time.Second); ready.Status == types.ExportPending && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		ready, _ = store.GetDataExport(started.ID)
+	}
+	if ready.Status != types.ExportReady || ready.Size == 0 {
+		t.Fatalf("Expected the export to be built, got %+v", ready)
+	}
+	archive, err := exporter.Open(ready)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	archive.Close()
+
+	files := readArchive(t, exporter.Path(ready.ID))
+	document := export.Document{}
+	if err := json.Unmarshal(files["data.json"], &document); err != nil {
+		t.Fatalf("Unable to read data.json: %s", err)
+	}
+	if document.Profile.Email != user.Email || len(document.Chirps) != 2 || len(document.Sessions) != 1 ||
+		len(document.ApiTokens) != 1 || len(document.OAuthClients) != 1 {
+		t.Fatalf("Expected everything about the user and nothing else, got %+v", document)
+	}
+	if len(document.Events) != 4 || document.Events[len(document.Events)-1].Event != "data_export_requested" {
+		t.Fatalf("Expected the account's events in order, got %+v", document.Events)
+	}
+	for name, content := range files {
+		for _, secret := range []string{"secret-hash", apiToken.Token, apiToken.TokenHash, "secret_hash", "password"} {
+			if strings.Contains(string(content), secret) {
+				t.Fatalf("%s should not contain %q", name, secret)
+			}
+		}
+	}
+	chirps, err := csv.NewReader(strings.NewReader(string(files["chirps.csv"]))).ReadAll()
+	if err != nil || len(chirps) != 3 || chirps[1][1] != "First, with a comma" {
+		t.Fatalf("Unexpected chirps.csv: %v %v", chirps, err)
+	}
+	if _, ok := files["sessions.csv"]; ok == false {
+		t.Fatal("The archive should contain sessions.csv")
+	}
+	if _, ok := files["events.csv"]; ok == false {
+		t.Fatal("The archive should contain events.csv")
+	}
+
+	orphan := exporter.Path(9999)
+	os.WriteFile(orphan, []byte("left behind"), 0600)
+	if err := exporter.Purge(time.Now().UTC()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(orphan); os.IsNotExist(err) == false {
+		t.Fatal("Archives without an export should be purged")
+	}
+	if _, err := os.Stat(exporter.Path(ready.ID)); err != nil {
+		t.Fatal("Archives that haven't expired should stay")
+	}
+	if err := exporter.Purge(time.Now().UTC().Add(2 * time.Hour)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(exporter.Path(ready.ID)); os.IsNotExist(err) == false {
+		t.Fatal("Expired archives should be purged")
+	}
+}
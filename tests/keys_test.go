@@ -0,0 +1,172 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mdwiltfong/chirpy/utils/auth"
+)
+
+const keysPath = "../database/jwt_keys.json"
+
+// fakeClock is a clock tests move by hand.
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.now = clock.now.Add(d)
+}
+
+func claimsFor(clock *fakeClock, userId int) jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{
+		IssuedAt:  jwt.NewNumericDate(clock.Now()),
+		ExpiresAt: jwt.NewNumericDate(clock.Now().Add(time.Hour)),
+		Subject:   strconv.Itoa(userId),
+	}
+}
+
+func testKeyRotation(t *testing.T, algorithm string) {
+	clock := &fakeClock{now: time.Now()}
+	options := auth.KeySetOptions{
+		Algorithm:        algorithm,
+		Path:             keysPath,
+		RotateEvery:      24 * time.Hour,
+		MaxTokenLifetime: time.Hour,
+		Now:              clock.Now,
+	}
+	defer os.Remove(keysPath)
+	keys, err := auth.NewKeySet(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	first, err := keys.Sign(claimsFor(clock, 1))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if userId, err := auth.ValidateJWT(first, keys); err != nil || userId != 1 {
+		t.Fatalf("Freshly signed tokens should validate: %v", err)
+	}
+
+	clock.Advance(24 * time.Hour)
+	second, _ := keys.Sign(jwt.RegisteredClaims{Subject: "2"})
+	if len(keys.Keys()) != 2 {
+		t.Fatalf("Signing after the rotation period should add a key, got %d", len(keys.Keys()))
+	}
+	firstKid, _, _ := jwt.NewParser().ParseUnverified(first, &jwt.RegisteredClaims{})
+	secondKid, _, _ := jwt.NewParser().ParseUnverified(second, &jwt.RegisteredClaims{})
+	if firstKid.Header["kid"] == secondKid.Header["kid"] {
+		t.Fatal("Rotation should sign with a new kid")
+	}
+	if len(keys.JWKS().Keys) != 2 {
+		t.Fatal("Retired keys should be published until their tokens expire")
+	}
+
+	reloaded, err := auth.NewKeySet(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if userId, err := auth.ValidateJWT(second, reloaded); err != nil || userId != 2 {
+		t.Fatalf("Keys should survive a restart: %v", err)
+	}
+
+	clock.Advance(2 * time.Hour)
+	if len(keys.JWKS().Keys) != 1 {
+		t.Fatal("Keys retired for longer than the token lifetime should not be published")
+	}
+	keys.Rotate()
+	if len(keys.Keys()) != 2 {
+		t.Fatalf("Expired keys should be dropped on rotation, got %d", len(keys.Keys()))
+	}
+}
+
+func TestKeyRotationEdDSA(t *testing.T) {
+	testKeyRotation(t, auth.AlgorithmEdDSA)
+}
+
+func TestKeyRotationRS256(t *testing.T) {
+	testKeyRotation(t, auth.AlgorithmRS256)
+}
+
+func TestKeySetRejectsForeignTokens(t *testing.T) {
+	keys, _ := auth.NewKeySet(auth.KeySetOptions{})
+	other, _ := auth.NewKeySet(auth.KeySetOptions{})
+	foreign, _ := other.Sign(jwt.RegisteredClaims{Subject: "1"})
+	if _, err := auth.ValidateJWT(foreign, keys); err == nil {
+		t.Fatal("Tokens signed by another key set should be rejected")
+	}
+	// An HMAC token claiming one of our kids must not be checked against
+	// anything, least of all the public key.
+	kid := keys.Keys()[0].ID
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "1"})
+	forged.Header["kid"] = kid
+	signed, _ := forged.SignedString([]byte(kid))
+	if _, err := auth.ValidateJWT(signed, keys); err == nil {
+		t.Fatal("HS256 tokens with a kid should be rejected")
+	}
+	if _, err := auth.NewKeySet(auth.KeySetOptions{Algorithm: "none"}); err == nil {
+		t.Fatal("Unknown algorithms should be rejected")
+	}
+}
+
+func TestLegacyTokens(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	options := auth.KeySetOptions{Path: keysPath, MaxTokenLifetime: time.Hour, LegacySecret: jwtSecret, Now: clock.Now}
+	defer os.Remove(keysPath)
+	keys, err := auth.NewKeySet(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	upgrade := clock.Now()
+	issued := signLegacyToken(t, 1, jwtSecret, upgrade.Add(-10*time.Minute), upgrade.Add(50*time.Minute))
+	if userId, err := auth.ValidateJWT(issued, keys); err != nil || userId != 1 {
+		t.Fatalf("Tokens issued before the upgrade should work until they expire: %v", err)
+	}
+	minted := []string{
+		signLegacyToken(t, 1, jwtSecret, upgrade.Add(time.Minute), upgrade.Add(30*time.Minute)),
+		signLegacyToken(t, 1, jwtSecret, upgrade.Add(-time.Minute), upgrade.Add(24*time.Hour)),
+	}
+	for _, token := range minted {
+		if _, err := auth.ValidateJWT(token, keys); err == nil {
+			t.Fatal("Tokens minted with the legacy secret after the upgrade should be rejected")
+		}
+	}
+
+	clock.Advance(10 * time.Minute)
+	reloaded, err := auth.NewKeySet(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reloaded.LegacyExpiry().Equal(keys.LegacyExpiry()) == false {
+		t.Fatalf("The cutoff should survive a restart, got %v and %v", reloaded.LegacyExpiry(), keys.LegacyExpiry())
+	}
+	if _, err := auth.ValidateJWT(issued, reloaded); err != nil {
+		t.Fatalf("Tokens issued before the upgrade should work after a restart: %v", err)
+	}
+	clock.Advance(time.Hour)
+	if _, err := auth.ValidateJWT(issued, reloaded); err == nil {
+		t.Fatal("The legacy secret should verify nothing once its tokens have expired")
+	}
+}
+
+func TestServeJWKS(t *testing.T) {
+	keys, _ := auth.NewKeySet(auth.KeySetOptions{Algorithm: auth.AlgorithmEdDSA})
+	resp := httptest.NewRecorder()
+	keys.ServeJWKS(resp, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	set := auth.JWKSet{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &set); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(set.Keys) != 1 || set.Keys[0].KeyType != "OKP" || set.Keys[0].X == "" || set.Keys[0].ID != keys.Keys()[0].ID {
+		t.Fatalf("Unexpected JWKS %s", resp.Body.String())
+	}
+}
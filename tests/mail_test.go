@@ -0,0 +1,29 @@
+package tests
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mdwiltfong/chirpy/utils/mail"
+)
+
+func TestFileMailer(t *testing.T) {
+	path := "../database/mail.txt"
+	defer os.Remove(path)
+	var mailer mail.Mailer = &mail.FileMailer{Path: path}
+	for _, subject := range []string{"First", "Second"} {
+		err := mailer.Send(mail.Message{To: "user@example.com", Subject: subject, Body: "Hello\nthere"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	dataBytes, _ := os.ReadFile(path)
+	sent := string(dataBytes)
+	if strings.Count(sent, "To: user@example.com") != 2 || strings.Contains(sent, "Subject: Second") == false {
+		t.Fatalf("Both messages should be appended, got %s", sent)
+	}
+	if strings.Contains(sent, "Hello\r\nthere") == false {
+		t.Fatal("Bodies should use CRLF line endings")
+	}
+}
@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mdwiltfong/chirpy/utils"
+)
+
+const legacyDB = `{"chirps":{"1":{"id":1,"body":"a"},"3":{"id":3,"body":"b"}},"users":{}}`
+
+func TestMigrateDBDryRun(t *testing.T) {
+	os.WriteFile("../database/database.json", []byte(legacyDB), 0644)
+	defer cleanUp(t)
+	pending, err := utils.MigrateDB("../database/database.json", utils.MigrateOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(pending) != utils.CurrentSchemaVersion || pending[0].Version != 1 {
+		t.Fatalf("Expected every migration to be pending, got %v", pending)
+	}
+	dataBytes, _ := os.ReadFile("../database/database.json")
+	if string(dataBytes) != legacyDB {
+		t.Fatal("A dry run should not modify the database file")
+	}
+	backups, _ := filepath.Glob("../database/database.json.*.bak")
+	if len(backups) != 0 {
+		t.Fatal("A dry run should not take a backup")
+	}
+}
+
+func TestMigrateDBUpgradesAndBacksUp(t *testing.T) {
+	os.WriteFile("../database/database.json", []byte(legacyDB), 0644)
+	defer cleanUp(t)
+	dbClient, err := utils.NewDB("../database/database.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer dbClient.Close()
+	dbData, _ := dbClient.LoadDB()
+	if dbData.Version != utils.CurrentSchemaVersion {
+		t.Fatalf("Expected schema version %d, got %d", utils.CurrentSchemaVersion, dbData.Version)
+	}
+	if dbData.RefreshTokens == nil || dbData.Sequences["chirps"] != 3 {
+		t.Fatal("Migration 1 should add refresh tokens and seed sequences")
+	}
+	if dbData.Chirps[1].AuthorId != 0 {
+		t.Fatal("Migration 2 should attribute legacy chirps to no author")
+	}
+	backups, _ := filepath.Glob("../database/database.json.v0.*.bak")
+	if len(backups) != 1 {
+		t.Fatalf("Expected one backup of the version 0 file, found %v", backups)
+	}
+	backup, _ := os.ReadFile(backups[0])
+	if len(backup) == 0 {
+		t.Fatal("Backup should hold the pre-migration contents")
+	}
+	pending, _ := utils.MigrateDB("../database/database.json", utils.MigrateOptions{DryRun: true})
+	if len(pending) != 0 {
+		t.Fatal("Migrated files should have nothing pending")
+	}
+}
+
+func TestMigrateDBRejectsNewerFiles(t *testing.T) {
+	os.WriteFile("../database/database.json", []byte(`{"version":9999}`), 0644)
+	defer cleanUp(t)
+	if _, err := utils.MigrateDB("../database/database.json", utils.MigrateOptions{}); err == nil {
+		t.Fatal("Files from a newer schema should be rejected")
+	}
+}
+
+func TestNewFilesStartAtCurrentVersion(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	dbData, _ := dbClient.LoadDB()
+	if dbData.Version != utils.CurrentSchemaVersion {
+		t.Fatalf("Expected schema version %d, got %d", utils.CurrentSchemaVersion, dbData.Version)
+	}
+	backups, _ := filepath.Glob("../database/database.json.*.bak")
+	if len(backups) != 0 {
+		t.Fatal("Fresh databases should not need migrating")
+	}
+}
+
+func TestMigrateDBStartsRefreshTokenFamilies(t *testing.T) {
+	legacy := `{"version":2,"chirps":{},"users":{},"refresh_tokens":{"4":{"id":4,"userId":1,"token":"abc","is_valid":true}},"sequences":{"refresh_tokens":4}}`
+	os.WriteFile("../database/database.json", []byte(legacy), 0644)
+	defer cleanUp(t)
+	dbClient, err := utils.NewDB("../database/database.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer dbClient.Close()
+	token, _ := dbClient.GetRefreshTokenID(4)
+	if token.FamilyId != 4 {
+		t.Fatalf("Existing tokens should start their own family, got %d", token.FamilyId)
+	}
+}
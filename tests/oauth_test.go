@@ -0,0 +1,360 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/auth"
+	"github.com/mdwiltfong/chirpy/utils/oauth"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+const redirectURI = "https://app.example/callback"
+
+// newOAuthServer mounts the OAuth endpoints the way main does, next to a
+// scoped route and a user-only route to try the issued tokens on. PUT
+// /api/users runs the same credential check as main's handler.
+func newOAuthServer(t *testing.T) (*httptest.Server, utils.Store, *auth.KeySet) {
+	store := newSQLiteClient(t)
+	keys, _ := auth.NewKeySet(auth.KeySetOptions{LegacySecret: jwtSecret})
+	issue := func(expiresIn time.Duration, user types.User, clientId string, scopes []string) (string, error) {
+		return keys.Sign(auth.AccessClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   strconv.Itoa(user.ID),
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
+			},
+			ClientId: clientId,
+			Scope:    strings.Join(scopes, " "),
+		})
+	}
+	server := oauth.NewServer(store, keys, issue)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	mux := http.NewServeMux()
+	mux.Handle("POST /api/oauth/clients", auth.RequireAccessToken(keys, http.HandlerFunc(server.RegisterClient)))
+	mux.Handle("GET /api/oauth/authorize", auth.RequireAccessToken(keys, http.HandlerFunc(server.Consent)))
+	mux.Handle("POST /api/oauth/authorize", auth.RequireAccessToken(keys, http.HandlerFunc(server.Authorize)))
+	mux.HandleFunc("POST /oauth/token", server.Token)
+	mux.HandleFunc("POST /oauth/introspect", server.Introspect)
+	mux.HandleFunc("POST /oauth/revoke", server.Revoke)
+	mux.Handle("POST /api/chirps", auth.RequireScope(keys, store, auth.ScopeChirpsWrite, ok))
+	mux.Handle("PUT /api/users", auth.RequireScope(keys, store, auth.ScopeProfileWrite, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := struct {
+			Email    string `json:"email"`
+			Password string `json:"password"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&params)
+		principal, _ := auth.PrincipalFromContext(r.Context())
+		if err := auth.CheckCredentialChange(principal, params.Email, params.Password); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})))
+	mux.Handle("GET /api/sessions", auth.RequireAccessToken(keys, ok))
+	httpServer := httptest.NewServer(mux)
+	t.Cleanup(httpServer.Close)
+	return httpServer, store, keys
+}
+
+// fakeClient plays a third-party app.
+type fakeClient struct {
+	t        *testing.T
+	base     string
+	clientId string
+	secret   string
+	verifier string
+}
+
+func doJSON(t *testing.T, method string, target string, bearer string, body interface{}, into interface{}) int {
+	encoded, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, target, bytes.NewReader(encoded))
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	if into != nil {
+		json.NewDecoder(resp.Body).Decode(into)
+	}
+	return resp.StatusCode
+}
+
+func registerClient(t *testing.T, base string, ownerToken string, confidential bool) *fakeClient {
+	registered := map[string]interface{}{}
+	status := doJSON(t, http.MethodPost, base+"/api/oauth/clients", ownerToken, map[string]interface{}{
+		"name": "Fake App", "redirect_uris": []string{redirectURI}, "confidential": confidential,
+	}, &registered)
+	if status != http.StatusCreated {
+		t.Fatalf("Unable to register the client: %d %v", status, registered)
+	}
+	secret, _ := registered["client_secret"].(string)
+	if confidential == (secret == "") {
+		t.Fatalf("Only confidential clients should get a secret, got %v", registered)
+	}
+	return &fakeClient{t: t, base: base, clientId: registered["client_id"].(string), secret: secret}
+}
+
+// authorizationRequest starts a new authorization with a fresh PKCE
+// verifier.
+func (client *fakeClient) authorizationRequest(scope string) map[string]interface{} {
+	client.verifier = strings.Repeat("v", 20) + strconv.FormatInt(time.Now().UnixNano(), 36) + strings.Repeat("x", 20)
+	sum := sha256.Sum256([]byte(client.verifier))
+	return map[string]interface{}{
+		"response_type":         "code",
+		"client_id":             client.clientId,
+		"redirect_uri":          redirectURI,
+		"scope":                 scope,
+		"state":                 "xyz",
+		"code_challenge":        base64.RawURLEncoding.EncodeToString(sum[:]),
+		"code_challenge_method": "S256",
+	}
+}
+
+// authorize has the user approve or deny request and returns the query the
+// user is sent back to the client with.
+func (client *fakeClient) authorize(userToken string, request map[string]interface{}, approve bool) url.Values {
+	request["approve"] = approve
+	decision := map[string]string{}
+	if status := doJSON(client.t, http.MethodPost, client.base+"/api/oauth/authorize", userToken, request, &decision); status != http.StatusOK {
+		client.t.Fatalf("Authorization failed: %d %v", status, decision)
+	}
+	redirect, err := url.Parse(decision["redirect_to"])
+	if err != nil || strings.HasPrefix(decision["redirect_to"], redirectURI+"?") == false {
+		client.t.Fatalf("Expected to be sent back to the client, got %q", decision["redirect_to"])
+	}
+	return redirect.Query()
+}
+
+func (client *fakeClient) post(path string, form url.Values, into interface{}) int {
+	if client.secret == "" {
+		form.Set("client_id", client.clientId)
+	}
+	req, _ := http.NewRequest(http.MethodPost, client.base+path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if client.secret != "" {
+		req.SetBasicAuth(client.clientId, client.secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		client.t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	if into != nil {
+		json.NewDecoder(resp.Body).Decode(into)
+	}
+	return resp.StatusCode
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	Error        string `json:"error"`
+}
+
+func (client *fakeClient) exchange(code string, verifier string) (tokenResponse, int) {
+	tokens := tokenResponse{}
+	status := client.post("/oauth/token", url.Values{
+		"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}, "code_verifier": {verifier},
+	}, &tokens)
+	return tokens, status
+}
+
+func (client *fakeClient) refresh(refreshToken string, scope string) (tokenResponse, int) {
+	tokens := tokenResponse{}
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}}
+	if scope != "" {
+		form.Set("scope", scope)
+	}
+	status := client.post("/oauth/token", form, &tokens)
+	return tokens, status
+}
+
+func (client *fakeClient) introspect(token string) oauth.Introspection {
+	introspection := oauth.Introspection{}
+	if status := client.post("/oauth/introspect", url.Values{"token": {token}}, &introspection); status != http.StatusOK {
+		client.t.Fatalf("Introspection failed with %d", status)
+	}
+	return introspection
+}
+
+func statusWithToken(t *testing.T, method string, target string, token string) int {
+	return doJSON(t, method, target, token, nil, nil)
+}
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	server, store, keys := newOAuthServer(t)
+	owner, _ := store.CreateUsers("developer@example.com", []byte("hash"))
+	user, _ := store.CreateUsers("oauth-user@example.com", []byte("hash"))
+	userToken := signRoleToken(t, keys, user.ID, types.RoleUser)
+
+	rejected := map[string]string{}
+	if status := doJSON(t, http.MethodPost, server.URL+"/api/oauth/clients", signRoleToken(t, keys, owner.ID, types.RoleUser),
+		map[string]interface{}{"name": "Evil", "redirect_uris": []string{"http://evil.example/cb"}}, &rejected); status != http.StatusBadRequest {
+		t.Fatalf("Plain http redirect URIs should be rejected, got %d", status)
+	}
+	client := registerClient(t, server.URL, signRoleToken(t, keys, owner.ID, types.RoleUser), true)
+
+	request := client.authorizationRequest("chirps:write")
+	consent := map[string]interface{}{}
+	query := url.Values{}
+	for key, value := range request {
+		query.Set(key, value.(string))
+	}
+	if status := doJSON(t, http.MethodGet, server.URL+"/api/oauth/authorize?"+query.Encode(), userToken, nil, &consent); status != http.StatusOK {
+		t.Fatalf("Unable to load the consent screen: %d %v", status, consent)
+	}
+	if consent["client_name"] != "Fake App" {
+		t.Fatalf("Expected the consent screen to name the client, got %v", consent)
+	}
+
+	callback := client.authorize(userToken, request, true)
+	if callback.Get("state") != "xyz" || callback.Get("code") == "" {
+		t.Fatalf("Expected a code and the state back, got %v", callback)
+	}
+	tokens, status := client.exchange(callback.Get("code"), client.verifier)
+	if status != http.StatusOK || tokens.TokenType != "Bearer" || tokens.Scope != "chirps:write" || tokens.RefreshToken == "" {
+		t.Fatalf("Unable to exchange the code: %d %+v", status, tokens)
+	}
+	if _, status := client.exchange(callback.Get("code"), client.verifier); status != http.StatusBadRequest {
+		t.Fatalf("Codes should only be redeemable once, got %d", status)
+	}
+	if _, status := client.refresh(tokens.RefreshToken, ""); status != http.StatusBadRequest {
+		t.Fatalf("Reusing a code should revoke the tokens from its first use, got %d", status)
+	}
+	request = client.authorizationRequest("chirps:write")
+	tokens, status = client.exchange(client.authorize(userToken, request, true).Get("code"), client.verifier)
+	if status != http.StatusOK {
+		t.Fatalf("Unable to exchange a fresh code: %d %+v", status, tokens)
+	}
+
+	if status := statusWithToken(t, http.MethodPost, server.URL+"/api/chirps", tokens.AccessToken); status != http.StatusOK {
+		t.Fatalf("The token should carry chirps:write, got %d", status)
+	}
+	if status := statusWithToken(t, http.MethodPut, server.URL+"/api/users", tokens.AccessToken); status != http.StatusForbidden {
+		t.Fatalf("The token should not carry profile:write, got %d", status)
+	}
+	if status := statusWithToken(t, http.MethodGet, server.URL+"/api/sessions", tokens.AccessToken); status != http.StatusUnauthorized {
+		t.Fatalf("Client tokens should not reach the user's own routes, got %d", status)
+	}
+
+	if introspection := client.introspect(tokens.AccessToken); introspection.Active == false ||
+		introspection.ClientId != client.clientId || introspection.Subject != strconv.Itoa(user.ID) {
+		t.Fatalf("Expected the access token to be active, got %+v", introspection)
+	}
+	other := registerClient(t, server.URL, signRoleToken(t, keys, owner.ID, types.RoleUser), false)
+	if other.introspect(tokens.AccessToken).Active || other.introspect(tokens.RefreshToken).Active {
+		t.Fatal("Clients should not be able to introspect each other's tokens")
+	}
+
+	refreshed, status := client.refresh(tokens.RefreshToken, "")
+	if status != http.StatusOK || refreshed.RefreshToken == tokens.RefreshToken || refreshed.Scope != "chirps:write" {
+		t.Fatalf("Unable to refresh: %d %+v", status, refreshed)
+	}
+	if _, status := client.refresh(refreshed.RefreshToken, "chirps:write profile:write"); status != http.StatusBadRequest {
+		t.Fatalf("Refreshing should not widen the scope, got %d", status)
+	}
+	if status := client.post("/oauth/revoke", url.Values{"token": {refreshed.RefreshToken}}, nil); status != http.StatusOK {
+		t.Fatalf("Unable to revoke: %d", status)
+	}
+	if client.introspect(refreshed.RefreshToken).Active {
+		t.Fatal("Revoked refresh tokens should be inactive")
+	}
+	if _, status := client.refresh(refreshed.RefreshToken, ""); status != http.StatusBadRequest {
+		t.Fatalf("Revoked refresh tokens should not refresh, got %d", status)
+	}
+}
+
+func TestOAuthRejectsBadRequests(t *testing.T) {
+	server, store, keys := newOAuthServer(t)
+	user, _ := store.CreateUsers("careful@example.com", []byte("hash"))
+	userToken := signRoleToken(t, keys, user.ID, types.RoleUser)
+	client := registerClient(t, server.URL, userToken, false)
+
+	request := client.authorizationRequest("chirps:read")
+	request["redirect_uri"] = "https://evil.example/callback"
+	request["approve"] = true
+	failure := map[string]string{}
+	if status := doJSON(t, http.MethodPost, server.URL+"/api/oauth/authorize", userToken, request, &failure); status != http.StatusBadRequest {
+		t.Fatalf("Unregistered redirect URIs should be rejected, got %d", status)
+	}
+	if failure["redirect_to"] != "" {
+		t.Fatalf("Errors about the redirect URI must not redirect, got %v", failure)
+	}
+
+	request = client.authorizationRequest("chirps:read admin")
+	request["approve"] = true
+	failure = map[string]string{}
+	doJSON(t, http.MethodPost, server.URL+"/api/oauth/authorize", userToken, request, &failure)
+	if failure["error"] != oauth.ErrorInvalidScope || strings.HasPrefix(failure["redirect_to"], redirectURI) == false {
+		t.Fatalf("Unknown scopes should be sent back to the client, got %v", failure)
+	}
+
+	denied := client.authorize(userToken, client.authorizationRequest("chirps:read"), false)
+	if denied.Get("error") != oauth.ErrorAccessDenied || denied.Get("state") != "xyz" {
+		t.Fatalf("Expected access_denied, got %v", denied)
+	}
+
+	callback := client.authorize(userToken, client.authorizationRequest("chirps:read"), true)
+	if _, status := client.exchange(callback.Get("code"), strings.Repeat("w", 43)); status != http.StatusBadRequest {
+		t.Fatalf("A wrong code_verifier should be rejected, got %d", status)
+	}
+
+	callback = client.authorize(userToken, client.authorizationRequest("chirps:read"), true)
+	impostor := &fakeClient{t: t, base: server.URL, clientId: client.clientId, secret: "guess"}
+	if _, status := impostor.exchange(callback.Get("code"), client.verifier); status != http.StatusUnauthorized {
+		t.Fatalf("Public clients should not accept a secret, got %d", status)
+	}
+	tokens, status := client.exchange(callback.Get("code"), client.verifier)
+	if status != http.StatusOK {
+		t.Fatalf("The public client should redeem its code with PKCE alone, got %d %+v", status, tokens)
+	}
+
+	store.SetSuspended(user.ID, true)
+	if _, status := client.refresh(tokens.RefreshToken, ""); status != http.StatusBadRequest {
+		t.Fatalf("Suspended users' grants should not refresh, got %d", status)
+	}
+	if client.introspect(tokens.AccessToken).Active {
+		t.Fatal("Suspended users' tokens should be inactive")
+	}
+}
+
+func TestOAuthClientsCantChangeCredentials(t *testing.T) {
+	server, store, keys := newOAuthServer(t)
+	owner, _ := store.CreateUsers("developer@example.com", []byte("hash"))
+	user, _ := store.CreateUsers("oauth-user@example.com", []byte("hash"))
+	userToken := signRoleToken(t, keys, user.ID, types.RoleUser)
+	client := registerClient(t, server.URL, signRoleToken(t, keys, owner.ID, types.RoleUser), true)
+	request := client.authorizationRequest("profile:write")
+	tokens, status := client.exchange(client.authorize(userToken, request, true).Get("code"), client.verifier)
+	if status != http.StatusOK {
+		t.Fatalf("Unable to exchange the code: %d", status)
+	}
+	if status := doJSON(t, http.MethodPut, server.URL+"/api/users", tokens.AccessToken, map[string]string{"bio": "Hi"}, nil); status != http.StatusOK {
+		t.Fatalf("profile:write should allow profile changes, got %d", status)
+	}
+	for _, body := range []map[string]string{{"email": "attacker@example.com"}, {"password": "hunter22"}} {
+		if status := doJSON(t, http.MethodPut, server.URL+"/api/users", tokens.AccessToken, body, nil); status != http.StatusForbidden {
+			t.Fatalf("Client tokens should not change %v, got %d", body, status)
+		}
+		if status := doJSON(t, http.MethodPut, server.URL+"/api/users", userToken, body, nil); status != http.StatusOK {
+			t.Fatalf("The user's own token should change %v, got %d", body, status)
+		}
+	}
+}
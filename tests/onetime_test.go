@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+func testOneTimeTokens(t *testing.T, store utils.Store) {
+	user, _ := store.CreateUsers("reset@example.com", []byte("hash"))
+	if _, err := store.CreateOneTimeToken(42, types.PurposePasswordReset, time.Hour); err == nil {
+		t.Fatal("Tokens should only be issued to existing users")
+	}
+	superseded, err := store.CreateOneTimeToken(user.ID, types.PurposePasswordReset, time.Hour)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	token, _ := store.CreateOneTimeToken(user.ID, types.PurposePasswordReset, time.Hour)
+	if token.Token == "" || token.Token == superseded.Token {
+		t.Fatal("Every token should be new")
+	}
+	if _, err := store.UseOneTimeToken(superseded.Token, types.PurposePasswordReset); errors.Is(err, utils.ErrOneTimeTokenInvalid) == false {
+		t.Fatalf("Issuing a new token should supersede the old one, got %v", err)
+	}
+	if _, err := store.UseOneTimeToken(token.Token, "other_purpose"); errors.Is(err, utils.ErrOneTimeTokenInvalid) == false {
+		t.Fatal("Tokens should only be usable for their purpose")
+	}
+	used, err := store.UseOneTimeToken(token.Token, types.PurposePasswordReset)
+	if err != nil || used.UserId != user.ID || used.UsedAt.IsZero() {
+		t.Fatalf("Unable to use the token: %v", err)
+	}
+	if _, err := store.UseOneTimeToken(token.Token, types.PurposePasswordReset); errors.Is(err, utils.ErrOneTimeTokenInvalid) == false {
+		t.Fatal("Tokens should only be usable once")
+	}
+	if err := store.SetOneTimeTokenFamily(used.ID, 7); err != nil {
+		t.Fatal(err.Error())
+	}
+	reused, err := store.UseOneTimeToken(token.Token, types.PurposePasswordReset)
+	if errors.Is(err, utils.ErrOneTimeTokenReused) == false || reused.ID != used.ID || reused.FamilyId != 7 {
+		t.Fatalf("Reuse should be reported with the token and its family, got %+v: %v", reused, err)
+	}
+	expired, _ := store.CreateOneTimeToken(user.ID, types.PurposePasswordReset, -time.Minute)
+	if _, err := store.UseOneTimeToken(expired.Token, types.PurposePasswordReset); errors.Is(err, utils.ErrOneTimeTokenInvalid) == false {
+		t.Fatal("Expired tokens should be rejected")
+	}
+}
+
+func TestOneTimeTokens(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	testOneTimeTokens(t, dbClient)
+}
+
+func TestSQLiteOneTimeTokens(t *testing.T) {
+	testOneTimeTokens(t, newSQLiteClient(t))
+}
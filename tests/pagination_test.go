@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+// collectChirpIds follows next_cursor until the last page and returns the
+// IDs in the order they were served.
+func collectChirpIds(t *testing.T, store utils.Store, query types.ChirpQuery) []int {
+	ids := []int{}
+	for pages := 0; pages < 20; pages++ {
+		page, err := store.ListChirps(query)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, chirp := range page.Chirps {
+			ids = append(ids, chirp.ID)
+		}
+		if page.NextCursor == "" {
+			return ids
+		}
+		query.Cursor = page.NextCursor
+	}
+	t.Fatal("Pagination never reached the last page")
+	return nil
+}
+
+func assertIds(t *testing.T, got []int, want []int) {
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected %v, got %v", want, got)
+		}
+	}
+}
+
+func testListChirps(t *testing.T, store utils.Store) {
+	// Authors alternate: odd chirps by user 1, even chirps by user 2.
+	for i := 1; i <= 7; i++ {
+		store.CreateChirp("Paged Chirp", 2-i%2)
+	}
+	store.DeleteChirp(3)
+	assertIds(t, collectChirpIds(t, store, types.ChirpQuery{Limit: 2}), []int{1, 2, 4, 5, 6, 7})
+	assertIds(t, collectChirpIds(t, store, types.ChirpQuery{Limit: 4, Descending: true}), []int{7, 6, 5, 4, 2, 1})
+	assertIds(t, collectChirpIds(t, store, types.ChirpQuery{Limit: 1, AuthorId: 1}), []int{1, 5, 7})
+	assertIds(t, collectChirpIds(t, store, types.ChirpQuery{AuthorId: 2, Descending: true}), []int{6, 4, 2})
+	assertIds(t, collectChirpIds(t, store, types.ChirpQuery{AuthorId: 3}), []int{})
+
+	page, _ := store.ListChirps(types.ChirpQuery{Limit: 6})
+	if page.NextCursor != "" {
+		t.Fatal("An exact final page should not have a next cursor")
+	}
+	if _, err := store.ListChirps(types.ChirpQuery{Cursor: "not-a-cursor"}); err == nil {
+		t.Fatal("Unknown cursors should be rejected")
+	}
+}
+
+func TestListChirps(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	testListChirps(t, dbClient)
+}
+
+func TestSQLiteListChirps(t *testing.T) {
+	testListChirps(t, newSQLiteClient(t))
+}
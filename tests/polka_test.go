@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/auth"
+	"github.com/mdwiltfong/chirpy/utils/polka"
+)
+
+const polkaKey = "f271c81ff7084ee5b99a5091b42d486e"
+
+// fakePolka stands in for the payment provider and delivers webhook events
+// the way Polka does.
+type fakePolka struct {
+	apiKey   string
+	endpoint string
+}
+
+func (provider fakePolka) send(t *testing.T, event string, userId int) int {
+	payload := polka.Event{Event: event}
+	payload.Data.UserId = userId
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest(http.MethodPost, provider.endpoint, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "ApiKey "+provider.apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func newPolkaServer(t *testing.T) (*utils.DataBaseClient, *httptest.Server) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	handler := auth.RequireApiKey(map[string]string{polkaKey: "polka"}, polka.NewWebhookHandler(dbClient))
+	server := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		server.Close()
+		dbClient.Close()
+		cleanUp(t)
+	})
+	return dbClient, server
+}
+
+func TestPolkaUpgradesUser(t *testing.T) {
+	dbClient, server := newPolkaServer(t)
+	user, _ := dbClient.CreateUsers("red@example.com", []byte("hash"))
+	provider := fakePolka{apiKey: polkaKey, endpoint: server.URL}
+	if status := provider.send(t, polka.EventUserUpgraded, user.ID); status != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", status)
+	}
+	upgraded, _ := dbClient.GetUserByID(user.ID)
+	if upgraded.IsChirpyRed == false {
+		t.Fatal("User should be upgraded to Chirpy Red")
+	}
+}
+
+func TestPolkaIgnoresUnknownEvents(t *testing.T) {
+	dbClient, server := newPolkaServer(t)
+	user, _ := dbClient.CreateUsers("red@example.com", []byte("hash"))
+	provider := fakePolka{apiKey: polkaKey, endpoint: server.URL}
+	if status := provider.send(t, "user.payment_failed", user.ID); status != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", status)
+	}
+	unchanged, _ := dbClient.GetUserByID(user.ID)
+	if unchanged.IsChirpyRed {
+		t.Fatal("Unknown events should not upgrade the user")
+	}
+	if status := provider.send(t, polka.EventUserUpgraded, 404); status != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing user, got %d", status)
+	}
+}
+
+func TestPolkaRejectsBadApiKey(t *testing.T) {
+	dbClient, server := newPolkaServer(t)
+	user, _ := dbClient.CreateUsers("red@example.com", []byte("hash"))
+	impostor := fakePolka{apiKey: "not-the-key", endpoint: server.URL}
+	if status := impostor.send(t, polka.EventUserUpgraded, user.ID); status != http.StatusUnauthorized {
+		t.Fatalf("Expected 401, got %d", status)
+	}
+	unchanged, _ := dbClient.GetUserByID(user.ID)
+	if unchanged.IsChirpyRed {
+		t.Fatal("Unauthenticated events should not upgrade the user")
+	}
+}
@@ -0,0 +1,192 @@
+package tests
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/auth"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+func signRoleToken(t *testing.T, keys *auth.KeySet, userId int, role string) string {
+	signed, err := keys.Sign(auth.AccessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(userId),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+		Role: role,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return signed
+}
+
+func TestPolicy(t *testing.T) {
+	if auth.Can(types.RoleUser, auth.ActionDeleteAnyChirp) {
+		t.Fatal("Users should not be able to delete other people's chirps")
+	}
+	if auth.Can(types.RoleModerator, auth.ActionDeleteAnyChirp) == false || auth.Can(types.RoleModerator, auth.ActionManageRoles) {
+		t.Fatal("Moderators should moderate chirps but not manage roles")
+	}
+	for _, action := range []string{auth.ActionManageRoles, auth.ActionResetMetrics, auth.ActionSuspendUsers} {
+		if auth.Can(types.RoleAdmin, action) == false {
+			t.Fatalf("Admins should be able to %s", action)
+		}
+	}
+	if auth.Can("", auth.ActionViewMetrics) {
+		t.Fatal("Unknown roles should not be able to do anything")
+	}
+	if auth.Outranks(types.RoleModerator, types.RoleModerator) || auth.Outranks(types.RoleModerator, types.RoleUser) == false {
+		t.Fatal("Moderators should only outrank users")
+	}
+}
+
+func TestCanDeleteChirp(t *testing.T) {
+	chirp := types.Chirp{ID: 1, Body: "Moderate me", AuthorId: 7}
+	if (auth.Principal{UserId: 7, Role: types.RoleUser}).CanDeleteChirp(chirp) == false {
+		t.Fatal("Authors should be able to delete their own chirps")
+	}
+	if (auth.Principal{UserId: 8, Role: types.RoleUser}).CanDeleteChirp(chirp) {
+		t.Fatal("Users should not be able to delete other people's chirps")
+	}
+	for _, role := range []string{types.RoleModerator, types.RoleAdmin} {
+		if (auth.Principal{UserId: 9, Role: role}).CanDeleteChirp(chirp) == false {
+			t.Fatalf("A %s should be able to delete other people's chirps", role)
+		}
+	}
+	if (auth.Principal{Role: types.RoleUser}).CanDeleteChirp(types.Chirp{ID: 2}) {
+		t.Fatal("Chirps without an author should only be deleted by staff")
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	store := newSQLiteClient(t)
+	keys, _ := auth.NewKeySet(auth.KeySetOptions{LegacySecret: jwtSecret})
+	admin, _ := store.CreateUsers("admin@example.com", []byte("hash"))
+	store.SetRole(admin.ID, types.RoleAdmin)
+	moderator, _ := store.CreateUsers("moderator@example.com", []byte("hash"))
+	store.SetRole(moderator.ID, types.RoleModerator)
+	user, _ := store.CreateUsers("user@example.com", []byte("hash"))
+	recorder := &principalRecorder{}
+	handler := auth.RequirePermission(keys, store, auth.ActionResetMetrics, recorder)
+	if resp := serve(handler, "Bearer "+signRoleToken(t, keys, admin.ID, types.RoleAdmin)); resp.Code != http.StatusOK {
+		t.Fatalf("Expected admins through, got %d", resp.Code)
+	}
+	if recorder.principal.Role != types.RoleAdmin {
+		t.Fatalf("Expected the admin role, got %q", recorder.principal.Role)
+	}
+	if resp := serve(handler, "Bearer "+signRoleToken(t, keys, moderator.ID, types.RoleModerator)); resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for moderators, got %d", resp.Code)
+	}
+	if resp := serve(handler, "Bearer "+signAccessToken(t, keys, user.ID, time.Minute)); resp.Code != http.StatusForbidden {
+		t.Fatalf("Tokens without a role should count as users, got %d", resp.Code)
+	}
+	if resp := serve(handler, ""); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without credentials, got %d", resp.Code)
+	}
+
+	// The role in the store wins over the one the token was issued with.
+	stale := "Bearer " + signRoleToken(t, keys, admin.ID, types.RoleAdmin)
+	store.SetRole(admin.ID, types.RoleUser)
+	if resp := serve(handler, stale); resp.Code != http.StatusForbidden {
+		t.Fatalf("Demoted admins should be turned away straight away, got %d", resp.Code)
+	}
+	store.SetRole(user.ID, types.RoleAdmin)
+	if resp := serve(handler, "Bearer "+signRoleToken(t, keys, user.ID, types.RoleUser)); resp.Code != http.StatusOK {
+		t.Fatalf("Promoted users should be let through straight away, got %d", resp.Code)
+	}
+}
+
+func testRoles(t *testing.T, store utils.Store) {
+	user, _ := store.CreateUsers("staff@example.com", []byte("hash"))
+	if user.Role != types.RoleUser {
+		t.Fatalf("New users should have the user role, got %q", user.Role)
+	}
+	if _, err := store.SetRole(user.ID, types.RoleModerator); err != nil {
+		t.Fatal(err.Error())
+	}
+	moderators, err := store.ListUsersByRole(types.RoleModerator)
+	if err != nil || len(moderators) != 1 || moderators[0].ID != user.ID {
+		t.Fatalf("Expected the moderator to be listed, got %+v: %v", moderators, err)
+	}
+	suspended, err := store.SetSuspended(user.ID, true)
+	if err != nil || suspended.IsSuspended == false || suspended.Role != types.RoleModerator {
+		t.Fatalf("Unable to suspend the user: %v", err)
+	}
+	if found, _ := store.GetUserByID(user.ID); found.IsSuspended == false {
+		t.Fatal("Suspension should be stored")
+	}
+	if _, err := store.SetRole(42, types.RoleAdmin); err == nil {
+		t.Fatal("Unknown users should not get roles")
+	}
+}
+
+func TestRoles(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	testRoles(t, dbClient)
+}
+
+func TestSQLiteRoles(t *testing.T) {
+	testRoles(t, newSQLiteClient(t))
+}
+
+func TestRequireActiveUser(t *testing.T) {
+	store := newSQLiteClient(t)
+	keys, _ := auth.NewKeySet(auth.KeySetOptions{LegacySecret: jwtSecret})
+	user, _ := store.CreateUsers("suspended@example.com", []byte("hash"))
+	recorder := &principalRecorder{}
+	handler := auth.RequireAccessToken(keys, auth.RequireActiveUser(store, recorder))
+	token := "Bearer " + signRoleToken(t, keys, user.ID, types.RoleUser)
+	if resp := serve(handler, token); resp.Code != http.StatusOK {
+		t.Fatalf("Expected active users through, got %d", resp.Code)
+	}
+	store.SetSuspended(user.ID, true)
+	if resp := serve(handler, token); resp.Code != http.StatusForbidden {
+		t.Fatalf("Suspended users should be turned away, got %d", resp.Code)
+	}
+}
+
+func TestBootstrapAdmin(t *testing.T) {
+	store := newSQLiteClient(t)
+	if _, ok, err := auth.BootstrapAdmin(store, "first@example.com"); ok || err != nil {
+		t.Fatalf("Nobody should be promoted before they sign up: %v", err)
+	}
+	first, _ := store.CreateUsers("first@example.com", []byte("hash"))
+	if _, ok, _ := auth.BootstrapAdmin(store, "First@Example.com"); ok {
+		t.Fatal("Unverified users should not be promoted")
+	}
+	store.SetEmailVerified(first.ID, true)
+	promoted, ok, err := auth.BootstrapAdmin(store, "First@Example.com")
+	if err != nil || ok == false || promoted.ID != first.ID || promoted.Role != types.RoleAdmin {
+		t.Fatalf("Expected the verified user to be promoted, got %+v: %v", promoted, err)
+	}
+	second, _ := store.CreateUsers("second@example.com", []byte("hash"))
+	store.SetEmailVerified(second.ID, true)
+	if _, ok, _ := auth.BootstrapAdmin(store, "second@example.com"); ok {
+		t.Fatal("Nobody should be bootstrapped once there is an admin")
+	}
+}
+
+func TestCheckCredentialChange(t *testing.T) {
+	delegated := []auth.Principal{{UserId: 1, ApiTokenId: 2}, {UserId: 1, ClientId: "app"}}
+	for _, principal := range delegated {
+		for _, change := range [][2]string{{"new@example.com", ""}, {"", "hunter22"}} {
+			if err := auth.CheckCredentialChange(principal, change[0], change[1]); err != auth.ErrDelegatedCredentials {
+				t.Fatalf("%+v should not change %v, got %v", principal, change, err)
+			}
+		}
+		if err := auth.CheckCredentialChange(principal, "", ""); err != nil {
+			t.Fatalf("%+v should be able to change the rest, got %v", principal, err)
+		}
+	}
+	if err := auth.CheckCredentialChange(auth.Principal{UserId: 1}, "new@example.com", "hunter22"); err != nil {
+		t.Fatalf("Users should change their own credentials, got %v", err)
+	}
+}
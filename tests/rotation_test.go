@@ -0,0 +1,61 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mdwiltfong/chirpy/utils"
+)
+
+func testRefreshTokenRotation(t *testing.T, store utils.Store) {
+	user, _ := store.CreateUsers("rotate@example.com", []byte("hash"))
+	login, err := store.GenerateRefreshToken(user.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if login.FamilyId != login.ID {
+		t.Fatal("Tokens issued at login should start a new family")
+	}
+	rotated, err := store.RotateRefreshToken(login.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if rotated.Token == login.Token || rotated.FamilyId != login.FamilyId || rotated.IsValid == false {
+		t.Fatalf("Unexpected rotated token %v", rotated)
+	}
+	old, _ := store.GetRefreshTokenID(login.ID)
+	if old.IsValid || old.ReplacedBy != rotated.ID {
+		t.Fatal("Rotated tokens should be invalidated and point at their replacement")
+	}
+	withToken, _ := store.GetUserByID(user.ID)
+	if withToken.RefreshTokenId != rotated.ID {
+		t.Fatal("User should point at the rotated token")
+	}
+
+	other, _ := store.GenerateRefreshToken(user.ID)
+	if _, err := store.RotateRefreshToken(login.ID); errors.Is(err, utils.ErrRefreshTokenReused) == false {
+		t.Fatalf("Reusing a rotated token should be detected, got %v", err)
+	}
+	revoked, _ := store.GetRefreshTokenID(rotated.ID)
+	if revoked.IsValid {
+		t.Fatal("Reuse should revoke the whole family")
+	}
+	if _, err := store.RotateRefreshToken(rotated.ID); errors.Is(err, utils.ErrRefreshTokenInvalid) == false {
+		t.Fatalf("Revoked tokens should not rotate, got %v", err)
+	}
+	untouched, _ := store.GetRefreshTokenID(other.ID)
+	if untouched.IsValid == false {
+		t.Fatal("Other families should survive a reuse")
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	testRefreshTokenRotation(t, dbClient)
+}
+
+func TestSQLiteRefreshTokenRotation(t *testing.T) {
+	testRefreshTokenRotation(t, newSQLiteClient(t))
+}
@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+func TestIDsAreNotReusedAfterDeletion(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	dbClient.CreateChirp("First Chirp", 1)
+	second, _ := dbClient.CreateChirp("Second Chirp", 1)
+	dbClient.Update(func(tx *utils.Tx) error {
+		utils.Remove(tx, tx.Chirps, second.ID)
+		return nil
+	})
+	third, err := dbClient.CreateChirp("Third Chirp", 1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if third.ID <= second.ID {
+		t.Fatalf("Expected an ID above %d, got %d", second.ID, third.ID)
+	}
+	first, _ := dbClient.GetChirp(1)
+	if first.Body != "First Chirp" {
+		t.Fatal("Existing chirps should never be overwritten")
+	}
+}
+
+func TestSequencesSeededForLegacyFiles(t *testing.T) {
+	legacy := `{"chirps":{"1":{"id":1,"body":"a"},"5":{"id":5,"body":"b"}},"users":{},"refresh_tokens":{}}`
+	if err := os.WriteFile("../database/database.json", []byte(legacy), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	dbClient, err := utils.NewDB("../database/database.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer cleanUp(t)
+	chirp, _ := dbClient.CreateChirp("After migration", 1)
+	if chirp.ID != 6 {
+		t.Fatalf("Expected ID 6 after the highest existing ID, got %d", chirp.ID)
+	}
+	if id, _ := dbClient.NextID(types.UsersCollection); id != 1 {
+		t.Fatalf("Expected the first user ID to be 1, got %d", id)
+	}
+}
+
+func TestSQLiteNextID(t *testing.T) {
+	dbClient := newSQLiteClient(t)
+	reserved, err := dbClient.NextID(types.ChirpsCollection)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	chirp, _ := dbClient.CreateChirp("After reservation", 1)
+	if chirp.ID <= reserved {
+		t.Fatalf("Inserted chirp %d reused reserved ID %d", chirp.ID, reserved)
+	}
+	if _, err := dbClient.NextID("unknown"); err == nil {
+		t.Fatal("Unknown collections should be rejected")
+	}
+}
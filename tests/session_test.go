@@ -0,0 +1,83 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+func testSessions(t *testing.T, store utils.Store) {
+	user, _ := store.CreateUsers("sessions@example.com", []byte("hash"))
+	other, _ := store.CreateUsers("other@example.com", []byte("hash"))
+	laptop, err := store.CreateSession(user.ID, types.SessionClient{DeviceLabel: "Laptop", UserAgent: "Firefox", IP: "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	phone, _ := store.CreateSession(user.ID, types.SessionClient{DeviceLabel: "Phone", UserAgent: "Safari", IP: "10.0.0.2"})
+	store.CreateSession(other.ID, types.SessionClient{DeviceLabel: "Desktop"})
+
+	rotated, err := store.RotateRefreshToken(laptop.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sessions, err := store.ListSessions(user.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected one session per device, got %v", sessions)
+	}
+	if sessions[0].ID != laptop.ID || sessions[0].DeviceLabel != "Laptop" || sessions[0].IP != "10.0.0.1" {
+		t.Fatalf("Rotation should keep the session, got %v", sessions[0])
+	}
+	if sessions[0].CreatedAt.Equal(laptop.CreatedAt) == false || sessions[0].LastUsedAt.Equal(rotated.LastUsedAt) == false {
+		t.Fatalf("Rotation should only move the last used time, got %v", sessions[0])
+	}
+	if sessions[1].ID != phone.ID || sessions[1].UserAgent != "Safari" {
+		t.Fatalf("Unexpected second session %v", sessions[1])
+	}
+
+	if err := store.RevokeRefreshTokenFamily(phone.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	sessions, _ = store.ListSessions(user.ID)
+	if len(sessions) != 1 || sessions[0].ID != laptop.ID {
+		t.Fatalf("Only the laptop session should remain, got %v", sessions)
+	}
+
+	if err := store.InvalidateUsersToken(user.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	if sessions, _ = store.ListSessions(user.ID); len(sessions) != 0 {
+		t.Fatalf("Logging out everywhere should end every session, got %v", sessions)
+	}
+	if sessions, _ = store.ListSessions(other.ID); len(sessions) != 1 {
+		t.Fatal("Other users' sessions should be untouched")
+	}
+
+	if _, err := store.CreateSession(42, types.SessionClient{}); err == nil {
+		t.Fatal("Unknown users should not get sessions")
+	}
+	ghost := "ghost@example.com"
+	if _, err := store.UpdateUser(42, types.UserUpdate{Email: &ghost}); err == nil {
+		t.Fatal("Updating an unknown user should fail")
+	}
+	if _, err := store.GetUserByID(42); err == nil {
+		t.Fatal("Neither should create the user")
+	}
+	if sessions, _ = store.ListSessions(42); len(sessions) != 0 {
+		t.Fatalf("Nothing should be stored for unknown users, got %v", sessions)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	testSessions(t, dbClient)
+}
+
+func TestSQLiteSessions(t *testing.T) {
+	testSessions(t, newSQLiteClient(t))
+}
@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mdwiltfong/chirpy/utils"
+)
+
+const sqlitePath = "../database/database.db"
+
+func newSQLiteClient(t *testing.T) *utils.SQLiteClient {
+	dbClient, err := utils.NewSQLiteDB(sqlitePath)
+	if err != nil {
+		t.Fatalf("There was an issue creating a SQLite connection: %s", err)
+	}
+	t.Cleanup(func() {
+		dbClient.Close()
+		os.Remove(sqlitePath)
+		os.Remove(sqlitePath + "-wal")
+		os.Remove(sqlitePath + "-shm")
+	})
+	return dbClient
+}
+
+func TestOpenStore(t *testing.T) {
+	store, err := utils.OpenStore("json", "../database/database.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := store.(*utils.DataBaseClient); ok == false {
+		t.Fatal("json driver should return a DataBaseClient")
+	}
+	cleanUp(t)
+	if _, err := utils.OpenStore("postgres", "unused"); err == nil {
+		t.Fatal("Unknown drivers should be rejected")
+	}
+}
+
+func TestSQLiteChirps(t *testing.T) {
+	dbClient := newSQLiteClient(t)
+	first, err := dbClient.CreateChirp("First Chirp", 1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	second, _ := dbClient.CreateChirp("Second Chirp", 7)
+	if second.ID == first.ID {
+		t.Fatal("Chirps should get distinct IDs")
+	}
+	chirps, err := dbClient.GetChirps()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(chirps) != 2 || chirps[0].Body != "First Chirp" {
+		t.Fatalf("Unexpected chirps: %v", chirps)
+	}
+	found, err := dbClient.GetChirp(second.ID)
+	if err != nil || found.Body != "Second Chirp" || found.AuthorId != 7 {
+		t.Fatalf("Unable to find chirp %d: %v", second.ID, err)
+	}
+	if _, err := dbClient.GetChirp(42); err == nil {
+		t.Fatal("Missing chirps should return an error")
+	}
+	if err := dbClient.DeleteChirp(first.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := dbClient.DeleteChirp(first.ID); err == nil {
+		t.Fatal("Deleting a missing chirp should return an error")
+	}
+}
+
+func TestSQLiteUsersAndTokens(t *testing.T) {
+	dbClient := newSQLiteClient(t)
+	user, err := dbClient.CreateUsers("test@example.com", []byte("hash"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if user.Password != nil {
+		t.Fatal("Password hash should not be returned")
+	}
+	found, err := dbClient.GetUserByEmail("test@example.com")
+	if err != nil || string(found.Password) != "hash" {
+		t.Fatalf("Unable to find user by email: %v", err)
+	}
+	token, err := dbClient.GenerateRefreshToken(user.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stored, err := dbClient.GetRefreshTokenByString(token.Token)
+	if err != nil || stored.ID != token.ID || stored.IsValid == false || stored.IsExpired() {
+		t.Fatalf("Refresh token was not stored correctly: %v", err)
+	}
+	withToken, _ := dbClient.GetUserByID(user.ID)
+	if withToken.RefreshTokenId != token.ID {
+		t.Fatal("User should point at its latest refresh token")
+	}
+	if err := dbClient.InvalidateUsersToken(user.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	invalidated, _ := dbClient.GetRefreshTokenID(token.ID)
+	if invalidated.IsValid {
+		t.Fatal("Refresh token should be invalidated")
+	}
+}
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mdwiltfong/chirpy/utils/auth"
+)
+
+func newTestThrottle(clock *fakeClock) *auth.LoginThrottle {
+	return auth.NewLoginThrottle(auth.LoginThrottleOptions{
+		Account: auth.ThrottlePolicy{FreeAttempts: 2, BaseDelay: time.Second, MaxDelay: 8 * time.Second, LockoutAfter: 6, LockoutFor: time.Hour},
+		IP:      auth.ThrottlePolicy{FreeAttempts: 4, BaseDelay: time.Second, MaxDelay: time.Minute},
+		Now:     clock.Now,
+	})
+}
+
+func TestLoginThrottleBacksOff(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	throttle := newTestThrottle(clock)
+	expected := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second}
+	for i, wait := range expected {
+		throttle.Fail("victim@example.com", "10.0.0.1")
+		if got := throttle.Check("Victim@Example.com ", "10.0.0.2"); got != wait {
+			t.Fatalf("After %d failures expected a %s wait, got %s", i+1, wait, got)
+		}
+		clock.Advance(wait)
+	}
+	if throttle.Check("victim@example.com", "10.0.0.2") != 0 {
+		t.Fatal("The client should be let through once the delay has passed")
+	}
+	throttle.Succeed("victim@example.com", "10.0.0.2")
+	throttle.Fail("victim@example.com", "10.0.0.2")
+	if throttle.Check("victim@example.com", "10.0.0.2") != 0 {
+		t.Fatal("A successful login should reset the account's failures")
+	}
+}
+
+func TestLoginThrottleLocksOutAndUnlocks(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	throttle := newTestThrottle(clock)
+	for i := 0; i < 6; i++ {
+		throttle.Fail("victim@example.com", "10.0.0.1")
+	}
+	if got := throttle.Check("victim@example.com", "10.0.0.9"); got != time.Hour {
+		t.Fatalf("Expected an hour long lockout from any IP, got %s", got)
+	}
+	clock.Advance(30 * time.Minute)
+	if throttle.Check("victim@example.com", "10.0.0.9") == 0 {
+		t.Fatal("The lockout should still be in force")
+	}
+	throttle.Unlock("victim@example.com")
+	if throttle.Check("victim@example.com", "10.0.0.9") != 0 {
+		t.Fatal("Unlocking should lift the lockout")
+	}
+}
+
+func TestLoginThrottleTracksIPsAcrossAccounts(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	throttle := newTestThrottle(clock)
+	for _, account := range []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"} {
+		throttle.Fail(account, "10.0.0.1")
+	}
+	if throttle.Check("f@example.com", "10.0.0.1") != time.Second {
+		t.Fatal("Spraying one password across accounts should slow the IP down")
+	}
+	if throttle.Check("f@example.com", "10.0.0.2") != 0 {
+		t.Fatal("Other IPs should be unaffected")
+	}
+}
+
+func TestLoginThrottleReservesParallelAttempts(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	throttle := newTestThrottle(clock)
+	for i := 0; i < 3; i++ {
+		if throttle.Check("victim@example.com", "10.0.0.1") != 0 {
+			t.Fatalf("Attempt %d should be let through", i+1)
+		}
+	}
+	if got := throttle.Check("victim@example.com", "10.0.0.2"); got != time.Second {
+		t.Fatalf("Attempts still in flight should count as failures, got a %s wait", got)
+	}
+	throttle.Succeed("victim@example.com", "10.0.0.1")
+	throttle.Release("victim@example.com", "10.0.0.1")
+	if got := throttle.Check("victim@example.com", "10.0.0.2"); got != 0 {
+		t.Fatalf("Settled attempts should no longer count, got a %s wait", got)
+	}
+	throttle.Fail("victim@example.com", "10.0.0.1")
+	throttle.Fail("victim@example.com", "10.0.0.2")
+	if got := throttle.Check("victim@example.com", "10.0.0.3"); got != 0 {
+		t.Fatalf("Two failures are free, got a %s wait", got)
+	}
+	if got := throttle.Check("victim@example.com", "10.0.0.3"); got != time.Second {
+		t.Fatalf("The third attempt in flight should wait for the second failure, got %s", got)
+	}
+}
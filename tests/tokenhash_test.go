@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mdwiltfong/chirpy/utils"
+)
+
+func testRefreshTokensHashedAtRest(t *testing.T, store utils.Store) {
+	user, _ := store.CreateUsers("hashed@example.com", []byte("hash"))
+	token, err := store.GenerateRefreshToken(user.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if token.Token == "" {
+		t.Fatal("Newly issued tokens should carry the plaintext token")
+	}
+	found, err := store.GetRefreshTokenByString(token.Token)
+	if err != nil || found.ID != token.ID {
+		t.Fatalf("Unable to look up the token: %v", err)
+	}
+	if found.Token != "" || found.TokenHash == "" || strings.HasPrefix(token.Token, found.TokenPrefix) == false {
+		t.Fatalf("Stored tokens should only keep a prefix and a hash, got %v", found)
+	}
+	forged := token.Token[:len(token.Token)-1] + "x"
+	if _, err := store.GetRefreshTokenByString(forged); err == nil {
+		t.Fatal("Tokens sharing a prefix should not match")
+	}
+	rotated, _ := store.RotateRefreshToken(token.ID)
+	if _, err := store.GetRefreshTokenByString(rotated.Token); err != nil {
+		t.Fatalf("Rotated tokens should be hashed too: %v", err)
+	}
+}
+
+func TestRefreshTokensHashedAtRest(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	testRefreshTokensHashedAtRest(t, dbClient)
+	token, _ := dbClient.GenerateRefreshToken(1)
+	dbClient.Compact()
+	dataBytes, _ := os.ReadFile("../database/database.json")
+	if strings.Contains(string(dataBytes), token.Token) {
+		t.Fatal("The plaintext token should not reach the database file")
+	}
+}
+
+func TestSQLiteRefreshTokensHashedAtRest(t *testing.T) {
+	dbClient := newSQLiteClient(t)
+	testRefreshTokensHashedAtRest(t, dbClient)
+	token, _ := dbClient.GenerateRefreshToken(1)
+	stored := 0
+	dbClient.DB.QueryRow("SELECT COUNT(*) FROM refresh_tokens WHERE token = ?", token.Token).Scan(&stored)
+	if stored != 0 {
+		t.Fatal("The plaintext token should not be stored")
+	}
+}
+
+func TestMigrateDBHashesRefreshTokens(t *testing.T) {
+	legacy := `{"version":3,"chirps":{},"users":{},"refresh_tokens":{"1":{"id":1,"userId":1,"token":"0123456789abcdef","is_valid":true,"family_id":1}},"sequences":{"refresh_tokens":1}}`
+	os.WriteFile("../database/database.json", []byte(legacy), 0644)
+	defer cleanUp(t)
+	dbClient, err := utils.NewDB("../database/database.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer dbClient.Close()
+	found, err := dbClient.GetRefreshTokenByString("0123456789abcdef")
+	if err != nil || found.ID != 1 {
+		t.Fatalf("Migrated tokens should still work: %v", err)
+	}
+	dataBytes, _ := os.ReadFile("../database/database.json")
+	if strings.Contains(string(dataBytes), "0123456789abcdef") {
+		t.Fatal("Migration should remove plaintext tokens")
+	}
+}
@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/auth"
+	"github.com/mdwiltfong/chirpy/utils/totp"
+)
+
+// rfcSecret is the SHA1 seed from RFC 6238 appendix B, base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	cases := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range cases {
+		got, err := totp.Code(rfcSecret, totp.Step(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if got != want {
+			t.Fatalf("Expected %s at %d, got %s", want, unix, got)
+		}
+	}
+	if _, err := totp.Code("not base32!", 1); errors.Is(err, totp.ErrInvalidSecret) == false {
+		t.Fatal("Invalid secrets should be rejected")
+	}
+}
+
+func TestTOTPValidate(t *testing.T) {
+	now := time.Unix(59, 0)
+	if step, ok := totp.Validate(rfcSecret, "287 082", now); ok == false || step != 1 {
+		t.Fatalf("The current code should be accepted, got step %d", step)
+	}
+	if _, ok := totp.Validate(rfcSecret, "287082", now.Add(totp.Period)); ok == false {
+		t.Fatal("The previous step's code should be accepted")
+	}
+	if _, ok := totp.Validate(rfcSecret, "287082", now.Add(2*totp.Period)); ok {
+		t.Fatal("Codes older than the skew should be rejected")
+	}
+	if _, ok := totp.Validate(rfcSecret, "28708", now); ok {
+		t.Fatal("Short codes should be rejected")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := totp.ProvisioningURI(rfcSecret, "Chirpy", "user@example.com")
+	if strings.HasPrefix(uri, "otpauth://totp/Chirpy:user@example.com?") == false {
+		t.Fatalf("Unexpected URI %s", uri)
+	}
+	for _, part := range []string{"secret=" + rfcSecret, "issuer=Chirpy", "digits=6", "period=30"} {
+		if strings.Contains(uri, part) == false {
+			t.Fatalf("Expected %s in %s", part, uri)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := totp.GenerateRecoveryCodes(10)
+	if err != nil || len(codes) != 10 {
+		t.Fatalf("Expected 10 codes, got %v: %v", codes, err)
+	}
+	if len(codes[0]) != 11 || codes[0][5] != '-' || codes[0] == codes[1] {
+		t.Fatalf("Unexpected codes %v", codes)
+	}
+	if totp.NormalizeRecoveryCode(" ABCDE-FGHIJ") != totp.NormalizeRecoveryCode("abcdefghij") {
+		t.Fatal("Recovery codes should compare regardless of case and dashes")
+	}
+}
+
+func testMFA(t *testing.T, store utils.Store) {
+	user, _ := store.CreateUsers("mfa@example.com", []byte("hash"))
+	clock := &fakeClock{now: time.Unix(59, 0)}
+	mfa, err := store.GetMFA(user.ID)
+	if err != nil || mfa.TOTPEnabled {
+		t.Fatalf("Users should start without 2FA: %v", err)
+	}
+	if err := store.EnrollTOTP(user.ID, rfcSecret); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := auth.VerifySecondFactor(store, user.ID, "287082", "", clock.Now()); err != nil {
+		t.Fatalf("The pending secret should verify: %v", err)
+	}
+	if err := store.EnableTOTP(user.ID, []string{"aaaaa-bbbbb", "ccccc-ddddd"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := store.EnrollTOTP(user.ID, rfcSecret); errors.Is(err, utils.ErrMFAEnabled) == false {
+		t.Fatal("Enrolling again should fail while 2FA is on")
+	}
+	if err := auth.VerifySecondFactor(store, user.ID, "287082", "", clock.Now()); errors.Is(err, utils.ErrMFACodeInvalid) == false {
+		t.Fatal("A code should not be accepted twice")
+	}
+	clock.Advance(totp.Period)
+	code, _ := totp.Code(rfcSecret, totp.Step(clock.Now()))
+	if err := auth.VerifySecondFactor(store, user.ID, code, "", clock.Now()); err != nil {
+		t.Fatalf("The next step's code should verify: %v", err)
+	}
+	if err := auth.VerifySecondFactor(store, user.ID, "", "AAAAA-BBBBB", clock.Now()); err != nil {
+		t.Fatalf("Recovery codes should verify: %v", err)
+	}
+	if err := auth.VerifySecondFactor(store, user.ID, "", "aaaaabbbbb", clock.Now()); errors.Is(err, utils.ErrMFACodeInvalid) == false {
+		t.Fatal("Recovery codes should only work once")
+	}
+	if err := store.DisableTOTP(user.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	mfa, _ = store.GetMFA(user.ID)
+	if mfa.TOTPEnabled || mfa.TOTPSecret != "" {
+		t.Fatal("Disabling should remove the secret")
+	}
+	if err := auth.VerifySecondFactor(store, user.ID, "", "ccccc-ddddd", clock.Now()); errors.Is(err, utils.ErrMFACodeInvalid) == false {
+		t.Fatal("Disabling should remove the recovery codes")
+	}
+}
+
+func TestMFA(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	testMFA(t, dbClient)
+}
+
+func TestSQLiteMFA(t *testing.T) {
+	testMFA(t, newSQLiteClient(t))
+}
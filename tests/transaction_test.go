@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+func TestConcurrentWritesAreNotLost(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	const writers = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*2)
+	for i := 0; i < writers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := dbClient.CreateChirp("Concurrent Chirp", 1); err != nil {
+				errs <- err
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			if _, err := dbClient.CreateUsers(fmt.Sprintf("concurrent%d@example.com", i), []byte("hash")); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err.Error())
+	}
+	dbData, err := dbClient.LoadDB()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(dbData.Chirps) != writers {
+		t.Fatalf("Expected %d chirps, found %d", writers, len(dbData.Chirps))
+	}
+	if len(dbData.Users) != writers {
+		t.Fatalf("Expected %d users, found %d", writers, len(dbData.Users))
+	}
+	for id, chirp := range dbData.Chirps {
+		if chirp.ID != id {
+			t.Fatalf("Chirp stored under %d has ID %d", id, chirp.ID)
+		}
+	}
+}
+
+func TestUpdateRollsBackOnError(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	failure := errors.New("Abort transaction")
+	err := dbClient.Update(func(tx *utils.Tx) error {
+		utils.Put(tx, tx.Chirps, 1, types.Chirp{ID: 1, Body: "Never persisted"})
+		return failure
+	})
+	if errors.Is(err, failure) == false {
+		t.Fatalf("Expected the transaction error, got %v", err)
+	}
+	chirps, _ := dbClient.GetChirps()
+	if len(chirps) != 0 {
+		t.Fatal("Failed transaction should not write to disk")
+	}
+}
+
+func TestUpdateRollsBackTouchedRecords(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	defer dbClient.Close()
+	user, _ := dbClient.CreateUsers("kept@example.com", []byte("hash"))
+	chirp, _ := dbClient.CreateChirp("Kept Chirp", user.ID)
+	failure := errors.New("Abort transaction")
+	dbClient.Update(func(tx *utils.Tx) error {
+		renamed := tx.Users[user.ID]
+		renamed.Email = "renamed@example.com"
+		utils.Put(tx, tx.Users, user.ID, renamed)
+		utils.Remove(tx, tx.Chirps, chirp.ID)
+		tx.NextID(types.ChirpsCollection)
+		return failure
+	})
+	if found, err := dbClient.GetUserByEmail("kept@example.com"); err != nil || found.ID != user.ID {
+		t.Fatalf("The user should keep their email: %v", err)
+	}
+	if _, err := dbClient.GetUserByEmail("renamed@example.com"); err == nil {
+		t.Fatal("The rolled back email should not be indexed")
+	}
+	if _, err := dbClient.GetChirp(chirp.ID); err != nil {
+		t.Fatal("The removed chirp should be back")
+	}
+	if next, _ := dbClient.CreateChirp("Next Chirp", user.ID); next.ID != chirp.ID+1 {
+		t.Fatalf("The sequence should be rolled back too, got ID %d", next.ID)
+	}
+}
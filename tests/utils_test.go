@@ -5,6 +5,7 @@ import (
 	"github.com/mdwiltfong/chirpy/utils"
 	"github.com/mdwiltfong/chirpy/utils/types"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -13,6 +14,11 @@ func cleanUp(t *testing.T) {
 	if delErr != nil {
 		t.Fatal(delErr)
 	}
+	// Write-ahead logs, migration backups and the like
+	siblings, _ := filepath.Glob("../database/database.json.*")
+	for _, sibling := range siblings {
+		os.Remove(sibling)
+	}
 }
 
 func TestDbFunctions(t *testing.T) {
@@ -26,7 +32,7 @@ func TestDbFunctions(t *testing.T) {
 	// Check that a database.json file was actually made
 	dataBytes, readErr := os.ReadFile("../database/database.json")
 	tempStruct := types.Database{Chirps: make(map[int]types.Chirp), Users: make(map[int]types.User)}
-	json.Unmarshal(dataBytes, tempStruct)
+	json.Unmarshal(dataBytes, &tempStruct)
 	if readErr != nil {
 		t.Fatalf("There was an issue in finding the database file: %s", readErr.Error())
 	}
@@ -94,7 +100,7 @@ func TestGetChirps(t *testing.T) {
 
 func TestCreateChirps(t *testing.T) {
 	dbClient, _ := utils.NewDB("../database/database.json")
-	chirp, err := dbClient.CreateChirp("Test Chirp")
+	chirp, err := dbClient.CreateChirp("Test Chirp", 1)
 	if chirp.Body != "Test Chirp" {
 		t.Fatalf("Chirp body is incorrect. Was expecting: %s , but got %s instead", "Test Chirp", chirp.Body)
 	}
@@ -105,5 +111,24 @@ func TestCreateChirps(t *testing.T) {
 	if chirps[0].Body != "Test Chirp" {
 		t.Fatal("New chirp isn't being saved into disk")
 	}
+	if chirps[0].AuthorId != 1 {
+		t.Fatalf("Chirp author is incorrect. Was expecting: %d , but got %d instead", 1, chirps[0].AuthorId)
+	}
+	cleanUp(t)
+}
+
+func TestDeleteChirp(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	chirp, _ := dbClient.CreateChirp("Test Chirp", 1)
+	err := dbClient.DeleteChirp(chirp.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, getErr := dbClient.GetChirp(chirp.ID); getErr == nil {
+		t.Fatal("Deleted chirp is still stored")
+	}
+	if deleteErr := dbClient.DeleteChirp(chirp.ID); deleteErr == nil {
+		t.Fatal("Deleting a missing chirp should return an error")
+	}
 	cleanUp(t)
 }
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+func readSnapshot(t *testing.T) types.Database {
+	dataBytes, err := os.ReadFile("../database/database.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	snapshot := types.Database{}
+	if err := json.Unmarshal(dataBytes, &snapshot); err != nil {
+		t.Fatal(err.Error())
+	}
+	return snapshot
+}
+
+func TestWALReplayedOnStartup(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	dbClient.CompactEvery = 1000
+	for i := 0; i < 3; i++ {
+		if _, err := dbClient.CreateChirp("Logged Chirp", 1); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if len(readSnapshot(t).Chirps) != 0 {
+		t.Fatal("Updates should only reach the snapshot on compaction")
+	}
+	// Simulate the process dying before compaction by opening a fresh client.
+	restarted, err := utils.NewDB("../database/database.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	chirps, _ := restarted.GetChirps()
+	if len(chirps) != 3 {
+		t.Fatalf("Expected 3 chirps after replay, found %d", len(chirps))
+	}
+	if len(readSnapshot(t).Chirps) != 3 {
+		t.Fatal("Startup should compact the replayed log into the snapshot")
+	}
+	if _, err := os.Stat("../database/database.json.wal"); os.IsNotExist(err) == false {
+		t.Fatal("Write-ahead log should be removed after compaction")
+	}
+}
+
+func TestWALIgnoresTornRecord(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	dbClient.CompactEvery = 1000
+	dbClient.CreateChirp("Committed Chirp", 1)
+	wal, err := os.OpenFile("../database/database.json.wal", os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	wal.WriteString(`0badc0de {"set":{"chirps":{"2":{"id":2,`)
+	wal.Close()
+	restarted, err := utils.NewDB("../database/database.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	chirps, _ := restarted.GetChirps()
+	if len(chirps) != 1 || chirps[0].Body != "Committed Chirp" {
+		t.Fatalf("Only the committed chirp should survive, found %v", chirps)
+	}
+}
+
+func TestCompactionLeavesNoTempFiles(t *testing.T) {
+	dbClient, _ := utils.NewDB("../database/database.json")
+	defer cleanUp(t)
+	dbClient.CompactEvery = 2
+	for i := 0; i < 5; i++ {
+		dbClient.CreateChirp("Compacted Chirp", 1)
+	}
+	chirps, _ := dbClient.GetChirps()
+	if len(chirps) != 5 {
+		t.Fatalf("Expected 5 chirps, found %d", len(chirps))
+	}
+	if err := dbClient.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(readSnapshot(t).Chirps) != 5 {
+		t.Fatal("Closing should flush every chirp into the snapshot")
+	}
+	leftovers, _ := filepath.Glob("../database/database.json.*")
+	if len(leftovers) != 0 {
+		t.Fatalf("Compaction left files behind: %v", leftovers)
+	}
+}
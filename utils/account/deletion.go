@@ -0,0 +1,114 @@
+// Package account carries out account deletion. Users schedule it, and it is
+// finalized once their grace period is over unless they log in before then.
+package account
+
+import (
+	"log"
+	"time"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+// DefaultGracePeriod is how long users have to change their mind.
+const DefaultGracePeriod = 30 * 24 * time.Hour
+
+// Deleter schedules, cancels and finalizes deletions in Store.
+type Deleter struct {
+	Store       utils.Store
+	GracePeriod time.Duration
+	// AnonymizeChirps keeps deleted users' chirps without an author instead
+	// of deleting them.
+	AnonymizeChirps bool
+	// Cleanup, if set, removes what a user leaves outside the store once
+	// they are deleted.
+	Cleanup func(user types.User) error
+}
+
+func (deleter Deleter) gracePeriod() time.Duration {
+	if deleter.GracePeriod <= 0 {
+		return DefaultGracePeriod
+	}
+	return deleter.GracePeriod
+}
+
+// Schedule deletes the user once the grace period from now is over, and
+// logs them out everywhere so the only way back in is a fresh login, which
+// cancels. Scheduling again keeps the original date.
+func (deleter Deleter) Schedule(userId int, now time.Time) (types.User, error) {
+	user, err := deleter.Store.GetUserByID(userId)
+	if err != nil {
+		return types.User{}, err
+	}
+	if user.DeletionScheduledAt.IsZero() {
+		user, err = deleter.Store.SetDeletionScheduledAt(userId, now.Add(deleter.gracePeriod()))
+		if err != nil {
+			return types.User{}, err
+		}
+	}
+	if err := deleter.Store.InvalidateUsersToken(userId); err != nil {
+		return types.User{}, err
+	}
+	return user, nil
+}
+
+// Cancel keeps user's account, and reports whether it was scheduled for
+// deletion.
+func (deleter Deleter) Cancel(user types.User) (types.User, bool, error) {
+	if user.DeletionScheduledAt.IsZero() {
+		return user, false, nil
+	}
+	cancelled, err := deleter.Store.SetDeletionScheduledAt(user.ID, time.Time{})
+	if err != nil {
+		return user, false, err
+	}
+	return cancelled, true, nil
+}
+
+// FinalizeDue deletes every user whose grace period is over by now and
+// returns their IDs. It stops at the first user it fails to delete. Users who
+// log in after being listed keep their account, since the store only
+// deletes them if they are still due.
+func (deleter Deleter) FinalizeDue(now time.Time) ([]int, error) {
+	due, err := deleter.Store.ListUsersDueForDeletion(now)
+	if err != nil {
+		return nil, err
+	}
+	deleted := []int{}
+	for _, user := range due {
+		current, ok, err := deleter.Store.DeleteUserIfDue(user.ID, now, deleter.AnonymizeChirps)
+		if err != nil {
+			return deleted, err
+		}
+		if ok == false {
+			continue
+		}
+		deleted = append(deleted, user.ID)
+		if deleter.Cleanup != nil {
+			if err := deleter.Cleanup(current); err != nil {
+				log.Printf("Unable to clean up after deleted user %d: %s", user.ID, err)
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// Run finalizes due deletions every interval until stop is closed.
+func (deleter Deleter) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		deleted, err := deleter.FinalizeDue(time.Now().UTC())
+		for _, userId := range deleted {
+			log.Printf("Deleted user %d at the end of their grace period", userId)
+		}
+		if err != nil {
+			log.Printf("Unable to finalize account deletions: %s", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Package auth extracts and validates the credentials Chirpy accepts and
+// carries the authenticated principal through the request context.
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+var ErrMissingCredentials = errors.New("Missing credentials")
+
+// Principal is whoever a request was authenticated as.
+type Principal struct {
+	// UserId is set for requests carrying a user's access or refresh token.
+	UserId int
+	// RefreshToken is the stored token for requests authenticated by
+	// RequireRefreshToken.
+	RefreshToken types.RefreshToken
+	// Service names the integration for requests authenticated by API key.
+	Service string
+	// ApiTokenId and Scopes are set for requests carrying a user's API
+	// token, see RequireScope.
+	ApiTokenId int
+	Scopes     []string
+	// ClientId is set, along with Scopes, for requests carrying an access
+	// token issued to an OAuth client.
+	ClientId string
+	// Role is the user's role, see Can. RequireActiveUser sets it to the
+	// user's current role, before that it is the role when the access token
+	// was issued.
+	Role string
+}
+
+// IsDelegated reports whether the request carries a credential the user
+// handed to someone else, an API token or an OAuth client's token, rather
+// than one of their own sessions.
+func (principal Principal) IsDelegated() bool {
+	return principal.ApiTokenId != 0 || principal.ClientId != ""
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal stored by one of the Require
+// middlewares.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// GetBearerToken returns the token from an "Authorization: Bearer <token>"
+// header.
+func GetBearerToken(headers http.Header) (string, error) {
+	return getCredential(headers, "Bearer")
+}
+
+// GetApiKey returns the key from an "Authorization: ApiKey <key>" header.
+func GetApiKey(headers http.Header) (string, error) {
+	return getCredential(headers, "ApiKey")
+}
+
+func getCredential(headers http.Header, scheme string) (string, error) {
+	gotScheme, credential, found := strings.Cut(strings.TrimSpace(headers.Get("Authorization")), " ")
+	if found == false || strings.EqualFold(gotScheme, scheme) == false {
+		return "", ErrMissingCredentials
+	}
+	credential = strings.TrimSpace(credential)
+	if credential == "" {
+		return "", ErrMissingCredentials
+	}
+	return credential, nil
+}
+
+// AccessClaims are the claims of the access tokens Chirpy issues.
+type AccessClaims struct {
+	jwt.RegisteredClaims
+	// Role is the user's role when the token was issued. Tokens from before
+	// roles existed have none and are treated as types.RoleUser.
+	Role string `json:"role,omitempty"`
+	// ClientId and Scope are set on tokens issued to an OAuth client. Scope
+	// is space separated, as in OAuth.
+	ClientId string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+}
+
+// ParseAccessToken checks an access token signed by one of keys and returns
+// its claims.
+func ParseAccessToken(tokenString string, keys *KeySet) (AccessClaims, error) {
+	claims := AccessClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, &claims, keys.Keyfunc,
+		jwt.WithValidMethods([]string{AlgorithmEdDSA, AlgorithmRS256, jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return AccessClaims{}, err
+	}
+	if isLegacy(token) {
+		log.Printf("SECURITY: accepted a legacy HS256 access token of user %s, the legacy secret stops verifying at %s",
+			claims.Subject, keys.LegacyExpiry().Format(time.RFC3339))
+	}
+	if claims.Role == "" {
+		claims.Role = types.RoleUser
+	}
+	return claims, nil
+}
+
+// ValidateJWT checks an access token signed by one of keys and returns the
+// ID of the user it was issued to.
+func ValidateJWT(tokenString string, keys *KeySet) (int, error) {
+	principal, err := accessTokenPrincipal(tokenString, keys)
+	return principal.UserId, err
+}
+
+func accessTokenPrincipal(tokenString string, keys *KeySet) (Principal, error) {
+	claims, err := ParseAccessToken(tokenString, keys)
+	if err != nil {
+		return Principal{}, err
+	}
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return Principal{}, err
+	}
+	if claims.ClientId != "" {
+		// Like API tokens, OAuth clients never act with staff privileges.
+		return Principal{UserId: userId, Role: types.RoleUser, ClientId: claims.ClientId, Scopes: strings.Fields(claims.Scope)}, nil
+	}
+	return Principal{UserId: userId, Role: claims.Role}, nil
+}
+
+// Unauthorized is the response every middleware in this package sends for a
+// missing or invalid credential.
+func Unauthorized(w http.ResponseWriter) {
+	writeError(w, http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+}
+
+func writeError(w http.ResponseWriter, status int, fields map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	body, _ := json.Marshal(fields)
+	w.Write(body)
+}
+
+// RequireAccessToken only lets through requests carrying a valid access JWT
+// issued to the user themselves. API tokens and OAuth clients' tokens are
+// refused, so routes wrapped in it are out of reach of automation and
+// third-party apps whatever their scopes.
+func RequireAccessToken(keys *KeySet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := GetBearerToken(r.Header)
+		if err != nil {
+			Unauthorized(w)
+			return
+		}
+		principal, err := accessTokenPrincipal(token, keys)
+		if err != nil || principal.ClientId != "" {
+			Unauthorized(w)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// RequireRefreshToken only lets through requests whose bearer token is a
+// refresh token known to store. Checking that it is still valid is left to
+// the handler, since revoking an expired token is not an error.
+func RequireRefreshToken(store utils.Store, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := GetBearerToken(r.Header)
+		if err != nil {
+			Unauthorized(w)
+			return
+		}
+		refreshToken, err := store.GetRefreshTokenByString(token)
+		if err != nil {
+			Unauthorized(w)
+			return
+		}
+		principal := Principal{UserId: refreshToken.UserId, RefreshToken: refreshToken}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// RequireApiKey only lets through requests carrying one of keys, which maps
+// each API key to the name of the service it was issued to.
+func RequireApiKey(keys map[string]string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey, err := GetApiKey(r.Header)
+		if err != nil {
+			Unauthorized(w)
+			return
+		}
+		for key, service := range keys {
+			if key != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(key)) == 1 {
+				next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), Principal{Service: service})))
+				return
+			}
+		}
+		Unauthorized(w)
+	})
+}
@@ -0,0 +1,397 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Signing algorithms a KeySet can issue tokens with.
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+)
+
+var ErrUnknownKey = errors.New("Unknown signing key")
+
+type KeySetOptions struct {
+	// Algorithm is AlgorithmEdDSA or AlgorithmRS256; EdDSA if empty.
+	Algorithm string
+	// Path is the file the keys are kept in so tokens survive restarts.
+	// Keys are only kept in memory if it is empty.
+	Path string
+	// RotateEvery is how long a key signs tokens before a new one takes
+	// over. Defaults to 30 days.
+	RotateEvery time.Duration
+	// MaxTokenLifetime is the longest a token signed by the set can live.
+	// Retired keys are kept for verification until every token they signed
+	// has expired.
+	MaxTokenLifetime time.Duration
+	// LegacySecret, if set, still verifies HS256 tokens without a kid
+	// header, from before keys were rotated, but only tokens issued before
+	// the set's first key was created and expiring at most MaxTokenLifetime
+	// after that. Once LegacyExpiry has passed it verifies nothing and can
+	// be dropped.
+	LegacySecret string
+	// Now is the clock, time.Now if nil.
+	Now func() time.Time
+}
+
+// SigningKey is one key of a KeySet.
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	CreatedAt time.Time
+	// RetiredAt is when a newer key took over signing, zero for the current
+	// key.
+	RetiredAt time.Time
+	private   crypto.Signer
+}
+
+func (key *SigningKey) method() jwt.SigningMethod {
+	if key.Algorithm == AlgorithmRS256 {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+// KeySet signs access tokens with its newest key and verifies them with any
+// key that may still have unexpired tokens out. Keys rotate on schedule the
+// next time a token is signed.
+type KeySet struct {
+	options KeySetOptions
+	mu      sync.RWMutex
+	// keys is ordered oldest first; the last key is the current one.
+	keys []*SigningKey
+	// legacyCutoff is when the first key was created, after which no
+	// HS256 token was issued.
+	legacyCutoff time.Time
+}
+
+func NewKeySet(options KeySetOptions) (*KeySet, error) {
+	if options.Algorithm == "" {
+		options.Algorithm = AlgorithmEdDSA
+	}
+	if options.Algorithm != AlgorithmEdDSA && options.Algorithm != AlgorithmRS256 {
+		return nil, fmt.Errorf("Unsupported signing algorithm: %s", options.Algorithm)
+	}
+	if options.RotateEvery <= 0 {
+		options.RotateEvery = 30 * 24 * time.Hour
+	}
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	keySet := &KeySet{options: options}
+	if err := keySet.load(); err != nil {
+		return nil, err
+	}
+	keySet.mu.Lock()
+	defer keySet.mu.Unlock()
+	if keySet.legacyCutoff.IsZero() {
+		keySet.legacyCutoff = options.Now().UTC()
+	}
+	if err := keySet.rotateIfDue(); err != nil {
+		return nil, err
+	}
+	return keySet, nil
+}
+
+// LegacyExpiry is when the last HS256 token LegacySecret may verify
+// expires.
+func (keySet *KeySet) LegacyExpiry() time.Time {
+	return keySet.legacyCutoff.Add(keySet.options.MaxTokenLifetime)
+}
+
+// Rotate makes a new key current straight away, for example after a key
+// may have leaked. The old key keeps verifying until its tokens expire.
+func (keySet *KeySet) Rotate() error {
+	keySet.mu.Lock()
+	defer keySet.mu.Unlock()
+	return keySet.rotate()
+}
+
+// Keys returns the keys tokens may currently be verified with.
+func (keySet *KeySet) Keys() []SigningKey {
+	keySet.mu.RLock()
+	defer keySet.mu.RUnlock()
+	keys := []SigningKey{}
+	for _, key := range keySet.keys {
+		keys = append(keys, *key)
+	}
+	return keys
+}
+
+// Sign signs claims with the current key, rotating first if it is due.
+func (keySet *KeySet) Sign(claims jwt.Claims) (string, error) {
+	keySet.mu.Lock()
+	if err := keySet.rotateIfDue(); err != nil {
+		keySet.mu.Unlock()
+		return "", err
+	}
+	key := keySet.keys[len(keySet.keys)-1]
+	keySet.mu.Unlock()
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.private)
+}
+
+// Keyfunc finds the key a token was signed with, for jwt.Parse.
+func (keySet *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok && keySet.acceptsLegacy(token.Claims) {
+			return []byte(keySet.options.LegacySecret), nil
+		}
+		return nil, ErrUnknownKey
+	}
+	keySet.mu.RLock()
+	defer keySet.mu.RUnlock()
+	for _, key := range keySet.keys {
+		if key.ID == kid && key.Algorithm == token.Method.Alg() && keySet.verifies(key) {
+			return key.private.Public(), nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// acceptsLegacy reports whether claims could belong to an HS256 token issued
+// before the first key, so that whoever still holds LegacySecret can't mint
+// new ones.
+func (keySet *KeySet) acceptsLegacy(claims jwt.Claims) bool {
+	if keySet.options.LegacySecret == "" || keySet.options.Now().Before(keySet.LegacyExpiry()) == false {
+		return false
+	}
+	issuedAt, err := claims.GetIssuedAt()
+	if err != nil || issuedAt == nil || issuedAt.Before(keySet.legacyCutoff) == false {
+		return false
+	}
+	expiresAt, err := claims.GetExpirationTime()
+	return err == nil && expiresAt != nil && expiresAt.After(keySet.LegacyExpiry()) == false
+}
+
+// isLegacy reports whether token was verified with LegacySecret.
+func isLegacy(token *jwt.Token) bool {
+	kid, _ := token.Header["kid"].(string)
+	return kid == ""
+}
+
+// verifies reports whether tokens signed by key can still be unexpired.
+func (keySet *KeySet) verifies(key *SigningKey) bool {
+	if key.RetiredAt.IsZero() {
+		return true
+	}
+	return keySet.options.Now().Before(key.RetiredAt.Add(keySet.options.MaxTokenLifetime))
+}
+
+func (keySet *KeySet) rotateIfDue() error {
+	if len(keySet.keys) > 0 {
+		current := keySet.keys[len(keySet.keys)-1]
+		if keySet.options.Now().Before(current.CreatedAt.Add(keySet.options.RotateEvery)) {
+			return nil
+		}
+	}
+	return keySet.rotate()
+}
+
+func (keySet *KeySet) rotate() error {
+	key, err := generateSigningKey(keySet.options.Algorithm, keySet.options.Now().UTC())
+	if err != nil {
+		return err
+	}
+	keys := []*SigningKey{}
+	for _, existing := range keySet.keys {
+		if existing.RetiredAt.IsZero() {
+			existing.RetiredAt = key.CreatedAt
+		}
+		if keySet.verifies(existing) {
+			keys = append(keys, existing)
+		}
+	}
+	keySet.keys = append(keys, key)
+	return keySet.save()
+}
+
+func generateSigningKey(algorithm string, now time.Time) (*SigningKey, error) {
+	kid := make([]byte, 8)
+	if _, err := rand.Read(kid); err != nil {
+		return nil, err
+	}
+	key := &SigningKey{ID: hex.EncodeToString(kid), Algorithm: algorithm, CreatedAt: now}
+	if algorithm == AlgorithmRS256 {
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		key.private = private
+		return key, nil
+	}
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	key.private = private
+	return key, nil
+}
+
+// storedKeySet is what KeySetOptions.Path holds. Files written before the
+// legacy cutoff was kept hold just the list of keys.
+type storedKeySet struct {
+	LegacyCutoff time.Time   `json:"legacy_cutoff"`
+	Keys         []storedKey `json:"keys"`
+}
+
+// storedKey is how a SigningKey is written to KeySetOptions.Path.
+type storedKey struct {
+	ID         string    `json:"kid"`
+	Algorithm  string    `json:"alg"`
+	CreatedAt  time.Time `json:"created_at"`
+	RetiredAt  time.Time `json:"retired_at"`
+	PrivateKey string    `json:"private_key"`
+}
+
+func (keySet *KeySet) load() error {
+	if keySet.options.Path == "" {
+		return nil
+	}
+	dataBytes, err := os.ReadFile(keySet.options.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	stored := storedKeySet{}
+	if err := json.Unmarshal(dataBytes, &stored); err != nil {
+		if err := json.Unmarshal(dataBytes, &stored.Keys); err != nil {
+			return err
+		}
+		// The oldest key left is the best guess at when HS256 stopped.
+		if len(stored.Keys) > 0 {
+			stored.LegacyCutoff = stored.Keys[0].CreatedAt
+		}
+	}
+	keySet.legacyCutoff = stored.LegacyCutoff
+	for _, entry := range stored.Keys {
+		block, _ := pem.Decode([]byte(entry.PrivateKey))
+		if block == nil {
+			return fmt.Errorf("Signing key %s is not PEM encoded", entry.ID)
+		}
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		signer, ok := private.(crypto.Signer)
+		if ok == false {
+			return fmt.Errorf("Signing key %s can't sign", entry.ID)
+		}
+		keySet.keys = append(keySet.keys, &SigningKey{
+			ID:        entry.ID,
+			Algorithm: entry.Algorithm,
+			CreatedAt: entry.CreatedAt,
+			RetiredAt: entry.RetiredAt,
+			private:   signer,
+		})
+	}
+	return nil
+}
+
+func (keySet *KeySet) save() error {
+	if keySet.options.Path == "" {
+		return nil
+	}
+	stored := storedKeySet{LegacyCutoff: keySet.legacyCutoff, Keys: []storedKey{}}
+	for _, key := range keySet.keys {
+		der, err := x509.MarshalPKCS8PrivateKey(key.private)
+		if err != nil {
+			return err
+		}
+		stored.Keys = append(stored.Keys, storedKey{
+			ID:         key.ID,
+			Algorithm:  key.Algorithm,
+			CreatedAt:  key.CreatedAt,
+			RetiredAt:  key.RetiredAt,
+			PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		})
+	}
+	dataBytes, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(keySet.options.Path), 0700); err != nil {
+		return err
+	}
+	tmpPath := keySet.options.Path + ".tmp"
+	if err := os.WriteFile(tmpPath, dataBytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, keySet.options.Path)
+}
+
+// JWK is the public half of a signing key, see RFC 7517.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	ID        string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys tokens may currently be verified with.
+func (keySet *KeySet) JWKS() JWKSet {
+	keySet.mu.RLock()
+	defer keySet.mu.RUnlock()
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range keySet.keys {
+		if keySet.verifies(key) == false {
+			continue
+		}
+		jwk := JWK{Use: "sig", ID: key.ID, Algorithm: key.Algorithm}
+		switch public := key.private.Public().(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// ServeJWKS serves the JWKS document other services verify our tokens with.
+func (keySet *KeySet) ServeJWKS(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(keySet.JWKS())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(body)
+}
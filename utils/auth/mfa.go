@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/totp"
+)
+
+// VerifySecondFactor accepts either a TOTP code for now or one of the user's
+// recovery codes, and uses it up. It fails with utils.ErrMFACodeInvalid.
+func VerifySecondFactor(store utils.Store, userId int, code string, recoveryCode string, now time.Time) error {
+	if recoveryCode != "" {
+		return store.UseRecoveryCode(userId, recoveryCode)
+	}
+	mfa, err := store.GetMFA(userId)
+	if err != nil {
+		return err
+	}
+	if mfa.TOTPSecret == "" {
+		return utils.ErrMFACodeInvalid
+	}
+	step, ok := totp.Validate(mfa.TOTPSecret, code, now)
+	if ok == false {
+		return utils.ErrMFACodeInvalid
+	}
+	return store.UseTOTPStep(userId, step)
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+// Actions the policy grants to roles beyond what every user may do with
+// their own account.
+const (
+	ActionDeleteAnyChirp = "chirps:delete_any"
+	ActionSuspendUsers   = "users:suspend"
+	ActionUnlockUsers    = "users:unlock"
+	ActionManageRoles    = "users:manage_roles"
+	ActionViewMetrics    = "metrics:view"
+	ActionResetMetrics   = "metrics:reset"
+)
+
+// policy lists the actions each role may take. Plain users have none.
+var policy = map[string][]string{
+	types.RoleModerator: {ActionDeleteAnyChirp, ActionSuspendUsers, ActionUnlockUsers},
+	types.RoleAdmin: {ActionDeleteAnyChirp, ActionSuspendUsers, ActionUnlockUsers, ActionManageRoles,
+		ActionViewMetrics, ActionResetMetrics},
+}
+
+// Can reports whether role may take action.
+func Can(role string, action string) bool {
+	for _, allowed := range policy[role] {
+		if allowed == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether the principal may take action.
+func (principal Principal) Can(action string) bool {
+	return Can(principal.Role, action)
+}
+
+// CanDeleteChirp reports whether the principal may remove chirp: authors
+// their own chirps, moderators and admins anyone's.
+func (principal Principal) CanDeleteChirp(chirp types.Chirp) bool {
+	return (principal.UserId != 0 && chirp.AuthorId == principal.UserId) || principal.Can(ActionDeleteAnyChirp)
+}
+
+var roleRank = map[string]int{types.RoleUser: 1, types.RoleModerator: 2, types.RoleAdmin: 3}
+
+// Outranks reports whether role is more privileged than other. Actions
+// against another user, like suspending them, need the actor to outrank
+// them, so moderators can't suspend each other or admins.
+func Outranks(role string, other string) bool {
+	return roleRank[role] > roleRank[other]
+}
+
+// PermissionDenied is the response for a user whose role doesn't allow an
+// action.
+func PermissionDenied(w http.ResponseWriter) {
+	writeError(w, http.StatusForbidden, map[string]string{"error": "Forbidden"})
+}
+
+// RequirePermission only lets through requests carrying a valid access token
+// of an active user whose role may take action. The role is the one in
+// store, not the token, so demotions take effect straight away.
+func RequirePermission(keys *KeySet, store utils.Store, action string, next http.Handler) http.Handler {
+	return RequireAccessToken(keys, RequireActiveUser(store, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := PrincipalFromContext(r.Context())
+		if principal.Can(action) == false {
+			log.Printf("SECURITY: user %d with role %q was denied %s on %s %s",
+				principal.UserId, principal.Role, action, r.Method, r.URL.Path)
+			PermissionDenied(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})))
+}
+
+// RequireActiveUser wraps one of the Require middlewares and turns away
+// suspended users and users who are about to be deleted, whose access
+// tokens stay valid until they expire. Users acting for themselves get
+// their current role from store in place of the one in their token.
+func RequireActiveUser(store utils.Store, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := PrincipalFromContext(r.Context())
+		if ok == false || principal.UserId == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, err := store.GetUserByID(principal.UserId)
+		if err != nil {
+			Unauthorized(w)
+			return
+		}
+		if user.IsSuspended {
+			writeError(w, http.StatusForbidden, map[string]string{"error": ErrSuspended.Error()})
+			return
+		}
+		if user.DeletionScheduledAt.IsZero() == false {
+			writeError(w, http.StatusForbidden, map[string]string{"error": ErrDeletionScheduled.Error()})
+			return
+		}
+		// API tokens and OAuth clients keep the user role they were given.
+		if principal.IsDelegated() == false && principal.Role != user.Role {
+			principal.Role = user.Role
+			r = r.WithContext(WithPrincipal(r.Context(), principal))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var (
+	ErrSuspended            = errors.New("Account suspended")
+	ErrDeletionScheduled    = errors.New("Account is scheduled for deletion, log in to cancel")
+	ErrDelegatedCredentials = errors.New("Only the user can change their email or password")
+)
+
+// CheckCredentialChange fails with ErrDelegatedCredentials if the principal
+// sets a new email or password with a delegated credential. A leaked API
+// token or OAuth client token must not be enough to take the account over.
+func CheckCredentialChange(principal Principal, email string, password string) error {
+	if principal.IsDelegated() && (email != "" || password != "") {
+		return ErrDelegatedCredentials
+	}
+	return nil
+}
+
+// BootstrapAdmin makes the user with email the first admin. It does nothing
+// once there is any admin, so the setting can't be used to take over later,
+// or until the user has verified the address, so nobody can sign up with it
+// first. It reports whether a user was promoted.
+func BootstrapAdmin(store utils.Store, email string) (types.User, bool, error) {
+	if email == "" {
+		return types.User{}, false, nil
+	}
+	admins, err := store.ListUsersByRole(types.RoleAdmin)
+	if err != nil || len(admins) > 0 {
+		return types.User{}, false, err
+	}
+	user, err := store.GetUserByEmail(email)
+	if err != nil || user.IsEmailVerified == false {
+		return types.User{}, false, nil
+	}
+	promoted, err := store.SetRole(user.ID, types.RoleAdmin)
+	if err != nil {
+		return types.User{}, false, err
+	}
+	log.Printf("SECURITY: bootstrapped user %d as the first admin", promoted.ID)
+	return promoted, true, nil
+}
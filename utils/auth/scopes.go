@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+// Scopes an API token can be granted.
+const (
+	ScopeChirpsRead   = "chirps:read"
+	ScopeChirpsWrite  = "chirps:write"
+	ScopeProfileWrite = "profile:write"
+)
+
+// Scopes lists every scope, in the order they are documented.
+var Scopes = []string{ScopeChirpsRead, ScopeChirpsWrite, ScopeProfileWrite}
+
+// ValidScope reports whether scope is one of Scopes.
+func ValidScope(scope string) bool {
+	for _, known := range Scopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the principal may use a route needing scope.
+// The user's own access tokens act with their full authority; API tokens and
+// OAuth clients only with the scopes they were granted.
+func (principal Principal) HasScope(scope string) bool {
+	if principal.IsDelegated() == false {
+		return principal.UserId != 0
+	}
+	for _, granted := range principal.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Forbidden is the response for a valid credential that doesn't carry the
+// scope a route needs.
+func Forbidden(w http.ResponseWriter, scope string) {
+	writeError(w, http.StatusForbidden, map[string]string{"error": "Insufficient scope", "required_scope": scope})
+}
+
+// authenticateUser accepts a bearer access JWT or API token.
+func authenticateUser(r *http.Request, keys *KeySet, store utils.Store) (Principal, bool) {
+	token, err := GetBearerToken(r.Header)
+	if err != nil {
+		return Principal{}, false
+	}
+	if strings.HasPrefix(token, utils.ApiTokenMarker) {
+		apiToken, err := store.UseApiToken(token)
+		if err != nil {
+			return Principal{}, false
+		}
+		// API tokens never carry staff privileges, whoever minted them.
+		principal := Principal{UserId: apiToken.UserId, ApiTokenId: apiToken.ID, Scopes: apiToken.Scopes, Role: types.RoleUser}
+		return principal, true
+	}
+	principal, err := accessTokenPrincipal(token, keys)
+	if err != nil {
+		return Principal{}, false
+	}
+	return principal, true
+}
+
+// RequireScope only lets through requests carrying a valid access token, or
+// an API token granted scope.
+func RequireScope(keys *KeySet, store utils.Store, scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := authenticateUser(r, keys, store)
+		if ok == false {
+			Unauthorized(w)
+			return
+		}
+		if principal.HasScope(scope) == false {
+			Forbidden(w, scope)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// AllowScope is RequireScope for public routes: requests without an
+// Authorization header go through anonymously, but a credential that is sent
+// has to be valid and carry scope.
+func AllowScope(keys *KeySet, store utils.Store, scope string, next http.Handler) http.Handler {
+	required := RequireScope(keys, store, scope, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		required.ServeHTTP(w, r)
+	})
+}
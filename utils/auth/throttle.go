@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ThrottlePolicy decides how long a client has to wait after failing to log
+// in. The first FreeAttempts failures cost nothing. After that the wait
+// doubles from BaseDelay with every failure, up to MaxDelay. LockoutAfter
+// failures in a row lock the client out for LockoutFor; 0 never locks out.
+type ThrottlePolicy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	LockoutAfter int
+	LockoutFor   time.Duration
+}
+
+// wait returns how long after the last of failures the next attempt is
+// allowed, and whether that is a lockout.
+func (policy ThrottlePolicy) wait(failures int) (time.Duration, bool) {
+	if policy.LockoutAfter > 0 && failures >= policy.LockoutAfter {
+		return policy.LockoutFor, true
+	}
+	if failures <= policy.FreeAttempts {
+		return 0, false
+	}
+	delay := policy.BaseDelay
+	for i := policy.FreeAttempts + 1; i < failures && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	return delay, false
+}
+
+// forgetAfter is how long an entry has to sit idle before it no longer
+// affects anything.
+func (policy ThrottlePolicy) forgetAfter() time.Duration {
+	if policy.LockoutFor > policy.MaxDelay {
+		return policy.LockoutFor
+	}
+	return policy.MaxDelay
+}
+
+type LoginThrottleOptions struct {
+	// Account applies to failures against one email address, IP to
+	// failures from one address across every account.
+	Account ThrottlePolicy
+	IP      ThrottlePolicy
+	// Now is the clock, time.Now if nil.
+	Now func() time.Time
+}
+
+// DefaultLoginThrottleOptions allow a few typos, then slow guessing down and
+// lock an account after 10 failures in a row. IPs get more slack since many
+// users can share one.
+var DefaultLoginThrottleOptions = LoginThrottleOptions{
+	Account: ThrottlePolicy{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: 5 * time.Minute, LockoutAfter: 10, LockoutFor: 30 * time.Minute},
+	IP:      ThrottlePolicy{FreeAttempts: 20, BaseDelay: time.Second, MaxDelay: 15 * time.Minute},
+}
+
+type failures struct {
+	count int
+	last  time.Time
+	// inFlight counts attempts Check let through that have not been
+	// settled yet, reserved the time of the latest of them.
+	inFlight int
+	reserved time.Time
+}
+
+// pending returns how many failures to throttle on and when the latest
+// happened, counting every attempt still in flight as a failure from when it
+// was let through. Otherwise parallel guesses would all pass Check before
+// the first of them is recorded.
+func (recorded failures) pending() (int, time.Time) {
+	if recorded.inFlight == 0 || recorded.reserved.Before(recorded.last) {
+		return recorded.count + recorded.inFlight, recorded.last
+	}
+	return recorded.count + recorded.inFlight, recorded.reserved
+}
+
+// LoginThrottle tracks failed logins per account and per IP in memory.
+type LoginThrottle struct {
+	options  LoginThrottleOptions
+	mu       sync.Mutex
+	accounts map[string]failures
+	ips      map[string]failures
+}
+
+// maxThrottleEntries bounds each map before idle entries are swept out.
+const maxThrottleEntries = 10000
+
+func NewLoginThrottle(options LoginThrottleOptions) *LoginThrottle {
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	return &LoginThrottle{options: options, accounts: map[string]failures{}, ips: map[string]failures{}}
+}
+
+// normalizeAccount makes "User@Example.com " and "user@example.com" share
+// one entry.
+func normalizeAccount(account string) string {
+	return strings.ToLower(strings.TrimSpace(account))
+}
+
+// Check returns how long the client has to wait before it may try to log in
+// to account again. When it returns 0 it has reserved the attempt, which
+// the caller has to settle with Fail, Succeed or Release once the
+// credentials have been checked.
+func (throttle *LoginThrottle) Check(account string, ip string) time.Duration {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	now := throttle.options.Now()
+	account = normalizeAccount(account)
+	retryAfter := time.Duration(0)
+	for _, entry := range []struct {
+		policy  ThrottlePolicy
+		entries map[string]failures
+		key     string
+	}{
+		{throttle.options.Account, throttle.accounts, account},
+		{throttle.options.IP, throttle.ips, ip},
+	} {
+		recorded, ok := entry.entries[entry.key]
+		if ok == false {
+			continue
+		}
+		count, last := recorded.pending()
+		wait, _ := entry.policy.wait(count)
+		if remaining := last.Add(wait).Sub(now); remaining > retryAfter {
+			retryAfter = remaining
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	throttle.reserve(throttle.accounts, account, now)
+	throttle.reserve(throttle.ips, ip, now)
+	return 0
+}
+
+func (throttle *LoginThrottle) reserve(entries map[string]failures, key string, now time.Time) {
+	recorded := entries[key]
+	recorded.inFlight++
+	recorded.reserved = now
+	entries[key] = recorded
+}
+
+// settle ends an attempt reserved by Check. Entries left with nothing to
+// remember are dropped.
+func (throttle *LoginThrottle) settle(entries map[string]failures, key string) {
+	recorded, ok := entries[key]
+	if ok == false || recorded.inFlight == 0 {
+		return
+	}
+	recorded.inFlight--
+	if recorded.inFlight == 0 && recorded.count == 0 {
+		delete(entries, key)
+		return
+	}
+	entries[key] = recorded
+}
+
+// Fail records a failed login to account from ip.
+func (throttle *LoginThrottle) Fail(account string, ip string) {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	now := throttle.options.Now()
+	account = normalizeAccount(account)
+	throttle.settle(throttle.accounts, account)
+	throttle.settle(throttle.ips, ip)
+	recorded := throttle.record(throttle.accounts, throttle.options.Account, account, now)
+	if _, locked := throttle.options.Account.wait(recorded.count); locked && recorded.count == throttle.options.Account.LockoutAfter {
+		log.Printf("SECURITY: locked logins to %q for %s after %d failed attempts, the last from %s",
+			account, throttle.options.Account.LockoutFor, recorded.count, ip)
+	}
+	throttle.record(throttle.ips, throttle.options.IP, ip, now)
+}
+
+func (throttle *LoginThrottle) record(entries map[string]failures, policy ThrottlePolicy, key string, now time.Time) failures {
+	recorded := entries[key]
+	if recorded.count > 0 && now.Sub(recorded.last) > policy.forgetAfter() {
+		recorded.count = 0
+	}
+	recorded.count++
+	recorded.last = now
+	entries[key] = recorded
+	if len(entries) > maxThrottleEntries {
+		for key, idle := range entries {
+			if idle.inFlight == 0 && now.Sub(idle.last) > policy.forgetAfter() {
+				delete(entries, key)
+			}
+		}
+	}
+	return recorded
+}
+
+// Succeed settles an attempt reserved by Check that logged in, clearing the
+// failures against account. Failures from the IP are kept, so one valid
+// account does not let an attacker keep guessing at others.
+func (throttle *LoginThrottle) Succeed(account string, ip string) {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	account = normalizeAccount(account)
+	throttle.settle(throttle.ips, ip)
+	throttle.settle(throttle.accounts, account)
+	throttle.clear(account)
+}
+
+// Release settles an attempt reserved by Check that ended before the
+// credentials were judged, leaving the failures as they were.
+func (throttle *LoginThrottle) Release(account string, ip string) {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	throttle.settle(throttle.accounts, normalizeAccount(account))
+	throttle.settle(throttle.ips, ip)
+}
+
+// Unlock clears the failures against account, lifting any lockout.
+func (throttle *LoginThrottle) Unlock(account string) {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	throttle.clear(normalizeAccount(account))
+}
+
+// clear forgets the failures against account but not the attempts on it
+// still in flight.
+func (throttle *LoginThrottle) clear(account string) {
+	recorded, ok := throttle.accounts[account]
+	if ok == false {
+		return
+	}
+	if recorded.inFlight == 0 {
+		delete(throttle.accounts, account)
+		return
+	}
+	throttle.accounts[account] = failures{inFlight: recorded.inFlight, reserved: recorded.reserved}
+}
@@ -0,0 +1,185 @@
+// Package avatar checks uploaded profile pictures and keeps them on disk as
+// square PNG thumbnails.
+package avatar
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// MaxUploadBytes bounds the size of an uploaded image, MaxDimension its
+// width and height, so small files can't decode into huge images.
+const (
+	MaxUploadBytes = 2 << 20
+	MaxDimension   = 4096
+)
+
+// Sizes are the edges, in pixels, of the thumbnails kept for every avatar.
+var Sizes = []int{64, 256}
+
+var (
+	ErrTooLarge        = errors.New("Avatars can be at most 2 MB and 4096x4096 pixels")
+	ErrUnsupportedType = errors.New("Avatars must be PNG, JPEG or GIF images")
+	ErrInvalidImage    = errors.New("Unable to read the image")
+)
+
+// contentTypes are the image types accepted, as sniffed from the upload
+// rather than taken from the client.
+var contentTypes = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true}
+
+// Decode reads an uploaded image, checking its size and type before decoding
+// the pixels.
+func Decode(r io.Reader) (image.Image, error) {
+	limited := bufio.NewReader(io.LimitReader(r, MaxUploadBytes+1))
+	head, _ := limited.Peek(512)
+	if contentTypes[http.DetectContentType(head)] == false {
+		return nil, ErrUnsupportedType
+	}
+	data, err := io.ReadAll(limited)
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if len(data) > MaxUploadBytes {
+		return nil, ErrTooLarge
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if config.Width > MaxDimension || config.Height > MaxDimension {
+		return nil, ErrTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	return img, nil
+}
+
+// Thumbnail crops the middle square out of img and scales it to size by
+// averaging the source pixels that fall into each target pixel.
+func Thumbnail(img image.Image, size int) *image.NRGBA {
+	bounds := img.Bounds()
+	edge := min(bounds.Dx(), bounds.Dy())
+	left := bounds.Min.X + (bounds.Dx()-edge)/2
+	top := bounds.Min.Y + (bounds.Dy()-edge)/2
+	thumbnail := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0, y1 := top+y*edge/size, top+(y+1)*edge/size
+		y1 = max(y1, y0+1)
+		for x := 0; x < size; x++ {
+			x0, x1 := left+x*edge/size, left+(x+1)*edge/size
+			x1 = max(x1, x0+1)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			offset := thumbnail.PixOffset(x, y)
+			alpha := a / n
+			thumbnail.Pix[offset+3] = uint8(alpha >> 8)
+			// RGBA returns premultiplied values, NRGBA stores them
+			// without.
+			if alpha > 0 {
+				thumbnail.Pix[offset] = uint8(r * 0xffff / a >> 8)
+				thumbnail.Pix[offset+1] = uint8(g * 0xffff / a >> 8)
+				thumbnail.Pix[offset+2] = uint8(b * 0xffff / a >> 8)
+			}
+		}
+	}
+	return thumbnail
+}
+
+// Avatars keeps thumbnails in Dir, served from URLPrefix.
+type Avatars struct {
+	Dir       string
+	URLPrefix string
+}
+
+// Save writes the thumbnails of img and returns the key naming them. Every
+// upload gets a new key, so cached thumbnails of the previous one never
+// stand in for it.
+func (avatars Avatars) Save(userId int, img image.Image) (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	key := strconv.Itoa(userId) + "-" + hex.EncodeToString(random)
+	if err := os.MkdirAll(avatars.Dir, 0755); err != nil {
+		return "", err
+	}
+	for _, size := range Sizes {
+		if err := writePNG(avatars.path(key, size), Thumbnail(img, size)); err != nil {
+			avatars.Remove(key)
+			return "", err
+		}
+	}
+	return key, nil
+}
+
+func writePNG(path string, img image.Image) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "avatar-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// Remove deletes the thumbnails of key. Removing an empty key does nothing.
+func (avatars Avatars) Remove(key string) error {
+	if key == "" {
+		return nil
+	}
+	for _, size := range Sizes {
+		if err := os.Remove(avatars.path(key, size)); err != nil && errors.Is(err, os.ErrNotExist) == false {
+			return err
+		}
+	}
+	return nil
+}
+
+func (avatars Avatars) path(key string, size int) string {
+	return filepath.Join(avatars.Dir, fileName(key, size))
+}
+
+func fileName(key string, size int) string {
+	return key + "-" + strconv.Itoa(size) + ".png"
+}
+
+// URLs maps each thumbnail size of key to where it is served, nil without
+// an avatar.
+func (avatars Avatars) URLs(key string) map[string]string {
+	if key == "" {
+		return nil
+	}
+	urls := map[string]string{}
+	for _, size := range Sizes {
+		urls[strconv.Itoa(size)] = avatars.URLPrefix + fileName(key, size)
+	}
+	return urls
+}
@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+var (
+	ErrInvalidEmail = errors.New("Invalid email address")
+	ErrEmailTaken   = errors.New("Email address is already in use")
+)
+
+// NormalizeEmail checks that email is a bare address, without a display name
+// or angle brackets, and lowercases it so each address has one spelling.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || strings.Contains(email[strings.LastIndex(email, "@"):], ".") == false {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
+
+// lookupEmail normalizes an email that is only looked up, not stored, so
+// malformed input simply finds nobody.
+func lookupEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
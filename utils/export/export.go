@@ -0,0 +1,336 @@
+// Package export builds archives of everything Chirpy stores about a user, for
+// users who ask for a copy of their data.
+package export
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+// DefaultTTL is how long an archive can be downloaded once requested.
+const DefaultTTL = 48 * time.Hour
+
+// Exporter builds archives from Store into Dir, one <id>.zip per export.
+type Exporter struct {
+	Store utils.Store
+	Dir   string
+	TTL   time.Duration
+}
+
+func (exporter Exporter) ttl() time.Duration {
+	if exporter.TTL <= 0 {
+		return DefaultTTL
+	}
+	return exporter.TTL
+}
+
+// Path is where the archive of export id is kept.
+func (exporter Exporter) Path(id int) string {
+	return filepath.Join(exporter.Dir, strconv.Itoa(id)+".zip")
+}
+
+// Start records a new export and builds its archive in the background. A
+// user whose previous export is still being built gets that one back.
+func (exporter Exporter) Start(userId int, now time.Time) (types.DataExport, error) {
+	exports, err := exporter.Store.ListDataExports(userId)
+	if err != nil {
+		return types.DataExport{}, err
+	}
+	for _, export := range exports {
+		if export.Status == types.ExportPending && export.ExpiresAt.After(now) {
+			return export, nil
+		}
+	}
+	export, err := exporter.Store.CreateDataExport(userId, now.Add(exporter.ttl()))
+	if err != nil {
+		return types.DataExport{}, err
+	}
+	go exporter.Build(export)
+	return export, nil
+}
+
+// Build writes the archive of export and marks it ready, or failed.
+func (exporter Exporter) Build(export types.DataExport) (types.DataExport, error) {
+	size, err := exporter.writeArchive(export)
+	if err != nil {
+		log.Printf("Unable to build data export %d of user %d: %s", export.ID, export.UserId, err)
+		if _, completeErr := exporter.Store.CompleteDataExport(export.ID, types.ExportFailed, 0); completeErr != nil {
+			log.Print(completeErr.Error())
+		}
+		return types.DataExport{}, err
+	}
+	return exporter.Store.CompleteDataExport(export.ID, types.ExportReady, size)
+}
+
+// writeArchive writes the archive next to its final path first, so a
+// half-written archive is never served.
+func (exporter Exporter) writeArchive(export types.DataExport) (int64, error) {
+	if err := os.MkdirAll(exporter.Dir, 0700); err != nil {
+		return 0, err
+	}
+	file, err := os.CreateTemp(exporter.Dir, "export-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	if err := Archive(exporter.Store, export.UserId, file, time.Now().UTC()); err != nil {
+		file.Close()
+		return 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+	return info.Size(), os.Rename(file.Name(), exporter.Path(export.ID))
+}
+
+// Open returns the archive of a ready export.
+func (exporter Exporter) Open(export types.DataExport) (*os.File, error) {
+	if export.Status != types.ExportReady {
+		return nil, utils.ErrDataExportNotFound
+	}
+	return os.Open(exporter.Path(export.ID))
+}
+
+// Purge deletes expired exports and their archives, as well as archives
+// whose export is gone, such as those of deleted users.
+func (exporter Exporter) Purge(now time.Time) error {
+	expired, err := exporter.Store.DeleteExpiredDataExports(now)
+	if err != nil {
+		return err
+	}
+	for _, export := range expired {
+		if err := os.Remove(exporter.Path(export.ID)); err != nil && errors.Is(err, os.ErrNotExist) == false {
+			return err
+		}
+	}
+	entries, err := os.ReadDir(exporter.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		idStr, isArchive := strings.CutSuffix(entry.Name(), ".zip")
+		id, err := strconv.Atoi(idStr)
+		if isArchive == false || err != nil {
+			continue
+		}
+		if _, err := exporter.Store.GetDataExport(id); errors.Is(err, utils.ErrDataExportNotFound) {
+			if err := os.Remove(exporter.Path(id)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Run purges expired exports every interval until stop is closed.
+func (exporter Exporter) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := exporter.Purge(time.Now().UTC()); err != nil {
+			log.Printf("Unable to purge data exports: %s", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Profile is the part of a types.User that is the user's own data, leaving
+// out credentials.
+type Profile struct {
+	ID                  int       `json:"id"`
+	Email               string    `json:"email"`
+	IsEmailVerified     bool      `json:"is_email_verified"`
+	IsChirpyRed         bool      `json:"is_chirpy_red"`
+	Role                string    `json:"role"`
+	IsSuspended         bool      `json:"is_suspended"`
+	DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
+	TOTPEnabled         bool      `json:"totp_enabled"`
+	types.Profile
+}
+
+type ApiToken struct {
+	ID         int       `json:"id"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type OAuthClient struct {
+	ClientId     string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Event is something that happened to the account. There is no separate
+// audit log; events are pieced together from the timestamps the store
+// keeps on sessions, tokens, clients and exports.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Detail string    `json:"detail"`
+}
+
+// Document is the content of data.json in an archive.
+type Document struct {
+	ExportedAt   time.Time       `json:"exported_at"`
+	Profile      Profile         `json:"profile"`
+	Chirps       []types.Chirp   `json:"chirps"`
+	Sessions     []types.Session `json:"sessions"`
+	ApiTokens    []ApiToken      `json:"api_tokens"`
+	OAuthClients []OAuthClient   `json:"oauth_clients"`
+	Events       []Event         `json:"events"`
+}
+
+// Collect gathers everything store holds about userId.
+func Collect(store utils.Store, userId int, now time.Time) (Document, error) {
+	user, err := store.GetUserByID(userId)
+	if err != nil {
+		return Document{}, err
+	}
+	mfa, err := store.GetMFA(userId)
+	if err != nil {
+		return Document{}, err
+	}
+	document := Document{
+		ExportedAt: now,
+		Profile: Profile{ID: user.ID, Email: user.Email, IsEmailVerified: user.IsEmailVerified, IsChirpyRed: user.IsChirpyRed,
+			Role: user.Role, IsSuspended: user.IsSuspended, DeletionScheduledAt: user.DeletionScheduledAt, TOTPEnabled: mfa.TOTPEnabled,
+			Profile: user.Profile},
+		Chirps:       []types.Chirp{},
+		ApiTokens:    []ApiToken{},
+		OAuthClients: []OAuthClient{},
+		Events:       []Event{},
+	}
+	query := types.ChirpQuery{AuthorId: userId, Limit: utils.MaxChirpLimit}
+	for {
+		page, err := store.ListChirps(query)
+		if err != nil {
+			return Document{}, err
+		}
+		document.Chirps = append(document.Chirps, page.Chirps...)
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	if document.Sessions, err = store.ListSessions(userId); err != nil {
+		return Document{}, err
+	}
+	for _, session := range document.Sessions {
+		if session.ClientId != "" {
+			document.Events = append(document.Events, Event{session.CreatedAt, "oauth_client_authorized", session.ClientId})
+			continue
+		}
+		document.Events = append(document.Events, Event{session.CreatedAt, "logged_in", session.DeviceLabel})
+	}
+	tokens, err := store.ListApiTokens(userId)
+	if err != nil {
+		return Document{}, err
+	}
+	for _, token := range tokens {
+		document.ApiTokens = append(document.ApiTokens, ApiToken{ID: token.ID, Name: token.Name, Scopes: token.Scopes,
+			CreatedAt: token.CreatedAt, LastUsedAt: token.LastUsedAt, ExpiresAt: token.ExpiresAt})
+		document.Events = append(document.Events, Event{token.CreatedAt, "api_token_created", token.Name})
+	}
+	clients, err := store.ListOAuthClients(userId)
+	if err != nil {
+		return Document{}, err
+	}
+	for _, client := range clients {
+		document.OAuthClients = append(document.OAuthClients, OAuthClient{ClientId: client.ClientId, Name: client.Name,
+			RedirectURIs: client.RedirectURIs, CreatedAt: client.CreatedAt})
+		document.Events = append(document.Events, Event{client.CreatedAt, "oauth_client_registered", client.Name})
+	}
+	exports, err := store.ListDataExports(userId)
+	if err != nil {
+		return Document{}, err
+	}
+	for _, export := range exports {
+		document.Events = append(document.Events, Event{export.CreatedAt, "data_export_requested", strconv.Itoa(export.ID)})
+	}
+	sort.SliceStable(document.Events, func(i, j int) bool {
+		return document.Events[i].Time.Before(document.Events[j].Time)
+	})
+	return document, nil
+}
+
+// Archive writes a zip of everything store holds about userId to w: all of
+// it in data.json, and the lists in CSV files as well.
+func Archive(store utils.Store, userId int, w io.Writer, now time.Time) error {
+	document, err := Collect(store, userId, now)
+	if err != nil {
+		return err
+	}
+	archive := zip.NewWriter(w)
+	data, err := archive.Create("data.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(data)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		return err
+	}
+	chirps := [][]string{{"id", "body"}}
+	for _, chirp := range document.Chirps {
+		chirps = append(chirps, []string{strconv.Itoa(chirp.ID), chirp.Body})
+	}
+	sessions := [][]string{{"id", "device_label", "user_agent", "ip", "created_at", "last_used_at", "client_id"}}
+	for _, session := range document.Sessions {
+		sessions = append(sessions, []string{strconv.Itoa(session.ID), session.DeviceLabel, session.UserAgent, session.IP,
+			formatTime(session.CreatedAt), formatTime(session.LastUsedAt), session.ClientId})
+	}
+	events := [][]string{{"time", "event", "detail"}}
+	for _, event := range document.Events {
+		events = append(events, []string{formatTime(event.Time), event.Event, event.Detail})
+	}
+	tables := []struct {
+		name    string
+		records [][]string
+	}{{"chirps.csv", chirps}, {"sessions.csv", sessions}, {"events.csv", events}}
+	for _, table := range tables {
+		file, err := archive.Create(table.name)
+		if err != nil {
+			return err
+		}
+		if err := csv.NewWriter(file).WriteAll(table.records); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,238 @@
+package utils
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+// sortedIDs is a set of record IDs kept in ascending order. IDs are handed
+// out monotonically, so inserting a new record is an append.
+type sortedIDs []int
+
+func (ids sortedIDs) insert(id int) sortedIDs {
+	i := sort.SearchInts(ids, id)
+	if i < len(ids) && ids[i] == id {
+		return ids
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
+
+func (ids sortedIDs) remove(id int) sortedIDs {
+	i := sort.SearchInts(ids, id)
+	if i == len(ids) || ids[i] != id {
+		return ids
+	}
+	return append(ids[:i], ids[i+1:]...)
+}
+
+// page returns up to limit IDs that come after the ID after, walking down
+// from the highest ID when descending. An after of 0 starts at the
+// beginning. The second result reports whether more IDs follow the page.
+func (ids sortedIDs) page(after int, descending bool, limit int) ([]int, bool) {
+	result := []int{}
+	if descending {
+		end := len(ids)
+		if after > 0 {
+			end = sort.SearchInts(ids, after)
+		}
+		for i := end - 1; i >= 0 && len(result) < limit; i-- {
+			result = append(result, ids[i])
+		}
+		return result, end-len(result) > 0
+	}
+	start := 0
+	if after > 0 {
+		start = sort.SearchInts(ids, after+1)
+	}
+	for i := start; i < len(ids) && len(result) < limit; i++ {
+		result = append(result, ids[i])
+	}
+	return result, start+len(result) < len(ids)
+}
+
+// index maps a lookup key to the IDs of the records carrying it.
+type index[K comparable] map[K]sortedIDs
+
+func (idx index[K]) add(key K, id int) {
+	idx[key] = idx[key].insert(id)
+}
+
+func (idx index[K]) remove(key K, id int) {
+	idx[key] = idx[key].remove(id)
+	if len(idx[key]) == 0 {
+		delete(idx, key)
+	}
+}
+
+// first returns the lowest ID stored under key.
+func (idx index[K]) first(key K) (int, bool) {
+	if len(idx[key]) == 0 {
+		return 0, false
+	}
+	return idx[key][0], true
+}
+
+// dbIndexes are the secondary indexes DataBaseClient keeps over its resident
+// copy of the database.
+type dbIndexes struct {
+	chirpIDs               sortedIDs
+	usersByEmail           index[string]
+	usersByHandle          index[string]
+	refreshTokensByPrefix  index[string]
+	refreshTokensByFamily  index[int]
+	refreshTokensByUser    index[int]
+	chirpsByAuthor         index[int]
+	oneTimeTokensByPrefix  index[string]
+	oneTimeTokensByUser    index[int]
+	apiTokensByPrefix      index[string]
+	apiTokensByUser        index[int]
+	oauthClientsByClientId index[string]
+	oauthClientsByOwner    index[int]
+	dataExportsByUser      index[int]
+}
+
+func buildIndexes(data *types.Database) dbIndexes {
+	indexes := dbIndexes{
+		usersByEmail:           index[string]{},
+		usersByHandle:          index[string]{},
+		refreshTokensByPrefix:  index[string]{},
+		refreshTokensByFamily:  index[int]{},
+		refreshTokensByUser:    index[int]{},
+		chirpsByAuthor:         index[int]{},
+		oneTimeTokensByPrefix:  index[string]{},
+		oneTimeTokensByUser:    index[int]{},
+		apiTokensByPrefix:      index[string]{},
+		apiTokensByUser:        index[int]{},
+		oauthClientsByClientId: index[string]{},
+		oauthClientsByOwner:    index[int]{},
+		dataExportsByUser:      index[int]{},
+	}
+	for id, chirp := range data.Chirps {
+		indexes.chirpIDs = indexes.chirpIDs.insert(id)
+		indexes.chirpsByAuthor.add(chirp.AuthorId, id)
+	}
+	for id, user := range data.Users {
+		indexes.usersByEmail.add(user.Email, id)
+		if user.Handle != "" {
+			indexes.usersByHandle.add(user.Handle, id)
+		}
+	}
+	for id, token := range data.RefreshTokens {
+		indexes.refreshTokensByPrefix.add(token.TokenPrefix, id)
+		indexes.refreshTokensByFamily.add(token.FamilyId, id)
+		indexes.refreshTokensByUser.add(token.UserId, id)
+	}
+	for id, token := range data.OneTimeTokens {
+		indexes.oneTimeTokensByPrefix.add(token.TokenPrefix, id)
+		indexes.oneTimeTokensByUser.add(token.UserId, id)
+	}
+	for id, token := range data.ApiTokens {
+		indexes.apiTokensByPrefix.add(token.TokenPrefix, id)
+		indexes.apiTokensByUser.add(token.UserId, id)
+	}
+	for id, client := range data.OAuthClients {
+		indexes.oauthClientsByClientId.add(client.ClientId, id)
+		indexes.oauthClientsByOwner.add(client.OwnerId, id)
+	}
+	for id, export := range data.DataExports {
+		indexes.dataExportsByUser.add(export.UserId, id)
+	}
+	return indexes
+}
+
+// update moves the index entries of every record touched by record from
+// their value in before to their value in after.
+func (indexes *dbIndexes) update(before *types.Database, after *types.Database, record walRecord) {
+	for _, id := range changedIDs(record, types.ChirpsCollection) {
+		if chirp, ok := before.Chirps[id]; ok {
+			indexes.chirpIDs = indexes.chirpIDs.remove(id)
+			indexes.chirpsByAuthor.remove(chirp.AuthorId, id)
+		}
+		if chirp, ok := after.Chirps[id]; ok {
+			indexes.chirpIDs = indexes.chirpIDs.insert(id)
+			indexes.chirpsByAuthor.add(chirp.AuthorId, id)
+		}
+	}
+	for _, id := range changedIDs(record, types.UsersCollection) {
+		if user, ok := before.Users[id]; ok {
+			indexes.usersByEmail.remove(user.Email, id)
+			indexes.usersByHandle.remove(user.Handle, id)
+		}
+		if user, ok := after.Users[id]; ok {
+			indexes.usersByEmail.add(user.Email, id)
+			if user.Handle != "" {
+				indexes.usersByHandle.add(user.Handle, id)
+			}
+		}
+	}
+	for _, id := range changedIDs(record, types.RefreshTokensCollection) {
+		if token, ok := before.RefreshTokens[id]; ok {
+			indexes.refreshTokensByPrefix.remove(token.TokenPrefix, id)
+			indexes.refreshTokensByFamily.remove(token.FamilyId, id)
+			indexes.refreshTokensByUser.remove(token.UserId, id)
+		}
+		if token, ok := after.RefreshTokens[id]; ok {
+			indexes.refreshTokensByPrefix.add(token.TokenPrefix, id)
+			indexes.refreshTokensByFamily.add(token.FamilyId, id)
+			indexes.refreshTokensByUser.add(token.UserId, id)
+		}
+	}
+	for _, id := range changedIDs(record, types.OneTimeTokensCollection) {
+		if token, ok := before.OneTimeTokens[id]; ok {
+			indexes.oneTimeTokensByPrefix.remove(token.TokenPrefix, id)
+			indexes.oneTimeTokensByUser.remove(token.UserId, id)
+		}
+		if token, ok := after.OneTimeTokens[id]; ok {
+			indexes.oneTimeTokensByPrefix.add(token.TokenPrefix, id)
+			indexes.oneTimeTokensByUser.add(token.UserId, id)
+		}
+	}
+	for _, id := range changedIDs(record, types.ApiTokensCollection) {
+		if token, ok := before.ApiTokens[id]; ok {
+			indexes.apiTokensByPrefix.remove(token.TokenPrefix, id)
+			indexes.apiTokensByUser.remove(token.UserId, id)
+		}
+		if token, ok := after.ApiTokens[id]; ok {
+			indexes.apiTokensByPrefix.add(token.TokenPrefix, id)
+			indexes.apiTokensByUser.add(token.UserId, id)
+		}
+	}
+	for _, id := range changedIDs(record, types.OAuthClientsCollection) {
+		if client, ok := before.OAuthClients[id]; ok {
+			indexes.oauthClientsByClientId.remove(client.ClientId, id)
+			indexes.oauthClientsByOwner.remove(client.OwnerId, id)
+		}
+		if client, ok := after.OAuthClients[id]; ok {
+			indexes.oauthClientsByClientId.add(client.ClientId, id)
+			indexes.oauthClientsByOwner.add(client.OwnerId, id)
+		}
+	}
+	for _, id := range changedIDs(record, types.DataExportsCollection) {
+		if export, ok := before.DataExports[id]; ok {
+			indexes.dataExportsByUser.remove(export.UserId, id)
+		}
+		if export, ok := after.DataExports[id]; ok {
+			indexes.dataExportsByUser.add(export.UserId, id)
+		}
+	}
+}
+
+func changedIDs(record walRecord, collection string) []int {
+	ids := []int{}
+	for key := range record.Set[collection] {
+		if id, err := strconv.Atoi(key); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	for _, key := range record.Delete[collection] {
+		if id, err := strconv.Atoi(key); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
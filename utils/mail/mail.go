@@ -0,0 +1,77 @@
+// Package mail sends the emails Chirpy sends to its users.
+package mail
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(message Message) error
+}
+
+// SMTPMailer delivers messages through an SMTP relay.
+type SMTPMailer struct {
+	// Addr is the relay's host:port.
+	Addr string
+	From string
+	// Username and Password authenticate with PLAIN auth if set.
+	Username string
+	Password string
+}
+
+func (mailer SMTPMailer) Send(message Message) error {
+	var auth smtp.Auth
+	if mailer.Username != "" {
+		host, _, _ := strings.Cut(mailer.Addr, ":")
+		auth = smtp.PlainAuth("", mailer.Username, mailer.Password, host)
+	}
+	return smtp.SendMail(mailer.Addr, auth, mailer.From, []string{message.To}, format(mailer.From, message))
+}
+
+func format(from string, message Message) []byte {
+	headers := []string{
+		"From: " + from,
+		"To: " + message.To,
+		"Subject: " + message.Subject,
+		"Date: " + time.Now().UTC().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + strings.ReplaceAll(message.Body, "\n", "\r\n"))
+}
+
+// FileMailer is for local development: instead of sending messages it
+// appends them to the file at Path, or logs them if Path is empty.
+type FileMailer struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (mailer *FileMailer) Send(message Message) error {
+	formatted := string(format("chirpy", message))
+	if mailer.Path == "" {
+		log.Printf("Not sending email:\n%s", formatted)
+		return nil
+	}
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+	file, err := os.OpenFile(mailer.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "%s\r\n\r\n", formatted)
+	return err
+}
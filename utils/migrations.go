@@ -0,0 +1,377 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+// Migration upgrades a database file from Version-1 to Version.
+type Migration struct {
+	Version     int
+	Description string
+	up          func(doc document) error
+}
+
+// migrations must stay sorted by Version, with no gaps. Add new schema
+// changes by appending a migration; never edit one that has shipped.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Add refresh token collection and per-collection ID sequences",
+		up: func(doc document) error {
+			collections := []string{types.ChirpsCollection, types.UsersCollection, types.RefreshTokensCollection}
+			for _, collection := range collections {
+				if _, ok := asObject(doc[collection]); ok == false {
+					doc[collection] = json.RawMessage("{}")
+				}
+			}
+			sequences := map[string]int{}
+			if existing, ok := asObject(doc["sequences"]); ok {
+				for collection, raw := range existing {
+					value := 0
+					json.Unmarshal(raw, &value)
+					sequences[collection] = value
+				}
+			}
+			for _, collection := range collections {
+				records, _ := asObject(doc[collection])
+				for key := range records {
+					if id, err := strconv.Atoi(key); err == nil && id > sequences[collection] {
+						sequences[collection] = id
+					}
+				}
+			}
+			return setField(doc, "sequences", sequences)
+		},
+	},
+	{
+		Version:     2,
+		Description: "Record an author on every chirp",
+		up: func(doc document) error {
+			// Chirps written before authorship was tracked have no known
+			// author and are attributed to the placeholder user 0.
+			chirps, _ := asObject(doc[types.ChirpsCollection])
+			for id, raw := range chirps {
+				chirp, ok := asObject(raw)
+				if ok == false {
+					return fmt.Errorf("Chirp %s is not an object", id)
+				}
+				if _, ok := chirp["author_id"]; ok == false {
+					chirp["author_id"] = json.RawMessage("0")
+				}
+				encoded, err := json.Marshal(chirp)
+				if err != nil {
+					return err
+				}
+				chirps[id] = encoded
+			}
+			return setField(doc, types.ChirpsCollection, chirps)
+		},
+	},
+	{
+		Version:     3,
+		Description: "Group refresh tokens into rotation families",
+		up: func(doc document) error {
+			// Tokens issued before rotation each start their own family.
+			tokens, _ := asObject(doc[types.RefreshTokensCollection])
+			for id, raw := range tokens {
+				token, ok := asObject(raw)
+				if ok == false {
+					return fmt.Errorf("Refresh token %s is not an object", id)
+				}
+				if _, ok := token["family_id"]; ok == false {
+					token["family_id"] = json.RawMessage(id)
+				}
+				encoded, err := json.Marshal(token)
+				if err != nil {
+					return err
+				}
+				tokens[id] = encoded
+			}
+			return setField(doc, types.RefreshTokensCollection, tokens)
+		},
+	},
+	{
+		Version:     4,
+		Description: "Store refresh tokens as keyed hashes",
+		up: func(doc document) error {
+			tokens, _ := asObject(doc[types.RefreshTokensCollection])
+			for id, raw := range tokens {
+				token, ok := asObject(raw)
+				if ok == false {
+					return fmt.Errorf("Refresh token %s is not an object", id)
+				}
+				plaintext := ""
+				if err := json.Unmarshal(token["token"], &plaintext); err != nil {
+					return fmt.Errorf("Refresh token %s has no token", id)
+				}
+				delete(token, "token")
+				if err := setField(token, "token_prefix", tokenPrefix(plaintext)); err != nil {
+					return err
+				}
+				if err := setField(token, "token_hash", hashToken(plaintext)); err != nil {
+					return err
+				}
+				encoded, err := json.Marshal(token)
+				if err != nil {
+					return err
+				}
+				tokens[id] = encoded
+			}
+			return setField(doc, types.RefreshTokensCollection, tokens)
+		},
+	},
+	{
+		Version:     5,
+		Description: "Add one-time token collection",
+		up: func(doc document) error {
+			if _, ok := asObject(doc[types.OneTimeTokensCollection]); ok == false {
+				doc[types.OneTimeTokensCollection] = json.RawMessage("{}")
+			}
+			return nil
+		},
+	},
+	{
+		Version:     6,
+		Description: "Normalize emails and mark existing users verified",
+		up: func(doc document) error {
+			// Verification only applies to signups from here on; existing
+			// accounts are not locked out retroactively.
+			users, _ := asObject(doc[types.UsersCollection])
+			if err := checkEmailCollisions(users); err != nil {
+				return err
+			}
+			for id, raw := range users {
+				user, ok := asObject(raw)
+				if ok == false {
+					return fmt.Errorf("User %s is not an object", id)
+				}
+				email := ""
+				json.Unmarshal(user["email"], &email)
+				if err := setField(user, "email", lookupEmail(email)); err != nil {
+					return err
+				}
+				user["is_email_verified"] = json.RawMessage("true")
+				encoded, err := json.Marshal(user)
+				if err != nil {
+					return err
+				}
+				users[id] = encoded
+			}
+			return setField(doc, types.UsersCollection, users)
+		},
+	},
+	{
+		Version:     7,
+		Description: "Add two-factor authentication collection",
+		up: func(doc document) error {
+			if _, ok := asObject(doc[types.MFACollection]); ok == false {
+				doc[types.MFACollection] = json.RawMessage("{}")
+			}
+			return nil
+		},
+	},
+	{
+		Version:     8,
+		Description: "Add API token collection",
+		up: func(doc document) error {
+			if _, ok := asObject(doc[types.ApiTokensCollection]); ok == false {
+				doc[types.ApiTokensCollection] = json.RawMessage("{}")
+			}
+			return nil
+		},
+	},
+	{
+		Version:     9,
+		Description: "Give existing users the user role",
+		up: func(doc document) error {
+			users, _ := asObject(doc[types.UsersCollection])
+			for id, raw := range users {
+				user, ok := asObject(raw)
+				if ok == false {
+					return fmt.Errorf("User %s is not an object", id)
+				}
+				if err := setField(user, "role", types.RoleUser); err != nil {
+					return err
+				}
+				user["is_suspended"] = json.RawMessage("false")
+				encoded, err := json.Marshal(user)
+				if err != nil {
+					return err
+				}
+				users[id] = encoded
+			}
+			return setField(doc, types.UsersCollection, users)
+		},
+	},
+	{
+		Version:     10,
+		Description: "Add OAuth client collection",
+		up: func(doc document) error {
+			if _, ok := asObject(doc[types.OAuthClientsCollection]); ok == false {
+				doc[types.OAuthClientsCollection] = json.RawMessage("{}")
+			}
+			return nil
+		},
+	},
+	{
+		Version:     11,
+		Description: "Add data export collection",
+		up: func(doc document) error {
+			if _, ok := asObject(doc[types.DataExportsCollection]); ok == false {
+				doc[types.DataExportsCollection] = json.RawMessage("{}")
+			}
+			return nil
+		},
+	},
+}
+
+// checkEmailCollisions fails, naming the users, if lowercasing emails would
+// give several users the same one. Which account keeps the address is for an
+// operator to decide, not the migration.
+func checkEmailCollisions(users document) error {
+	owners := map[string][]int{}
+	for id, raw := range users {
+		user, ok := asObject(raw)
+		if ok == false {
+			return fmt.Errorf("User %s is not an object", id)
+		}
+		email := ""
+		json.Unmarshal(user["email"], &email)
+		userId, err := strconv.Atoi(id)
+		if err != nil {
+			return fmt.Errorf("Invalid user ID %s", id)
+		}
+		owners[lookupEmail(email)] = append(owners[lookupEmail(email)], userId)
+	}
+	collisions := []string{}
+	for email, ids := range owners {
+		if len(ids) > 1 {
+			sort.Ints(ids)
+			collisions = append(collisions, fmt.Sprintf("%s is used by users %s", email, joinIds(ids)))
+		}
+	}
+	if len(collisions) == 0 {
+		return nil
+	}
+	sort.Strings(collisions)
+	return fmt.Errorf("Emails differing only in case or spacing would collide, change all but one of each before migrating: %s",
+		strings.Join(collisions, "; "))
+}
+
+func joinIds(ids []int) string {
+	formatted := make([]string, len(ids))
+	for i, id := range ids {
+		formatted[i] = strconv.Itoa(id)
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// CurrentSchemaVersion is the schema version this build reads and writes.
+var CurrentSchemaVersion = migrations[len(migrations)-1].Version
+
+type MigrateOptions struct {
+	// DryRun reports the migrations that would run without writing
+	// anything. They are still applied in memory, so a migration that
+	// would fail fails the dry run too.
+	DryRun bool
+}
+
+// MigrateDB upgrades the database file at path, and any write-ahead log next
+// to it, to CurrentSchemaVersion one migration at a time. The pre-migration
+// contents are saved to a .bak file next to path first. It returns the
+// migrations that ran, or with DryRun the ones that would have. It must not
+// be called while a DataBaseClient has path open.
+func MigrateDB(path string, options MigrateOptions) ([]Migration, error) {
+	doc, err := readDocument(path)
+	if err != nil {
+		return nil, err
+	}
+	version, err := schemaVersion(doc)
+	if err != nil {
+		return nil, err
+	}
+	if version > CurrentSchemaVersion {
+		return nil, fmt.Errorf("Database schema version %d is newer than the supported version %d", version, CurrentSchemaVersion)
+	}
+	pending := []Migration{}
+	for _, migration := range migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	if len(pending) == 0 {
+		return pending, nil
+	}
+	if options.DryRun {
+		for _, migration := range pending {
+			if err := migration.up(doc); err != nil {
+				return nil, fmt.Errorf("Migration to version %d would fail: %w", migration.Version, err)
+			}
+		}
+		return pending, nil
+	}
+
+	original, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	backupPath := fmt.Sprintf("%s.v%d.%s.bak", path, version, time.Now().UTC().Format("20060102T150405Z"))
+	if err := writeFileAtomic(backupPath, original, 0644); err != nil {
+		return nil, err
+	}
+	for _, migration := range pending {
+		if err := migration.up(doc); err != nil {
+			return nil, fmt.Errorf("Migration to version %d failed: %w", migration.Version, err)
+		}
+		if err := setField(doc, "version", migration.Version); err != nil {
+			return nil, err
+		}
+		log.Printf("Migrated %s to schema version %d: %s", path, migration.Version, migration.Description)
+	}
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, migrated, 0644); err != nil {
+		return nil, err
+	}
+	// The logs have been folded into the migrated snapshot and were written
+	// against the old schema, so they must not be replayed again.
+	for _, walPath := range []string{path + ".wal.old", path + ".wal"} {
+		if removeErr := os.Remove(walPath); removeErr != nil && errors.Is(removeErr, os.ErrNotExist) == false {
+			return nil, removeErr
+		}
+	}
+	return pending, nil
+}
+
+func schemaVersion(doc document) (int, error) {
+	raw, ok := doc["version"]
+	if ok == false || string(raw) == "null" {
+		return 0, nil
+	}
+	version := 0
+	if err := json.Unmarshal(raw, &version); err != nil {
+		return 0, fmt.Errorf("Invalid schema version %s", raw)
+	}
+	return version, nil
+}
+
+func setField(doc document, field string, value any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	doc[field] = raw
+	return nil
+}
@@ -0,0 +1,623 @@
+// Package oauth makes Chirpy an OAuth 2.0 authorization server, so
+// third-party apps can act for users who authorize them without ever seeing
+// their password. It implements the authorization code grant with PKCE (RFC
+// 6749, RFC 7636), refresh tokens, token introspection (RFC 7662) and
+// revocation (RFC 7009).
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdwiltfong/chirpy/utils"
+	"github.com/mdwiltfong/chirpy/utils/auth"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+const (
+	// CodeTTL is how long a client has to redeem an authorization code.
+	CodeTTL = 10 * time.Minute
+	// AccessTokenTTL is kept short since access tokens can't be revoked,
+	// only the refresh tokens they are renewed with.
+	AccessTokenTTL = 15 * time.Minute
+)
+
+// IssueFunc signs an access token for user that only carries scopes, on
+// behalf of the client clientId.
+type IssueFunc func(expiresIn time.Duration, user types.User, clientId string, scopes []string) (string, error)
+
+// Server holds the OAuth endpoints. RegisterClient, ListClients, Consent and
+// Authorize act for the logged-in user and have to be mounted behind
+// auth.RequireAccessToken; Token, Introspect and Revoke authenticate the
+// client themselves.
+type Server struct {
+	Store utils.Store
+	Keys  *auth.KeySet
+	Issue IssueFunc
+}
+
+func NewServer(store utils.Store, keys *auth.KeySet, issue IssueFunc) *Server {
+	return &Server{Store: store, Keys: keys, Issue: issue}
+}
+
+// ScopeDescriptions are shown on the consent screen.
+var ScopeDescriptions = map[string]string{
+	auth.ScopeChirpsRead:   "Read chirps",
+	auth.ScopeChirpsWrite:  "Post and delete chirps as you",
+	auth.ScopeProfileWrite: "Update your profile",
+}
+
+// Error codes from RFC 6749.
+const (
+	ErrorInvalidRequest       = "invalid_request"
+	ErrorInvalidClient        = "invalid_client"
+	ErrorInvalidGrant         = "invalid_grant"
+	ErrorInvalidScope         = "invalid_scope"
+	ErrorAccessDenied         = "access_denied"
+	ErrorUnsupportedGrantType = "unsupported_grant_type"
+	ErrorUnsupportedResponse  = "unsupported_response_type"
+)
+
+func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	body, _ := json.Marshal(payload)
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, description string) {
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+// maxClientNameLength bounds the name shown on the consent screen.
+const maxClientNameLength = 100
+
+// validRedirectURI only allows https, or plain http to the loopback address
+// for apps under development. Fragments aren't allowed by RFC 6749.
+func validRedirectURI(raw string) bool {
+	uri, err := url.Parse(raw)
+	if err != nil || uri.IsAbs() == false || uri.Host == "" || uri.Fragment != "" || uri.User != nil {
+		return false
+	}
+	if uri.Scheme == "https" {
+		return true
+	}
+	host := uri.Hostname()
+	ip := net.ParseIP(host)
+	return uri.Scheme == "http" && (host == "localhost" || (ip != nil && ip.IsLoopback()))
+}
+
+type clientView struct {
+	ClientId     string    `json:"client_id"`
+	ClientSecret string    `json:"client_secret,omitempty"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func viewClient(client types.OAuthClient) clientView {
+	return clientView{
+		ClientId:     client.ClientId,
+		ClientSecret: client.Secret,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+		Confidential: client.SecretHash != "",
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+func principal(r *http.Request) auth.Principal {
+	principal, _ := auth.PrincipalFromContext(r.Context())
+	return principal
+}
+
+// RegisterClient registers an app owned by the user. A confidential client's
+// secret is only in this response.
+func (server *Server) RegisterClient(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Confidential bool     `json:"confidential"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		writeError(w, http.StatusBadRequest, ErrorInvalidRequest, "Invalid payload")
+		return
+	}
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || len(params.Name) > maxClientNameLength {
+		writeError(w, http.StatusBadRequest, ErrorInvalidRequest, fmt.Sprintf("name must be between 1 and %d characters", maxClientNameLength))
+		return
+	}
+	if len(params.RedirectURIs) == 0 {
+		writeError(w, http.StatusBadRequest, ErrorInvalidRequest, "At least one redirect URI is required")
+		return
+	}
+	for _, uri := range params.RedirectURIs {
+		if validRedirectURI(uri) == false {
+			writeError(w, http.StatusBadRequest, ErrorInvalidRequest, fmt.Sprintf("Redirect URI %q must be https, or http to localhost", uri))
+			return
+		}
+	}
+	client, err := server.Store.CreateOAuthClient(principal(r).UserId, params.Name, params.RedirectURIs, params.Confidential)
+	if err != nil {
+		log.Print(err.Error())
+		writeError(w, http.StatusServiceUnavailable, "server_error", "There was an issue registering the client")
+		return
+	}
+	writeJSON(w, http.StatusCreated, viewClient(client))
+}
+
+// ListClients lists the apps the user registered.
+func (server *Server) ListClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := server.Store.ListOAuthClients(principal(r).UserId)
+	if err != nil {
+		log.Print(err.Error())
+		writeError(w, http.StatusServiceUnavailable, "server_error", "There was an issue listing your clients")
+		return
+	}
+	views := []clientView{}
+	for _, client := range clients {
+		views = append(views, viewClient(client))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// authorizationRequest is what a client asks the user to approve.
+type authorizationRequest struct {
+	Client              types.OAuthClient
+	RedirectURI         string
+	Scopes              []string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// codePayload is remembered with an authorization code until it is
+// redeemed.
+type codePayload struct {
+	RedirectURI   string   `json:"redirect_uri"`
+	Scopes        []string `json:"scopes"`
+	CodeChallenge string   `json:"code_challenge"`
+}
+
+// authorizeError is an invalid authorization request. Once the client and
+// redirect URI check out, errors go back to the client at RedirectTo;
+// before that they must not, so nobody can bounce users to arbitrary URIs.
+type authorizeError struct {
+	Code        string
+	Description string
+	RedirectTo  string
+}
+
+func (request authorizationRequest) redirect(values url.Values) string {
+	if request.State != "" {
+		values.Set("state", request.State)
+	}
+	separator := "?"
+	if strings.Contains(request.RedirectURI, "?") {
+		separator = "&"
+	}
+	return request.RedirectURI + separator + values.Encode()
+}
+
+func (request authorizationRequest) fail(code string, description string) *authorizeError {
+	redirectTo := request.redirect(url.Values{"error": {code}, "error_description": {description}})
+	return &authorizeError{Code: code, Description: description, RedirectTo: redirectTo}
+}
+
+// parseScopes splits a space separated scope parameter, rejecting unknown
+// and duplicate scopes.
+func parseScopes(scope string) ([]string, bool) {
+	scopes := strings.Fields(scope)
+	seen := map[string]bool{}
+	for _, requested := range scopes {
+		if auth.ValidScope(requested) == false || seen[requested] {
+			return nil, false
+		}
+		seen[requested] = true
+	}
+	return scopes, len(scopes) > 0
+}
+
+func (server *Server) parseAuthorizationRequest(values url.Values) (authorizationRequest, *authorizeError) {
+	request := authorizationRequest{}
+	client, err := server.Store.GetOAuthClient(values.Get("client_id"))
+	if err != nil {
+		return request, &authorizeError{Code: ErrorInvalidRequest, Description: "Unknown client_id"}
+	}
+	redirectURI := values.Get("redirect_uri")
+	registered := false
+	for _, uri := range client.RedirectURIs {
+		registered = registered || uri == redirectURI
+	}
+	if registered == false {
+		return request, &authorizeError{Code: ErrorInvalidRequest, Description: "redirect_uri is not registered for this client"}
+	}
+	request.Client = client
+	request.RedirectURI = redirectURI
+	request.State = values.Get("state")
+	if values.Get("response_type") != "code" {
+		return request, request.fail(ErrorUnsupportedResponse, "Only the code response type is supported")
+	}
+	// PKCE is required of every client, confidential ones included.
+	request.CodeChallenge = values.Get("code_challenge")
+	request.CodeChallengeMethod = values.Get("code_challenge_method")
+	if request.CodeChallengeMethod != "S256" || len(request.CodeChallenge) != 43 {
+		return request, request.fail(ErrorInvalidRequest, "A S256 code_challenge is required")
+	}
+	scopes, ok := parseScopes(values.Get("scope"))
+	if ok == false {
+		return request, request.fail(ErrorInvalidScope, "scope must list one or more of "+strings.Join(auth.Scopes, " "))
+	}
+	request.Scopes = scopes
+	return request, nil
+}
+
+func writeAuthorizeError(w http.ResponseWriter, authErr *authorizeError) {
+	payload := map[string]string{"error": authErr.Code, "error_description": authErr.Description}
+	if authErr.RedirectTo != "" {
+		payload["redirect_to"] = authErr.RedirectTo
+	}
+	writeJSON(w, http.StatusBadRequest, payload)
+}
+
+// Consent validates an authorization request, given as the query string the
+// client sent the user with, and returns what the consent screen shows.
+func (server *Server) Consent(w http.ResponseWriter, r *http.Request) {
+	request, authErr := server.parseAuthorizationRequest(r.URL.Query())
+	if authErr != nil {
+		writeAuthorizeError(w, authErr)
+		return
+	}
+	type scopeView struct {
+		Scope       string `json:"scope"`
+		Description string `json:"description"`
+	}
+	scopes := []scopeView{}
+	for _, scope := range request.Scopes {
+		scopes = append(scopes, scopeView{Scope: scope, Description: ScopeDescriptions[scope]})
+	}
+	writeJSON(w, http.StatusOK, struct {
+		ClientId    string      `json:"client_id"`
+		ClientName  string      `json:"client_name"`
+		RedirectURI string      `json:"redirect_uri"`
+		Scopes      []scopeView `json:"scopes"`
+	}{ClientId: request.Client.ClientId, ClientName: request.Client.Name, RedirectURI: request.RedirectURI, Scopes: scopes})
+}
+
+// Authorize records the user's decision on the consent screen. It takes the
+// authorization request's parameters plus "approve" as JSON and returns the
+// URI to send the user back to the client with, carrying either a code or
+// an access_denied error.
+func (server *Server) Authorize(w http.ResponseWriter, r *http.Request) {
+	params := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		writeError(w, http.StatusBadRequest, ErrorInvalidRequest, "Invalid payload")
+		return
+	}
+	values := url.Values{}
+	for key, value := range params {
+		if text, ok := value.(string); ok {
+			values.Set(key, text)
+		}
+	}
+	request, authErr := server.parseAuthorizationRequest(values)
+	if authErr != nil {
+		writeAuthorizeError(w, authErr)
+		return
+	}
+	if approved, _ := params["approve"].(bool); approved == false {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"redirect_to": request.fail(ErrorAccessDenied, "The user denied the request").RedirectTo,
+		})
+		return
+	}
+	payload, err := json.Marshal(codePayload{RedirectURI: request.RedirectURI, Scopes: request.Scopes, CodeChallenge: request.CodeChallenge})
+	if err != nil {
+		log.Print(err.Error())
+		writeError(w, http.StatusServiceUnavailable, "server_error", "There was an issue authorizing the client")
+		return
+	}
+	userId := principal(r).UserId
+	code, err := server.Store.CreateOneTimeTokenWithPayload(userId, types.PurposeOAuthCode+request.Client.ClientId, string(payload), CodeTTL)
+	if err != nil {
+		log.Print(err.Error())
+		writeError(w, http.StatusServiceUnavailable, "server_error", "There was an issue authorizing the client")
+		return
+	}
+	log.Printf("User %d authorized client %s for %s", userId, request.Client.ClientId, strings.Join(request.Scopes, " "))
+	writeJSON(w, http.StatusOK, map[string]string{"redirect_to": request.redirect(url.Values{"code": {code.Token}})})
+}
+
+var errClientAuthentication = errors.New("Client authentication failed")
+
+// authenticateClient checks the client credentials of a token, introspection
+// or revocation request, sent either with HTTP Basic auth or as form
+// parameters. Public clients only send their client_id.
+func (server *Server) authenticateClient(r *http.Request) (types.OAuthClient, error) {
+	clientId, secret, basic := r.BasicAuth()
+	if basic == false {
+		clientId, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	client, err := server.Store.GetOAuthClient(clientId)
+	if err != nil {
+		return types.OAuthClient{}, errClientAuthentication
+	}
+	if client.SecretHash == "" {
+		if secret != "" {
+			return types.OAuthClient{}, errClientAuthentication
+		}
+		return client, nil
+	}
+	if utils.OAuthClientSecretMatches(client, secret) == false {
+		return types.OAuthClient{}, errClientAuthentication
+	}
+	return client, nil
+}
+
+func writeClientError(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+	writeError(w, http.StatusUnauthorized, ErrorInvalidClient, errClientAuthentication.Error())
+}
+
+// verifyPKCE checks verifier against the S256 challenge it was derived from.
+func verifyPKCE(verifier string, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// Token is the token endpoint. It redeems authorization codes and refresh
+// tokens issued to the calling client.
+func (server *Server) Token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, ErrorInvalidRequest, "Invalid form")
+		return
+	}
+	client, err := server.authenticateClient(r)
+	if err != nil {
+		writeClientError(w)
+		return
+	}
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		server.redeemCode(w, r, client)
+	case "refresh_token":
+		server.redeemRefreshToken(w, r, client)
+	default:
+		writeError(w, http.StatusBadRequest, ErrorUnsupportedGrantType, "grant_type must be authorization_code or refresh_token")
+	}
+}
+
+func (server *Server) redeemCode(w http.ResponseWriter, r *http.Request, client types.OAuthClient) {
+	code, err := server.Store.UseOneTimeToken(r.PostForm.Get("code"), types.PurposeOAuthCode+client.ClientId)
+	// Whoever presents a code twice may have intercepted it, so the grant
+	// from its first use is revoked too (RFC 6749 section 4.1.2).
+	if errors.Is(err, utils.ErrOneTimeTokenReused) && code.FamilyId != 0 {
+		if revokeErr := server.Store.RevokeRefreshTokenFamily(code.FamilyId); revokeErr != nil {
+			log.Print(revokeErr.Error())
+		} else {
+			log.Printf("SECURITY: authorization code %d of client %s was reused, revoked token family %d",
+				code.ID, client.ClientId, code.FamilyId)
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorInvalidGrant, "The code is invalid, expired or already used")
+		return
+	}
+	payload := codePayload{}
+	if err := json.Unmarshal([]byte(code.Payload), &payload); err != nil {
+		log.Print(err.Error())
+		writeError(w, http.StatusBadRequest, ErrorInvalidGrant, "The code is invalid, expired or already used")
+		return
+	}
+	if r.PostForm.Get("redirect_uri") != payload.RedirectURI {
+		writeError(w, http.StatusBadRequest, ErrorInvalidGrant, "redirect_uri does not match the authorization request")
+		return
+	}
+	if verifyPKCE(r.PostForm.Get("code_verifier"), payload.CodeChallenge) == false {
+		writeError(w, http.StatusBadRequest, ErrorInvalidGrant, "code_verifier does not match the code_challenge")
+		return
+	}
+	user, err := server.Store.GetUserByID(code.UserId)
+	if err != nil || user.IsSuspended {
+		writeError(w, http.StatusBadRequest, ErrorInvalidGrant, "The user can no longer authorize clients")
+		return
+	}
+	refreshToken, err := server.Store.CreateSession(user.ID, types.SessionClient{
+		DeviceLabel: client.Name,
+		UserAgent:   r.UserAgent(),
+		ClientId:    client.ClientId,
+		Scopes:      payload.Scopes,
+	})
+	if err == nil {
+		err = server.Store.SetOneTimeTokenFamily(code.ID, refreshToken.FamilyId)
+		if err != nil {
+			// A session the code can't be traced to must not outlive it.
+			server.Store.RevokeRefreshTokenFamily(refreshToken.FamilyId)
+		}
+	}
+	if err != nil {
+		log.Print(err.Error())
+		writeError(w, http.StatusServiceUnavailable, "server_error", "There was an issue issuing tokens")
+		return
+	}
+	server.writeTokens(w, user, client, payload.Scopes, refreshToken.Token)
+}
+
+func (server *Server) redeemRefreshToken(w http.ResponseWriter, r *http.Request, client types.OAuthClient) {
+	stored, err := server.Store.GetRefreshTokenByString(r.PostForm.Get("refresh_token"))
+	if err != nil || stored.ClientId != client.ClientId || stored.IsExpired() {
+		writeError(w, http.StatusBadRequest, ErrorInvalidGrant, "The refresh token is invalid or expired")
+		return
+	}
+	// A narrower scope may be asked for; the refresh token keeps the scope
+	// the user granted.
+	scopes := stored.Scopes
+	if requested := r.PostForm.Get("scope"); requested != "" {
+		narrowed, ok := parseScopes(requested)
+		if ok == false || subset(narrowed, stored.Scopes) == false {
+			writeError(w, http.StatusBadRequest, ErrorInvalidScope, "scope can only narrow what the user granted")
+			return
+		}
+		scopes = narrowed
+	}
+	user, err := server.Store.GetUserByID(stored.UserId)
+	if err != nil || user.IsSuspended {
+		writeError(w, http.StatusBadRequest, ErrorInvalidGrant, "The refresh token is invalid or expired")
+		return
+	}
+	rotated, err := server.Store.RotateRefreshToken(stored.ID)
+	if errors.Is(err, utils.ErrRefreshTokenReused) {
+		log.Printf("SECURITY: refresh token %d of client %s was reused after rotation, revoked token family %d",
+			stored.ID, client.ClientId, stored.FamilyId)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorInvalidGrant, "The refresh token is invalid or expired")
+		return
+	}
+	server.writeTokens(w, user, client, scopes, rotated.Token)
+}
+
+func subset(scopes []string, of []string) bool {
+	for _, scope := range scopes {
+		found := false
+		for _, granted := range of {
+			found = found || scope == granted
+		}
+		if found == false {
+			return false
+		}
+	}
+	return true
+}
+
+func (server *Server) writeTokens(w http.ResponseWriter, user types.User, client types.OAuthClient, scopes []string, refreshToken string) {
+	accessToken, err := server.Issue(AccessTokenTTL, user, client.ClientId, scopes)
+	if err != nil {
+		log.Print(err.Error())
+		writeError(w, http.StatusServiceUnavailable, "server_error", "There was an issue issuing tokens")
+		return
+	}
+	w.Header().Set("Pragma", "no-cache")
+	writeJSON(w, http.StatusOK, struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(AccessTokenTTL / time.Second),
+		RefreshToken: refreshToken,
+		Scope:        strings.Join(scopes, " "),
+	})
+}
+
+// Introspection is the response of the introspection endpoint. Everything
+// but Active is omitted for inactive tokens.
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientId  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+}
+
+// looksLikeJWT tells access tokens from refresh tokens, which are hex.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// introspect describes token if it is live and was issued to client. Tokens
+// of other clients are reported inactive, so clients can't probe them.
+func (server *Server) introspect(token string, client types.OAuthClient) (Introspection, types.RefreshToken) {
+	if looksLikeJWT(token) {
+		claims, err := auth.ParseAccessToken(token, server.Keys)
+		if err != nil || claims.ClientId != client.ClientId || server.suspended(claims.Subject) {
+			return Introspection{}, types.RefreshToken{}
+		}
+		introspection := Introspection{Active: true, Scope: claims.Scope, ClientId: claims.ClientId,
+			Subject: claims.Subject, TokenType: "access_token"}
+		if claims.ExpiresAt != nil {
+			introspection.ExpiresAt = claims.ExpiresAt.Unix()
+		}
+		return introspection, types.RefreshToken{}
+	}
+	stored, err := server.Store.GetRefreshTokenByString(token)
+	if err != nil || stored.ClientId != client.ClientId || stored.IsValid == false || stored.IsExpired() ||
+		server.suspended(strconv.Itoa(stored.UserId)) {
+		return Introspection{}, types.RefreshToken{}
+	}
+	return Introspection{Active: true, Scope: strings.Join(stored.Scopes, " "), ClientId: stored.ClientId,
+		Subject: strconv.Itoa(stored.UserId), ExpiresAt: stored.ExpiresAt.Unix(), TokenType: "refresh_token"}, stored
+}
+
+func (server *Server) suspended(subject string) bool {
+	userId, err := strconv.Atoi(subject)
+	if err != nil {
+		return true
+	}
+	user, err := server.Store.GetUserByID(userId)
+	return err != nil || user.IsSuspended
+}
+
+// Introspect tells a client whether a token it holds is still live.
+func (server *Server) Introspect(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, ErrorInvalidRequest, "Invalid form")
+		return
+	}
+	client, err := server.authenticateClient(r)
+	if err != nil {
+		writeClientError(w)
+		return
+	}
+	introspection, _ := server.introspect(r.PostForm.Get("token"), client)
+	writeJSON(w, http.StatusOK, introspection)
+}
+
+// Revoke ends the grant a refresh token belongs to. Access tokens can't be
+// revoked and just run out within AccessTokenTTL. As RFC 7009 asks, unknown
+// tokens are not an error.
+func (server *Server) Revoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, ErrorInvalidRequest, "Invalid form")
+		return
+	}
+	client, err := server.authenticateClient(r)
+	if err != nil {
+		writeClientError(w)
+		return
+	}
+	token := r.PostForm.Get("token")
+	if looksLikeJWT(token) == false {
+		if introspection, stored := server.introspect(token, client); introspection.Active {
+			if err := server.Store.RevokeRefreshTokenFamily(stored.FamilyId); err != nil {
+				log.Print(err.Error())
+				writeError(w, http.StatusServiceUnavailable, "server_error", "There was an issue revoking the token")
+				return
+			}
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,56 @@
+// Package polka receives payment events from Polka, the provider that bills
+// Chirpy Red memberships.
+package polka
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/mdwiltfong/chirpy/utils"
+)
+
+// EventUserUpgraded is sent once a user has paid for Chirpy Red.
+const EventUserUpgraded = "user.upgraded"
+
+type Event struct {
+	Event string `json:"event"`
+	Data  struct {
+		UserId int `json:"user_id"`
+	} `json:"data"`
+}
+
+// WebhookHandler applies Polka events to Store. It does not authenticate
+// requests itself; mount it behind auth.RequireApiKey with Polka's key.
+type WebhookHandler struct {
+	Store utils.Store
+}
+
+func NewWebhookHandler(store utils.Store) *WebhookHandler {
+	return &WebhookHandler{Store: store}
+}
+
+// ServeHTTP answers 204 once an event has been handled, or for events Chirpy
+// does not care about, so that Polka stops retrying them.
+func (handler *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	event := Event{}
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		log.Printf("Invalid Polka event: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if event.Event != EventUserUpgraded {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if _, err := handler.Store.GetUserByID(event.Data.UserId); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if _, err := handler.Store.SetChirpyRed(event.Data.UserId, true); err != nil {
+		log.Print(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
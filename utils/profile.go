@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+var (
+	ErrInvalidHandle  = errors.New("Handles are 3 to 30 letters, digits or underscores, starting with a letter")
+	ErrHandleTaken    = errors.New("Handle is already in use")
+	ErrInvalidWebsite = errors.New("Website must be an http or https URL")
+)
+
+// Limits on the free-text Profile fields, in characters.
+const (
+	MaxDisplayNameLength = 50
+	MaxBioLength         = 160
+	MaxLocationLength    = 30
+	MaxWebsiteLength     = 100
+)
+
+// reservedHandles would read as something other than a user in URLs.
+var reservedHandles = map[string]bool{"me": true, "admin": true, "api": true, "avatar": true, "verify": true}
+
+// NormalizeHandle lowercases handle and checks it. Handles start with a letter
+// so they never look like user IDs.
+func NormalizeHandle(handle string) (string, error) {
+	handle = strings.ToLower(strings.TrimSpace(handle))
+	if len(handle) < 3 || len(handle) > 30 || reservedHandles[handle] || handle[0] < 'a' || handle[0] > 'z' {
+		return "", ErrInvalidHandle
+	}
+	for _, r := range handle {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' {
+			return "", ErrInvalidHandle
+		}
+	}
+	return handle, nil
+}
+
+// UpdatedProfile returns profile with the profile fields of update applied
+// and normalized. Without any, profile is returned as it is.
+func UpdatedProfile(profile types.Profile, update types.UserUpdate) (types.Profile, error) {
+	changed := false
+	for _, field := range []struct {
+		value  *string
+		target *string
+	}{
+		{update.Handle, &profile.Handle},
+		{update.DisplayName, &profile.DisplayName},
+		{update.Bio, &profile.Bio},
+		{update.Location, &profile.Location},
+		{update.Website, &profile.Website},
+	} {
+		if field.value != nil {
+			*field.target = *field.value
+			changed = true
+		}
+	}
+	if changed == false {
+		return profile, nil
+	}
+	return NormalizeProfile(profile)
+}
+
+// NormalizeProfile trims and checks every field of profile. An empty handle
+// is allowed and means the user has none.
+func NormalizeProfile(profile types.Profile) (types.Profile, error) {
+	if profile.Handle != "" {
+		handle, err := NormalizeHandle(profile.Handle)
+		if err != nil {
+			return types.Profile{}, err
+		}
+		profile.Handle = handle
+	}
+	fields := []struct {
+		name      string
+		value     *string
+		max       int
+		multiline bool
+	}{
+		{"Display name", &profile.DisplayName, MaxDisplayNameLength, false},
+		{"Bio", &profile.Bio, MaxBioLength, true},
+		{"Location", &profile.Location, MaxLocationLength, false},
+		{"Website", &profile.Website, MaxWebsiteLength, false},
+	}
+	for _, field := range fields {
+		*field.value = strings.TrimSpace(*field.value)
+		if utf8.ValidString(*field.value) == false || utf8.RuneCountInString(*field.value) > field.max {
+			return types.Profile{}, fmt.Errorf("%s can be at most %d characters", field.name, field.max)
+		}
+		for _, r := range *field.value {
+			if unicode.IsControl(r) && (field.multiline == false || r != '\n') {
+				return types.Profile{}, fmt.Errorf("%s can't contain control characters", field.name)
+			}
+		}
+	}
+	if profile.Website != "" {
+		website, err := url.Parse(profile.Website)
+		if err != nil || (website.Scheme != "http" && website.Scheme != "https") || website.Host == "" || website.User != nil {
+			return types.Profile{}, ErrInvalidWebsite
+		}
+	}
+	return profile, nil
+}
@@ -0,0 +1,1388 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+// sqliteMigrations are applied in order on NewSQLiteDB. The index of the last
+// applied statement is tracked in PRAGMA user_version, so new tables and
+// columns are added by appending to this list, never by editing it.
+var sqliteMigrations = []string{
+	`CREATE TABLE chirps (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		body TEXT NOT NULL
+	);
+	CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT NOT NULL,
+		password BLOB,
+		refresh_token_id INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX users_email ON users(email);
+	CREATE TABLE refresh_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		token TEXT NOT NULL UNIQUE,
+		expires_at DATETIME NOT NULL,
+		is_valid BOOLEAN NOT NULL
+	);`,
+	`ALTER TABLE chirps ADD COLUMN author_id INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX chirps_author_id ON chirps(author_id);`,
+	`ALTER TABLE users ADD COLUMN is_chirpy_red BOOLEAN NOT NULL DEFAULT FALSE;`,
+	`ALTER TABLE refresh_tokens ADD COLUMN family_id INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE refresh_tokens ADD COLUMN replaced_by INTEGER NOT NULL DEFAULT 0;
+	UPDATE refresh_tokens SET family_id = id;
+	CREATE INDEX refresh_tokens_family_id ON refresh_tokens(family_id);`,
+	`ALTER TABLE refresh_tokens ADD COLUMN device_label TEXT NOT NULL DEFAULT '';
+	ALTER TABLE refresh_tokens ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+	ALTER TABLE refresh_tokens ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+	ALTER TABLE refresh_tokens ADD COLUMN created_at DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	ALTER TABLE refresh_tokens ADD COLUMN last_used_at DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	CREATE INDEX refresh_tokens_user_id ON refresh_tokens(user_id);`,
+	// The token column holds the keyed hash of the token from here on.
+	`ALTER TABLE refresh_tokens ADD COLUMN token_prefix TEXT NOT NULL DEFAULT '';
+	CREATE INDEX refresh_tokens_token_prefix ON refresh_tokens(token_prefix);`,
+	`CREATE TABLE one_time_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		purpose TEXT NOT NULL,
+		token_prefix TEXT NOT NULL,
+		token_hash TEXT NOT NULL,
+		expires_at DATETIME NOT NULL,
+		used_at DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00'
+	);
+	CREATE INDEX one_time_tokens_token_prefix ON one_time_tokens(token_prefix);
+	CREATE INDEX one_time_tokens_user_id ON one_time_tokens(user_id);`,
+	`ALTER TABLE users ADD COLUMN is_email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+	UPDATE users SET is_email_verified = TRUE, email = lower(trim(email));`,
+	`CREATE TABLE mfa (
+		user_id INTEGER PRIMARY KEY,
+		totp_secret TEXT NOT NULL DEFAULT '',
+		totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+		last_totp_step INTEGER NOT NULL DEFAULT 0,
+		recovery_code_hashes TEXT NOT NULL DEFAULT ''
+	);`,
+	`CREATE TABLE api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		token_prefix TEXT NOT NULL,
+		token_hash TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		revoked_at DATETIME NOT NULL
+	);
+	CREATE INDEX api_tokens_token_prefix ON api_tokens(token_prefix);
+	CREATE INDEX api_tokens_user_id ON api_tokens(user_id);`,
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
+	ALTER TABLE users ADD COLUMN is_suspended BOOLEAN NOT NULL DEFAULT FALSE;`,
+	`ALTER TABLE refresh_tokens ADD COLUMN client_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE refresh_tokens ADD COLUMN scopes TEXT NOT NULL DEFAULT '';
+	ALTER TABLE one_time_tokens ADD COLUMN payload TEXT NOT NULL DEFAULT '';
+	CREATE TABLE oauth_clients (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		client_id TEXT NOT NULL UNIQUE,
+		owner_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		redirect_uris TEXT NOT NULL,
+		secret_hash TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX oauth_clients_owner_id ON oauth_clients(owner_id);`,
+	`ALTER TABLE users ADD COLUMN deletion_scheduled_at DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';`,
+	`CREATE TABLE data_exports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		size INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		completed_at DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00',
+		expires_at DATETIME NOT NULL
+	);
+	CREATE INDEX data_exports_user_id ON data_exports(user_id);`,
+	`ALTER TABLE users ADD COLUMN handle TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN location TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN website TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN avatar TEXT NOT NULL DEFAULT '';
+	CREATE INDEX users_handle ON users(handle);`,
+	`DROP INDEX users_email;
+	CREATE UNIQUE INDEX users_email ON users(email);`,
+	`ALTER TABLE one_time_tokens ADD COLUMN family_id INTEGER NOT NULL DEFAULT 0;`,
+	`DROP INDEX users_handle;
+	CREATE UNIQUE INDEX users_handle ON users(handle) WHERE handle != '';`,
+}
+
+// sqliteMigrationChecks run before the sqliteMigrations statement with the
+// same version, in its transaction, to fail it with an explanation rather
+// than let it lose data or trip over a constraint.
+var sqliteMigrationChecks = map[int]func(tx *sql.Tx) error{
+	9:  checkSQLiteEmailCollisions,
+	16: checkSQLiteEmailCollisions,
+	18: checkSQLiteHandleCollisions,
+}
+
+// sqliteDataMigrations run in Go right after the sqliteMigrations statement
+// with the same version, in the same transaction, for changes SQL can't make.
+var sqliteDataMigrations = map[int]func(tx *sql.Tx) error{
+	6: hashSQLiteRefreshTokens,
+}
+
+// checkSQLiteEmailCollisions fails, naming the users, if several of them
+// have the same email once lowercased.
+func checkSQLiteEmailCollisions(tx *sql.Tx) error {
+	collisions, err := sqliteCollisions(tx, "lower(trim(email))", "TRUE")
+	if err != nil || len(collisions) == 0 {
+		return err
+	}
+	return fmt.Errorf("Emails differing only in case or spacing would collide, change all but one of each before migrating: %s",
+		strings.Join(collisions, "; "))
+}
+
+// checkSQLiteHandleCollisions fails, naming the users, if several of them
+// have the same handle.
+func checkSQLiteHandleCollisions(tx *sql.Tx) error {
+	collisions, err := sqliteCollisions(tx, "handle", "handle != ''")
+	if err != nil || len(collisions) == 0 {
+		return err
+	}
+	return fmt.Errorf("Handles are shared, change all but one of each before migrating: %s", strings.Join(collisions, "; "))
+}
+
+// sqliteCollisions lists the values of key shared by several of the users
+// matching where, with their IDs.
+func sqliteCollisions(tx *sql.Tx, key string, where string) ([]string, error) {
+	rows, err := tx.Query(fmt.Sprintf(`SELECT %[1]s, group_concat(id, ', ') FROM (SELECT * FROM users WHERE %[2]s ORDER BY id)
+		GROUP BY %[1]s HAVING COUNT(*) > 1 ORDER BY %[1]s`, key, where))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	collisions := []string{}
+	for rows.Next() {
+		value, ids := "", ""
+		if err := rows.Scan(&value, &ids); err != nil {
+			return nil, err
+		}
+		collisions = append(collisions, fmt.Sprintf("%s is used by users %s", value, ids))
+	}
+	return collisions, rows.Err()
+}
+
+// uniqueViolation maps a failed UNIQUE index on the users table to the
+// error the checks before it would have returned. Those checks and the write
+// share a transaction, so this only happens if the checks are missed.
+func uniqueViolation(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) == false || sqliteErr.ExtendedCode != sqlite3.ErrConstraintUnique {
+		return err
+	}
+	switch {
+	case strings.Contains(sqliteErr.Error(), "users.email"):
+		return ErrEmailTaken
+	case strings.Contains(sqliteErr.Error(), "users.handle"):
+		return ErrHandleTaken
+	}
+	return err
+}
+
+func hashSQLiteRefreshTokens(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, token FROM refresh_tokens")
+	if err != nil {
+		return err
+	}
+	plaintext := map[int]string{}
+	for rows.Next() {
+		id, token := 0, ""
+		if err := rows.Scan(&id, &token); err != nil {
+			rows.Close()
+			return err
+		}
+		plaintext[id] = token
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, token := range plaintext {
+		if _, err := tx.Exec("UPDATE refresh_tokens SET token = ?, token_prefix = ? WHERE id = ?", hashToken(token), tokenPrefix(token), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type SQLiteClient struct {
+	Path string
+	DB   *sql.DB
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func NewSQLiteDB(path string) (*SQLiteClient, error) {
+	conn, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows a single writer; serialising through one connection
+	// avoids "database is locked" errors under concurrent requests.
+	conn.SetMaxOpenConns(1)
+	client := &SQLiteClient{Path: path, DB: conn}
+	if migrateErr := client.migrate(); migrateErr != nil {
+		conn.Close()
+		return nil, migrateErr
+	}
+	return client, nil
+}
+
+func (db *SQLiteClient) Close() error {
+	return db.DB.Close()
+}
+
+func (db *SQLiteClient) migrate() error {
+	var version int
+	if err := db.DB.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.DB.Begin()
+		if err != nil {
+			return err
+		}
+		if check, ok := sqliteMigrationChecks[i+1]; ok {
+			if checkErr := check(tx); checkErr != nil {
+				tx.Rollback()
+				return fmt.Errorf("Migration %d failed: %w", i+1, checkErr)
+			}
+		}
+		if _, execErr := tx.Exec(sqliteMigrations[i]); execErr != nil {
+			tx.Rollback()
+			return fmt.Errorf("Migration %d failed: %w", i+1, execErr)
+		}
+		if dataMigration, ok := sqliteDataMigrations[i+1]; ok {
+			if dataErr := dataMigration(tx); dataErr != nil {
+				tx.Rollback()
+				return fmt.Errorf("Migration %d failed: %w", i+1, dataErr)
+			}
+		}
+		if _, execErr := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); execErr != nil {
+			tx.Rollback()
+			return execErr
+		}
+		if commitErr := tx.Commit(); commitErr != nil {
+			return commitErr
+		}
+	}
+	return nil
+}
+
+// NextID reserves the next ID for collection by advancing the same
+// AUTOINCREMENT counter that inserts into its table use.
+func (db *SQLiteClient) NextID(collection string) (int, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	exists := 0
+	err = tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", collection).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if exists == 0 {
+		return 0, fmt.Errorf("Unknown collection: %s", collection)
+	}
+	_, err = tx.Exec(`INSERT INTO sqlite_sequence (name, seq)
+		SELECT ?, 0 WHERE NOT EXISTS (SELECT 1 FROM sqlite_sequence WHERE name = ?)`, collection, collection)
+	if err != nil {
+		return 0, err
+	}
+	id := 0
+	err = tx.QueryRow("UPDATE sqlite_sequence SET seq = seq + 1 WHERE name = ? RETURNING seq", collection).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+const chirpColumns = "id, body, author_id"
+
+func scanChirp(row rowScanner) (types.Chirp, error) {
+	chirp := types.Chirp{}
+	err := row.Scan(&chirp.ID, &chirp.Body, &chirp.AuthorId)
+	return chirp, err
+}
+
+func (db *SQLiteClient) GetChirps() ([]types.Chirp, error) {
+	rows, err := db.DB.Query("SELECT " + chirpColumns + " FROM chirps ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	chirps := []types.Chirp{}
+	for rows.Next() {
+		chirp, scanErr := scanChirp(rows)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps, rows.Err()
+}
+
+func (db *SQLiteClient) ListChirps(query types.ChirpQuery) (types.ChirpPage, error) {
+	lastId, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return types.ChirpPage{}, err
+	}
+	conditions := []string{"1 = 1"}
+	args := []any{}
+	if query.AuthorId != 0 {
+		conditions = append(conditions, "author_id = ?")
+		args = append(args, query.AuthorId)
+	}
+	order := "ASC"
+	if query.Descending {
+		order = "DESC"
+	}
+	if lastId > 0 {
+		if query.Descending {
+			conditions = append(conditions, "id < ?")
+		} else {
+			conditions = append(conditions, "id > ?")
+		}
+		args = append(args, lastId)
+	}
+	limit := chirpLimit(query.Limit)
+	// Fetch one extra row to learn whether another page follows.
+	args = append(args, limit+1)
+	rows, err := db.DB.Query("SELECT "+chirpColumns+" FROM chirps WHERE "+strings.Join(conditions, " AND ")+
+		" ORDER BY id "+order+" LIMIT ?", args...)
+	if err != nil {
+		return types.ChirpPage{}, err
+	}
+	defer rows.Close()
+	page := types.ChirpPage{Chirps: []types.Chirp{}}
+	for rows.Next() {
+		chirp, scanErr := scanChirp(rows)
+		if scanErr != nil {
+			return types.ChirpPage{}, scanErr
+		}
+		page.Chirps = append(page.Chirps, chirp)
+	}
+	if err := rows.Err(); err != nil {
+		return types.ChirpPage{}, err
+	}
+	if len(page.Chirps) > limit {
+		page.Chirps = page.Chirps[:limit]
+		page.NextCursor = encodeCursor(page.Chirps[limit-1].ID)
+	}
+	return page, nil
+}
+
+func (db *SQLiteClient) GetChirp(id int) (types.Chirp, error) {
+	chirp, err := scanChirp(db.DB.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.Chirp{}, fmt.Errorf("Unable to find chirp: %v", id)
+	}
+	if err != nil {
+		return types.Chirp{}, err
+	}
+	return chirp, nil
+}
+
+func (db *SQLiteClient) CreateChirp(body string, authorId int) (types.Chirp, error) {
+	result, err := db.DB.Exec("INSERT INTO chirps (body, author_id) VALUES (?, ?)", body, authorId)
+	if err != nil {
+		return types.Chirp{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return types.Chirp{}, err
+	}
+	return types.Chirp{ID: int(id), Body: body, AuthorId: authorId}, nil
+}
+
+func (db *SQLiteClient) DeleteChirp(id int) error {
+	result, err := db.DB.Exec("DELETE FROM chirps WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return fmt.Errorf("Unable to find chirp: %v", id)
+	}
+	return nil
+}
+
+const userColumns = "id, email, password, refresh_token_id, is_chirpy_red, is_email_verified, role, is_suspended, deletion_scheduled_at, " +
+	"handle, display_name, bio, location, website, avatar"
+
+func scanUser(row rowScanner) (types.User, error) {
+	user := types.User{}
+	err := row.Scan(&user.ID, &user.Email, &user.Password, &user.RefreshTokenId, &user.IsChirpyRed, &user.IsEmailVerified,
+		&user.Role, &user.IsSuspended, &user.DeletionScheduledAt,
+		&user.Handle, &user.DisplayName, &user.Bio, &user.Location, &user.Website, &user.Avatar)
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.User{}, errors.New("Can't find user")
+	}
+	return user, err
+}
+
+func (db *SQLiteClient) CreateUsers(email string, password []byte) (types.User, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return types.User{}, err
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return types.User{}, err
+	}
+	defer tx.Rollback()
+	if err := checkEmailFree(tx, email, 0); err != nil {
+		return types.User{}, err
+	}
+	result, err := tx.Exec("INSERT INTO users (email, password) VALUES (?, ?)", email, password)
+	if err != nil {
+		return types.User{}, uniqueViolation(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return types.User{}, err
+	}
+	return types.User{ID: int(id), Email: email, Role: types.RoleUser}, tx.Commit()
+}
+
+// checkEmailFree fails with ErrEmailTaken if a user other than userId has
+// email. The users_email index enforces the same, see uniqueViolation.
+func checkEmailFree(tx *sql.Tx, email string, userId int) error {
+	taken := 0
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE email = ? AND id != ?", email, userId).Scan(&taken); err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrEmailTaken
+	}
+	return nil
+}
+
+func (db *SQLiteClient) GetUserByEmail(email string) (types.User, error) {
+	return scanUser(db.DB.QueryRow("SELECT "+userColumns+" FROM users WHERE email = ? ORDER BY id LIMIT 1", lookupEmail(email)))
+}
+
+func (db *SQLiteClient) GetUserByID(id int) (types.User, error) {
+	return scanUser(db.DB.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+}
+
+func (db *SQLiteClient) UpdateUser(id int, update types.UserUpdate) (types.User, error) {
+	email := ""
+	if update.Email != nil {
+		normalized, err := NormalizeEmail(*update.Email)
+		if err != nil {
+			return types.User{}, err
+		}
+		email = normalized
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return types.User{}, err
+	}
+	defer tx.Rollback()
+	user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if err != nil {
+		return types.User{}, err
+	}
+	if update.Email != nil && email != user.Email {
+		if err := checkEmailFree(tx, email, id); err != nil {
+			return types.User{}, err
+		}
+		user.Email = email
+		user.IsEmailVerified = false
+	}
+	if update.Password != nil {
+		user.Password = update.Password
+	}
+	user.Profile, err = UpdatedProfile(user.Profile, update)
+	if err != nil {
+		return types.User{}, err
+	}
+	if user.Handle != "" {
+		taken := 0
+		if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE handle = ? AND id != ?", user.Handle, id).Scan(&taken); err != nil {
+			return types.User{}, err
+		}
+		if taken > 0 {
+			return types.User{}, ErrHandleTaken
+		}
+	}
+	_, err = tx.Exec(`UPDATE users SET email = ?, password = ?, is_email_verified = ?,
+		handle = ?, display_name = ?, bio = ?, location = ?, website = ? WHERE id = ?`,
+		user.Email, user.Password, user.IsEmailVerified, user.Handle, user.DisplayName, user.Bio, user.Location, user.Website, id)
+	if err != nil {
+		return types.User{}, uniqueViolation(err)
+	}
+	return user, tx.Commit()
+}
+
+func (db *SQLiteClient) SetChirpyRed(userId int, isChirpyRed bool) (types.User, error) {
+	result, err := db.DB.Exec("UPDATE users SET is_chirpy_red = ? WHERE id = ?", isChirpyRed, userId)
+	if err != nil {
+		return types.User{}, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return types.User{}, errors.New("Can't find user")
+	}
+	return db.GetUserByID(userId)
+}
+
+func (db *SQLiteClient) SetEmailVerified(userId int, isEmailVerified bool) (types.User, error) {
+	result, err := db.DB.Exec("UPDATE users SET is_email_verified = ? WHERE id = ?", isEmailVerified, userId)
+	if err != nil {
+		return types.User{}, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return types.User{}, errors.New("Can't find user")
+	}
+	return db.GetUserByID(userId)
+}
+
+func (db *SQLiteClient) SetRole(userId int, role string) (types.User, error) {
+	result, err := db.DB.Exec("UPDATE users SET role = ? WHERE id = ?", role, userId)
+	if err != nil {
+		return types.User{}, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return types.User{}, errors.New("Can't find user")
+	}
+	return db.GetUserByID(userId)
+}
+
+func (db *SQLiteClient) SetSuspended(userId int, isSuspended bool) (types.User, error) {
+	result, err := db.DB.Exec("UPDATE users SET is_suspended = ? WHERE id = ?", isSuspended, userId)
+	if err != nil {
+		return types.User{}, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return types.User{}, errors.New("Can't find user")
+	}
+	return db.GetUserByID(userId)
+}
+
+func (db *SQLiteClient) ListUsersByRole(role string) ([]types.User, error) {
+	rows, err := db.DB.Query("SELECT "+userColumns+" FROM users WHERE role = ? ORDER BY id", role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []types.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (db *SQLiteClient) UpdateProfile(userId int, profile types.Profile) (types.User, error) {
+	profile, err := NormalizeProfile(profile)
+	if err != nil {
+		return types.User{}, err
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return types.User{}, err
+	}
+	defer tx.Rollback()
+	if profile.Handle != "" {
+		taken := 0
+		if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE handle = ? AND id != ?", profile.Handle, userId).Scan(&taken); err != nil {
+			return types.User{}, err
+		}
+		if taken > 0 {
+			return types.User{}, ErrHandleTaken
+		}
+	}
+	result, err := tx.Exec("UPDATE users SET handle = ?, display_name = ?, bio = ?, location = ?, website = ?, avatar = ? WHERE id = ?",
+		profile.Handle, profile.DisplayName, profile.Bio, profile.Location, profile.Website, profile.Avatar, userId)
+	if err != nil {
+		return types.User{}, uniqueViolation(err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return types.User{}, errors.New("Can't find user")
+	}
+	if err := tx.Commit(); err != nil {
+		return types.User{}, err
+	}
+	return db.GetUserByID(userId)
+}
+
+func (db *SQLiteClient) GetUserByHandle(handle string) (types.User, error) {
+	return scanUser(db.DB.QueryRow("SELECT "+userColumns+" FROM users WHERE handle = ? AND handle != ''",
+		strings.ToLower(strings.TrimSpace(handle))))
+}
+
+func (db *SQLiteClient) SetDeletionScheduledAt(userId int, deleteAt time.Time) (types.User, error) {
+	result, err := db.DB.Exec("UPDATE users SET deletion_scheduled_at = ? WHERE id = ?", deleteAt.UTC(), userId)
+	if err != nil {
+		return types.User{}, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return types.User{}, errors.New("Can't find user")
+	}
+	return db.GetUserByID(userId)
+}
+
+func (db *SQLiteClient) ListUsersDueForDeletion(now time.Time) ([]types.User, error) {
+	rows, err := db.DB.Query("SELECT "+userColumns+" FROM users WHERE deletion_scheduled_at > ? AND deletion_scheduled_at <= ? ORDER BY id",
+		time.Time{}, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []types.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (db *SQLiteClient) DeleteUser(userId int, anonymizeChirps bool) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("DELETE FROM users WHERE id = ?", userId)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errors.New("User not found")
+	}
+	if err := deleteSQLiteUserData(tx, userId, anonymizeChirps); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *SQLiteClient) DeleteUserIfDue(userId int, now time.Time, anonymizeChirps bool) (types.User, bool, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return types.User{}, false, err
+	}
+	defer tx.Rollback()
+	exists := 0
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", userId).Scan(&exists); err != nil || exists == 0 {
+		return types.User{}, false, err
+	}
+	user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userId))
+	if err != nil {
+		return types.User{}, false, err
+	}
+	if user.DeletionScheduledAt.IsZero() || user.DeletionScheduledAt.After(now) {
+		return user, false, nil
+	}
+	if _, err := tx.Exec("DELETE FROM users WHERE id = ?", userId); err != nil {
+		return types.User{}, false, err
+	}
+	if err := deleteSQLiteUserData(tx, userId, anonymizeChirps); err != nil {
+		return types.User{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return types.User{}, false, err
+	}
+	return user, true, nil
+}
+
+// deleteSQLiteUserData removes or revokes everything of a user whose row
+// was just deleted in tx, see Store.DeleteUser.
+func deleteSQLiteUserData(tx *sql.Tx, userId int, anonymizeChirps bool) error {
+	chirps := "DELETE FROM chirps WHERE author_id = ?"
+	if anonymizeChirps {
+		chirps = "UPDATE chirps SET author_id = 0 WHERE author_id = ?"
+	}
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{chirps, []interface{}{userId}},
+		{"UPDATE refresh_tokens SET is_valid = FALSE WHERE user_id = ?", []interface{}{userId}},
+		{"UPDATE api_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at = ?", []interface{}{time.Now().UTC(), userId, time.Time{}}},
+		{"DELETE FROM one_time_tokens WHERE user_id = ?", []interface{}{userId}},
+		{"DELETE FROM oauth_clients WHERE owner_id = ?", []interface{}{userId}},
+		{"DELETE FROM data_exports WHERE user_id = ?", []interface{}{userId}},
+		{"DELETE FROM mfa WHERE user_id = ?", []interface{}{userId}},
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const refreshTokenColumns = "id, user_id, token_prefix, token, expires_at, is_valid, family_id, replaced_by, device_label, user_agent, ip, created_at, last_used_at, client_id, scopes"
+
+func scanRefreshToken(row rowScanner) (types.RefreshToken, error) {
+	token := types.RefreshToken{}
+	scopes := ""
+	err := row.Scan(&token.ID, &token.UserId, &token.TokenPrefix, &token.TokenHash, &token.ExpiresAt, &token.IsValid, &token.FamilyId, &token.ReplacedBy,
+		&token.DeviceLabel, &token.UserAgent, &token.IP, &token.CreatedAt, &token.LastUsedAt, &token.ClientId, &scopes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.RefreshToken{}, errors.New("Token not found")
+	}
+	token.Scopes = splitList(scopes)
+	return token, err
+}
+
+// splitList reverses strings.Join(list, ","), for lists kept in one column.
+func splitList(joined string) []string {
+	if joined == "" {
+		return nil
+	}
+	return strings.Split(joined, ",")
+}
+
+func (db *SQLiteClient) GenerateRefreshToken(userId int) (types.RefreshToken, error) {
+	refreshToken, err := newRefreshToken(userId)
+	if err != nil {
+		return types.RefreshToken{}, err
+	}
+	return db.StoreRefreshToken(refreshToken)
+}
+
+func (db *SQLiteClient) CreateSession(userId int, client types.SessionClient) (types.RefreshToken, error) {
+	refreshToken, err := newSession(userId, client)
+	if err != nil {
+		return types.RefreshToken{}, err
+	}
+	return db.StoreRefreshToken(refreshToken)
+}
+
+func (db *SQLiteClient) ListSessions(userId int) ([]types.Session, error) {
+	rows, err := db.DB.Query("SELECT "+refreshTokenColumns+" FROM refresh_tokens WHERE user_id = ? AND is_valid = TRUE ORDER BY id", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []types.Session{}
+	for rows.Next() {
+		token, err := scanRefreshToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		if session, ok := sessionFromToken(token); ok {
+			sessions = append(sessions, session)
+		}
+	}
+	sortSessions(sessions)
+	return sessions, rows.Err()
+}
+
+func (db *SQLiteClient) StoreRefreshToken(refreshToken types.RefreshToken) (types.RefreshToken, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return types.RefreshToken{}, err
+	}
+	defer tx.Rollback()
+	refreshToken, err = insertRefreshToken(tx, refreshToken)
+	if err != nil {
+		return types.RefreshToken{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return types.RefreshToken{}, err
+	}
+	return refreshToken, nil
+}
+
+// insertRefreshToken stores refreshToken, starting a new family unless it
+// already belongs to one, and makes it the user's current token.
+func insertRefreshToken(tx *sql.Tx, refreshToken types.RefreshToken) (types.RefreshToken, error) {
+	sealed := sealRefreshToken(refreshToken)
+	result, err := tx.Exec(`INSERT INTO refresh_tokens
+		(user_id, token_prefix, token, expires_at, is_valid, family_id, device_label, user_agent, ip, created_at, last_used_at, client_id, scopes)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		refreshToken.UserId, sealed.TokenPrefix, sealed.TokenHash, refreshToken.ExpiresAt, refreshToken.IsValid, refreshToken.FamilyId,
+		refreshToken.DeviceLabel, refreshToken.UserAgent, refreshToken.IP, refreshToken.CreatedAt, refreshToken.LastUsedAt,
+		refreshToken.ClientId, strings.Join(refreshToken.Scopes, ","))
+	if err != nil {
+		return types.RefreshToken{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return types.RefreshToken{}, err
+	}
+	refreshToken.ID = int(id)
+	if refreshToken.FamilyId == 0 {
+		refreshToken.FamilyId = refreshToken.ID
+		if _, err := tx.Exec("UPDATE refresh_tokens SET family_id = id WHERE id = ?", refreshToken.ID); err != nil {
+			return types.RefreshToken{}, err
+		}
+	}
+	result, err = tx.Exec("UPDATE users SET refresh_token_id = ? WHERE id = ?", refreshToken.ID, refreshToken.UserId)
+	if err != nil {
+		return types.RefreshToken{}, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return types.RefreshToken{}, errors.New("Can't find user")
+	}
+	return refreshToken, nil
+}
+
+func (db *SQLiteClient) UpdateRefreshToken(updatedRefreshToken types.RefreshToken) (bool, error) {
+	updatedRefreshToken = sealRefreshToken(updatedRefreshToken)
+	_, err := db.DB.Exec(`UPDATE refresh_tokens SET user_id = ?, token_prefix = ?, token = ?, expires_at = ?, is_valid = ?, family_id = ?, replaced_by = ?,
+		device_label = ?, user_agent = ?, ip = ?, created_at = ?, last_used_at = ?, client_id = ?, scopes = ? WHERE id = ?`,
+		updatedRefreshToken.UserId, updatedRefreshToken.TokenPrefix, updatedRefreshToken.TokenHash, updatedRefreshToken.ExpiresAt, updatedRefreshToken.IsValid,
+		updatedRefreshToken.FamilyId, updatedRefreshToken.ReplacedBy, updatedRefreshToken.DeviceLabel, updatedRefreshToken.UserAgent,
+		updatedRefreshToken.IP, updatedRefreshToken.CreatedAt, updatedRefreshToken.LastUsedAt, updatedRefreshToken.ClientId,
+		strings.Join(updatedRefreshToken.Scopes, ","), updatedRefreshToken.ID)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (db *SQLiteClient) GetRefreshTokenID(tokenId int) (types.RefreshToken, error) {
+	return scanRefreshToken(db.DB.QueryRow("SELECT "+refreshTokenColumns+" FROM refresh_tokens WHERE id = ?", tokenId))
+}
+
+func (db *SQLiteClient) GetRefreshTokenByString(token string) (types.RefreshToken, error) {
+	rows, err := db.DB.Query("SELECT "+refreshTokenColumns+" FROM refresh_tokens WHERE token_prefix = ?", tokenPrefix(token))
+	if err != nil {
+		return types.RefreshToken{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		refreshToken, err := scanRefreshToken(rows)
+		if err != nil {
+			return types.RefreshToken{}, err
+		}
+		if tokenMatches(refreshToken, token) {
+			return refreshToken, nil
+		}
+	}
+	return types.RefreshToken{}, errors.New("Could not find Refresh Token")
+}
+
+func (db *SQLiteClient) InvalidateToken(tokenId int) (types.RefreshToken, error) {
+	token, err := db.GetRefreshTokenID(tokenId)
+	if err != nil {
+		return types.RefreshToken{}, err
+	}
+	if token.IsValid == false {
+		return token, nil
+	}
+	if _, err := db.DB.Exec("UPDATE refresh_tokens SET is_valid = FALSE WHERE id = ?", tokenId); err != nil {
+		return types.RefreshToken{}, err
+	}
+	token.IsValid = false
+	return token, nil
+}
+
+func (db *SQLiteClient) InvalidateUsersToken(userId int) error {
+	if _, err := db.GetUserByID(userId); err != nil {
+		return errors.New("User not found")
+	}
+	if _, err := db.DB.Exec("UPDATE refresh_tokens SET is_valid = FALSE WHERE user_id = ?", userId); err != nil {
+		return errors.New("Could not invalidate token")
+	}
+	return nil
+}
+
+func (db *SQLiteClient) RotateRefreshToken(tokenId int) (types.RefreshToken, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return types.RefreshToken{}, err
+	}
+	defer tx.Rollback()
+	token, err := scanRefreshToken(tx.QueryRow("SELECT "+refreshTokenColumns+" FROM refresh_tokens WHERE id = ?", tokenId))
+	if err != nil {
+		return types.RefreshToken{}, err
+	}
+	if token.ReplacedBy != 0 {
+		if _, err := tx.Exec("UPDATE refresh_tokens SET is_valid = FALSE WHERE family_id = ?", token.FamilyId); err != nil {
+			return types.RefreshToken{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return types.RefreshToken{}, err
+		}
+		return types.RefreshToken{}, ErrRefreshTokenReused
+	}
+	if token.IsValid == false || token.IsExpired() {
+		return types.RefreshToken{}, ErrRefreshTokenInvalid
+	}
+	next, err := rotatedRefreshToken(token)
+	if err != nil {
+		return types.RefreshToken{}, err
+	}
+	next, err = insertRefreshToken(tx, next)
+	if err != nil {
+		return types.RefreshToken{}, err
+	}
+	if _, err := tx.Exec("UPDATE refresh_tokens SET is_valid = FALSE, replaced_by = ? WHERE id = ?", next.ID, token.ID); err != nil {
+		return types.RefreshToken{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return types.RefreshToken{}, err
+	}
+	return next, nil
+}
+
+func (db *SQLiteClient) RevokeRefreshTokenFamily(familyId int) error {
+	_, err := db.DB.Exec("UPDATE refresh_tokens SET is_valid = FALSE WHERE family_id = ?", familyId)
+	return err
+}
+
+const oneTimeTokenColumns = "id, user_id, purpose, token_prefix, token_hash, expires_at, used_at, payload, family_id"
+
+func scanOneTimeToken(row rowScanner) (types.OneTimeToken, error) {
+	token := types.OneTimeToken{}
+	err := row.Scan(&token.ID, &token.UserId, &token.Purpose, &token.TokenPrefix, &token.TokenHash, &token.ExpiresAt, &token.UsedAt, &token.Payload,
+		&token.FamilyId)
+	return token, err
+}
+
+func (db *SQLiteClient) CreateOneTimeToken(userId int, purpose string, ttl time.Duration) (types.OneTimeToken, error) {
+	return db.CreateOneTimeTokenWithPayload(userId, purpose, "", ttl)
+}
+
+func (db *SQLiteClient) CreateOneTimeTokenWithPayload(userId int, purpose string, payload string, ttl time.Duration) (types.OneTimeToken, error) {
+	token, err := newOneTimeToken(userId, purpose, payload, ttl)
+	if err != nil {
+		return types.OneTimeToken{}, err
+	}
+	if _, err := db.GetUserByID(userId); err != nil {
+		return types.OneTimeToken{}, errors.New("User not found")
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return types.OneTimeToken{}, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE one_time_tokens SET used_at = ? WHERE user_id = ? AND purpose = ? AND used_at = ?",
+		time.Now().UTC(), userId, purpose, time.Time{})
+	if err != nil {
+		return types.OneTimeToken{}, err
+	}
+	result, err := tx.Exec("INSERT INTO one_time_tokens (user_id, purpose, token_prefix, token_hash, expires_at, used_at, payload) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		token.UserId, token.Purpose, token.TokenPrefix, token.TokenHash, token.ExpiresAt, token.UsedAt, token.Payload)
+	if err != nil {
+		return types.OneTimeToken{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return types.OneTimeToken{}, err
+	}
+	token.ID = int(id)
+	return token, tx.Commit()
+}
+
+func (db *SQLiteClient) UseOneTimeToken(token string, purpose string) (types.OneTimeToken, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return types.OneTimeToken{}, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT "+oneTimeTokenColumns+" FROM one_time_tokens WHERE token_prefix = ?", tokenPrefix(token))
+	if err != nil {
+		return types.OneTimeToken{}, err
+	}
+	used := types.OneTimeToken{}
+	found := false
+	var usable error
+	for rows.Next() {
+		stored, err := scanOneTimeToken(rows)
+		if err != nil {
+			rows.Close()
+			return types.OneTimeToken{}, err
+		}
+		if found, usable = checkOneTimeToken(stored, token, purpose); found {
+			used = stored
+			break
+		}
+	}
+	rows.Close()
+	if found == false {
+		return types.OneTimeToken{}, ErrOneTimeTokenInvalid
+	}
+	if usable != nil {
+		return used, usable
+	}
+	used.UsedAt = time.Now().UTC()
+	if _, err := tx.Exec("UPDATE one_time_tokens SET used_at = ? WHERE id = ?", used.UsedAt, used.ID); err != nil {
+		return types.OneTimeToken{}, err
+	}
+	return used, tx.Commit()
+}
+
+func (db *SQLiteClient) SetOneTimeTokenFamily(tokenId int, familyId int) error {
+	result, err := db.DB.Exec("UPDATE one_time_tokens SET family_id = ? WHERE id = ?", familyId, tokenId)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrOneTimeTokenInvalid
+	}
+	return nil
+}
+
+const apiTokenColumns = "id, user_id, name, scopes, token_prefix, token_hash, created_at, last_used_at, expires_at, revoked_at"
+
+func scanApiToken(row rowScanner) (types.ApiToken, error) {
+	token := types.ApiToken{}
+	scopes := ""
+	err := row.Scan(&token.ID, &token.UserId, &token.Name, &scopes, &token.TokenPrefix, &token.TokenHash,
+		&token.CreatedAt, &token.LastUsedAt, &token.ExpiresAt, &token.RevokedAt)
+	token.Scopes = []string{}
+	if scopes != "" {
+		token.Scopes = strings.Split(scopes, ",")
+	}
+	return token, err
+}
+
+func (db *SQLiteClient) CreateApiToken(userId int, name string, scopes []string, expiresAt time.Time) (types.ApiToken, error) {
+	token, err := newApiToken(userId, name, scopes, expiresAt)
+	if err != nil {
+		return types.ApiToken{}, err
+	}
+	if _, err := db.GetUserByID(userId); err != nil {
+		return types.ApiToken{}, errors.New("User not found")
+	}
+	result, err := db.DB.Exec("INSERT INTO api_tokens (user_id, name, scopes, token_prefix, token_hash, created_at, last_used_at, expires_at, revoked_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		token.UserId, token.Name, strings.Join(token.Scopes, ","), token.TokenPrefix, token.TokenHash,
+		token.CreatedAt, token.LastUsedAt, token.ExpiresAt, token.RevokedAt)
+	if err != nil {
+		return types.ApiToken{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return types.ApiToken{}, err
+	}
+	token.ID = int(id)
+	return token, nil
+}
+
+func (db *SQLiteClient) ListApiTokens(userId int) ([]types.ApiToken, error) {
+	rows, err := db.DB.Query("SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id = ? AND revoked_at = ? ORDER BY id",
+		userId, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []types.ApiToken{}
+	for rows.Next() {
+		token, err := scanApiToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (db *SQLiteClient) RevokeApiToken(userId int, tokenId int) error {
+	result, err := db.DB.Exec("UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at = ?",
+		time.Now().UTC(), tokenId, userId, time.Time{})
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return ErrApiTokenNotFound
+	}
+	return nil
+}
+
+func (db *SQLiteClient) UseApiToken(token string) (types.ApiToken, error) {
+	now := time.Now().UTC()
+	rows, err := db.DB.Query("SELECT "+apiTokenColumns+" FROM api_tokens WHERE token_prefix = ?", apiTokenPrefix(token))
+	if err != nil {
+		return types.ApiToken{}, err
+	}
+	found := types.ApiToken{}
+	ok := false
+	for rows.Next() {
+		stored, err := scanApiToken(rows)
+		if err != nil {
+			rows.Close()
+			return types.ApiToken{}, err
+		}
+		if canUseApiToken(stored, token, now) {
+			found, ok = stored, true
+			break
+		}
+	}
+	rows.Close()
+	if ok == false {
+		return types.ApiToken{}, ErrApiTokenInvalid
+	}
+	if now.Sub(found.LastUsedAt) < apiTokenTouchInterval {
+		return found, nil
+	}
+	found.LastUsedAt = now
+	if _, err := db.DB.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", now, found.ID); err != nil {
+		return types.ApiToken{}, err
+	}
+	return found, nil
+}
+
+const oauthClientColumns = "id, client_id, owner_id, name, redirect_uris, secret_hash, created_at"
+
+func scanOAuthClient(row rowScanner) (types.OAuthClient, error) {
+	client := types.OAuthClient{}
+	redirectURIs := ""
+	err := row.Scan(&client.ID, &client.ClientId, &client.OwnerId, &client.Name, &redirectURIs, &client.SecretHash, &client.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.OAuthClient{}, ErrOAuthClientNotFound
+	}
+	// Redirect URIs can contain commas, so they are stored as JSON.
+	if err == nil {
+		err = json.Unmarshal([]byte(redirectURIs), &client.RedirectURIs)
+	}
+	return client, err
+}
+
+func (db *SQLiteClient) CreateOAuthClient(ownerId int, name string, redirectURIs []string, confidential bool) (types.OAuthClient, error) {
+	client, err := newOAuthClient(ownerId, name, redirectURIs, confidential)
+	if err != nil {
+		return types.OAuthClient{}, err
+	}
+	if _, err := db.GetUserByID(ownerId); err != nil {
+		return types.OAuthClient{}, errors.New("User not found")
+	}
+	encoded, err := json.Marshal(client.RedirectURIs)
+	if err != nil {
+		return types.OAuthClient{}, err
+	}
+	result, err := db.DB.Exec("INSERT INTO oauth_clients (client_id, owner_id, name, redirect_uris, secret_hash, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		client.ClientId, client.OwnerId, client.Name, string(encoded), client.SecretHash, client.CreatedAt)
+	if err != nil {
+		return types.OAuthClient{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return types.OAuthClient{}, err
+	}
+	client.ID = int(id)
+	return client, nil
+}
+
+func (db *SQLiteClient) GetOAuthClient(clientId string) (types.OAuthClient, error) {
+	return scanOAuthClient(db.DB.QueryRow("SELECT "+oauthClientColumns+" FROM oauth_clients WHERE client_id = ?", clientId))
+}
+
+func (db *SQLiteClient) ListOAuthClients(ownerId int) ([]types.OAuthClient, error) {
+	rows, err := db.DB.Query("SELECT "+oauthClientColumns+" FROM oauth_clients WHERE owner_id = ? ORDER BY id", ownerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	clients := []types.OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, rows.Err()
+}
+
+const dataExportColumns = "id, user_id, status, size, created_at, completed_at, expires_at"
+
+func scanDataExport(row rowScanner) (types.DataExport, error) {
+	export := types.DataExport{}
+	err := row.Scan(&export.ID, &export.UserId, &export.Status, &export.Size, &export.CreatedAt, &export.CompletedAt, &export.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.DataExport{}, ErrDataExportNotFound
+	}
+	return export, err
+}
+
+func scanDataExports(rows *sql.Rows) ([]types.DataExport, error) {
+	defer rows.Close()
+	exports := []types.DataExport{}
+	for rows.Next() {
+		export, err := scanDataExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, export)
+	}
+	return exports, rows.Err()
+}
+
+func (db *SQLiteClient) CreateDataExport(userId int, expiresAt time.Time) (types.DataExport, error) {
+	export := newDataExport(userId, expiresAt)
+	if _, err := db.GetUserByID(userId); err != nil {
+		return types.DataExport{}, errors.New("User not found")
+	}
+	result, err := db.DB.Exec("INSERT INTO data_exports (user_id, status, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		export.UserId, export.Status, export.CreatedAt, export.ExpiresAt)
+	if err != nil {
+		return types.DataExport{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return types.DataExport{}, err
+	}
+	export.ID = int(id)
+	return export, nil
+}
+
+func (db *SQLiteClient) GetDataExport(id int) (types.DataExport, error) {
+	return scanDataExport(db.DB.QueryRow("SELECT "+dataExportColumns+" FROM data_exports WHERE id = ?", id))
+}
+
+func (db *SQLiteClient) CompleteDataExport(id int, status string, size int64) (types.DataExport, error) {
+	result, err := db.DB.Exec("UPDATE data_exports SET status = ?, size = ?, completed_at = ? WHERE id = ? AND status = ?",
+		status, size, time.Now().UTC(), id, types.ExportPending)
+	if err != nil {
+		return types.DataExport{}, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return types.DataExport{}, ErrDataExportNotFound
+	}
+	return db.GetDataExport(id)
+}
+
+func (db *SQLiteClient) ListDataExports(userId int) ([]types.DataExport, error) {
+	rows, err := db.DB.Query("SELECT "+dataExportColumns+" FROM data_exports WHERE user_id = ? ORDER BY id", userId)
+	if err != nil {
+		return nil, err
+	}
+	return scanDataExports(rows)
+}
+
+func (db *SQLiteClient) DeleteExpiredDataExports(now time.Time) ([]types.DataExport, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT "+dataExportColumns+" FROM data_exports WHERE expires_at <= ? ORDER BY id", now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	expired, err := scanDataExports(rows)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM data_exports WHERE expires_at <= ?", now.UTC()); err != nil {
+		return nil, err
+	}
+	return expired, tx.Commit()
+}
+
+func scanMFA(row rowScanner, userId int) (types.MFA, error) {
+	mfa := types.MFA{UserId: userId}
+	hashes := ""
+	err := row.Scan(&mfa.TOTPSecret, &mfa.TOTPEnabled, &mfa.LastTOTPStep, &hashes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return mfa, nil
+	}
+	if hashes != "" {
+		mfa.RecoveryCodeHashes = strings.Split(hashes, ",")
+	}
+	return mfa, err
+}
+
+const mfaColumns = "totp_secret, totp_enabled, last_totp_step, recovery_code_hashes"
+
+func (db *SQLiteClient) GetMFA(userId int) (types.MFA, error) {
+	return scanMFA(db.DB.QueryRow("SELECT "+mfaColumns+" FROM mfa WHERE user_id = ?", userId), userId)
+}
+
+// updateMFA runs fn on the user's MFA row, creating it if needed.
+func (db *SQLiteClient) updateMFA(userId int, fn func(mfa *types.MFA) error) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	exists := 0
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", userId).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errors.New("Can't find user")
+	}
+	mfa, err := scanMFA(tx.QueryRow("SELECT "+mfaColumns+" FROM mfa WHERE user_id = ?", userId), userId)
+	if err != nil {
+		return err
+	}
+	if err := fn(&mfa); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO mfa (user_id, `+mfaColumns+`) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET totp_secret = excluded.totp_secret, totp_enabled = excluded.totp_enabled,
+		last_totp_step = excluded.last_totp_step, recovery_code_hashes = excluded.recovery_code_hashes`,
+		userId, mfa.TOTPSecret, mfa.TOTPEnabled, mfa.LastTOTPStep, strings.Join(mfa.RecoveryCodeHashes, ","))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *SQLiteClient) EnrollTOTP(userId int, secret string) error {
+	return db.updateMFA(userId, func(mfa *types.MFA) error {
+		if mfa.TOTPEnabled {
+			return ErrMFAEnabled
+		}
+		mfa.TOTPSecret = secret
+		mfa.LastTOTPStep = 0
+		return nil
+	})
+}
+
+func (db *SQLiteClient) EnableTOTP(userId int, recoveryCodes []string) error {
+	return db.updateMFA(userId, func(mfa *types.MFA) error {
+		mfa.TOTPEnabled = true
+		mfa.RecoveryCodeHashes = hashRecoveryCodes(recoveryCodes)
+		return nil
+	})
+}
+
+func (db *SQLiteClient) DisableTOTP(userId int) error {
+	_, err := db.DB.Exec("DELETE FROM mfa WHERE user_id = ?", userId)
+	return err
+}
+
+func (db *SQLiteClient) UseTOTPStep(userId int, step int64) error {
+	return db.updateMFA(userId, func(mfa *types.MFA) error {
+		if step <= mfa.LastTOTPStep {
+			return ErrMFACodeInvalid
+		}
+		mfa.LastTOTPStep = step
+		return nil
+	})
+}
+
+func (db *SQLiteClient) UseRecoveryCode(userId int, code string) error {
+	return db.updateMFA(userId, func(mfa *types.MFA) error {
+		remaining, ok := redeemRecoveryCode(mfa.RecoveryCodeHashes, code)
+		if ok == false {
+			return ErrMFACodeInvalid
+		}
+		mfa.RecoveryCodeHashes = remaining
+		return nil
+	})
+}
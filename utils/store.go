@@ -0,0 +1,450 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdwiltfong/chirpy/utils/totp"
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+// Store is the persistence layer the API handlers talk to. DataBaseClient
+// keeps everything in a single JSON file, SQLiteClient keeps it in a SQLite
+// database.
+type Store interface {
+	// NextID reserves the next ID for one of the types collections. IDs are
+	// never reused, even after deletions.
+	NextID(collection string) (int, error)
+
+	GetChirps() ([]types.Chirp, error)
+	// ListChirps returns one page of chirps ordered by ID.
+	ListChirps(query types.ChirpQuery) (types.ChirpPage, error)
+	GetChirp(id int) (types.Chirp, error)
+	CreateChirp(body string, authorId int) (types.Chirp, error)
+	DeleteChirp(id int) error
+
+	// CreateUsers and UpdateUser normalize the email and fail with
+	// ErrInvalidEmail or ErrEmailTaken. GetUserByEmail ignores case.
+	// UpdateUser applies update to the stored user, leaving the fields it
+	// doesn't set alone, and also fails like UpdateProfile. Nothing is
+	// changed unless every field can be.
+	CreateUsers(email string, password []byte) (types.User, error)
+	GetUserByEmail(email string) (types.User, error)
+	GetUserByID(id int) (types.User, error)
+	UpdateUser(id int, update types.UserUpdate) (types.User, error)
+	SetChirpyRed(userId int, isChirpyRed bool) (types.User, error)
+	SetEmailVerified(userId int, isEmailVerified bool) (types.User, error)
+	SetRole(userId int, role string) (types.User, error)
+	SetSuspended(userId int, isSuspended bool) (types.User, error)
+	// UpdateProfile replaces the user's profile after NormalizeProfile, and
+	// fails with ErrHandleTaken. GetUserByHandle ignores case.
+	UpdateProfile(userId int, profile types.Profile) (types.User, error)
+	GetUserByHandle(handle string) (types.User, error)
+	// ListUsersByRole returns the users with role, ordered by ID.
+	ListUsersByRole(role string) ([]types.User, error)
+	// SetDeletionScheduledAt schedules the user's deletion, a zero deleteAt
+	// cancels it.
+	SetDeletionScheduledAt(userId int, deleteAt time.Time) (types.User, error)
+	// ListUsersDueForDeletion returns the users whose deletion was scheduled
+	// for now or earlier, ordered by ID.
+	ListUsersDueForDeletion(now time.Time) ([]types.User, error)
+	// DeleteUser removes the user for good. Their chirps are deleted, or
+	// kept without an author if anonymizeChirps. Their refresh and API
+	// tokens are revoked, and their second factor, one-time tokens, OAuth
+	// clients and data exports deleted.
+	DeleteUser(userId int, anonymizeChirps bool) error
+	// DeleteUserIfDue is DeleteUser for a user whose deletion is still
+	// scheduled for now or earlier, checked in the same transaction so a
+	// login that cancels it can't slip in between. It returns the user as
+	// they were and whether they were deleted; unknown users are not.
+	DeleteUserIfDue(userId int, now time.Time, anonymizeChirps bool) (types.User, bool, error)
+
+	GenerateRefreshToken(userId int) (types.RefreshToken, error)
+	// CreateSession issues the first refresh token of a new session.
+	CreateSession(userId int, client types.SessionClient) (types.RefreshToken, error)
+	// ListSessions returns the user's sessions that can still be refreshed.
+	ListSessions(userId int) ([]types.Session, error)
+	StoreRefreshToken(refreshToken types.RefreshToken) (types.RefreshToken, error)
+	UpdateRefreshToken(updatedRefreshToken types.RefreshToken) (bool, error)
+	GetRefreshTokenID(tokenId int) (types.RefreshToken, error)
+	GetRefreshTokenByString(token string) (types.RefreshToken, error)
+	InvalidateToken(tokenId int) (types.RefreshToken, error)
+	// InvalidateUsersToken ends every session of the user.
+	InvalidateUsersToken(userId int) error
+	// RotateRefreshToken invalidates a valid refresh token and returns a new
+	// one in the same family. Presenting a token that was already rotated
+	// revokes its whole family and returns ErrRefreshTokenReused.
+	RotateRefreshToken(tokenId int) (types.RefreshToken, error)
+	RevokeRefreshTokenFamily(familyId int) error
+
+	// CreateOneTimeToken issues a token for purpose that expires after ttl.
+	// Earlier unused tokens of the user for the same purpose stop working.
+	CreateOneTimeToken(userId int, purpose string, ttl time.Duration) (types.OneTimeToken, error)
+	// CreateOneTimeTokenWithPayload is CreateOneTimeToken for tokens that
+	// carry a payload back to whoever redeems them.
+	CreateOneTimeTokenWithPayload(userId int, purpose string, payload string, ttl time.Duration) (types.OneTimeToken, error)
+	// UseOneTimeToken redeems token, which must have been issued for
+	// purpose, and returns ErrOneTimeTokenInvalid for anything that can't be
+	// redeemed. A token that was used or superseded before fails with
+	// ErrOneTimeTokenReused, which is also ErrOneTimeTokenInvalid, and is
+	// returned too.
+	UseOneTimeToken(token string, purpose string) (types.OneTimeToken, error)
+	// SetOneTimeTokenFamily records the refresh token family a used token
+	// was exchanged for.
+	SetOneTimeTokenFamily(tokenId int, familyId int) error
+
+	// CreateApiToken issues a token carrying scopes. A zero expiresAt
+	// never expires.
+	CreateApiToken(userId int, name string, scopes []string, expiresAt time.Time) (types.ApiToken, error)
+	// ListApiTokens returns the user's tokens that haven't been revoked.
+	ListApiTokens(userId int) ([]types.ApiToken, error)
+	// RevokeApiToken fails with ErrApiTokenNotFound unless the user has an
+	// unrevoked token tokenId.
+	RevokeApiToken(userId int, tokenId int) error
+	// UseApiToken looks up a presented token and records that it was used,
+	// or fails with ErrApiTokenInvalid.
+	UseApiToken(token string) (types.ApiToken, error)
+
+	// CreateOAuthClient registers a client. Confidential clients get a
+	// secret, returned in plaintext this once.
+	CreateOAuthClient(ownerId int, name string, redirectURIs []string, confidential bool) (types.OAuthClient, error)
+	// GetOAuthClient fails with ErrOAuthClientNotFound for unknown IDs.
+	GetOAuthClient(clientId string) (types.OAuthClient, error)
+	ListOAuthClients(ownerId int) ([]types.OAuthClient, error)
+
+	// CreateDataExport records a pending export of the user's data, to be
+	// deleted at expiresAt.
+	CreateDataExport(userId int, expiresAt time.Time) (types.DataExport, error)
+	// GetDataExport fails with ErrDataExportNotFound for unknown IDs.
+	GetDataExport(id int) (types.DataExport, error)
+	// CompleteDataExport moves a pending export to status, ExportReady with
+	// an archive of size bytes or ExportFailed.
+	CompleteDataExport(id int, status string, size int64) (types.DataExport, error)
+	// ListDataExports returns the user's exports, ordered by ID.
+	ListDataExports(userId int) ([]types.DataExport, error)
+	// DeleteExpiredDataExports deletes the exports that expired by now and
+	// returns them, so their archives can be removed too.
+	DeleteExpiredDataExports(now time.Time) ([]types.DataExport, error)
+
+	// GetMFA returns the user's second factor, with TOTPEnabled false if
+	// they never enrolled.
+	GetMFA(userId int) (types.MFA, error)
+	// EnrollTOTP starts over with a new, not yet enabled, secret. It fails
+	// with ErrMFAEnabled if TOTP is already on.
+	EnrollTOTP(userId int, secret string) error
+	// EnableTOTP turns TOTP on and replaces the recovery codes.
+	EnableTOTP(userId int, recoveryCodes []string) error
+	DisableTOTP(userId int) error
+	// UseTOTPStep records that a code from step was accepted and fails with
+	// ErrMFACodeInvalid if it is not newer than the last one.
+	UseTOTPStep(userId int, step int64) error
+	// UseRecoveryCode redeems one of the user's recovery codes, or fails
+	// with ErrMFACodeInvalid.
+	UseRecoveryCode(userId int, code string) error
+
+	// Close flushes anything still pending and releases the store.
+	Close() error
+}
+
+// OpenStore opens the Store selected by driver ("json" or "sqlite") at path.
+func OpenStore(driver string, path string) (Store, error) {
+	switch driver {
+	case "", "json":
+		client, err := NewDB(path)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	case "sqlite":
+		client, err := NewSQLiteDB(path)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+	return nil, fmt.Errorf("Unknown database driver: %s", driver)
+}
+
+// DefaultChirpLimit and MaxChirpLimit bound ChirpQuery.Limit.
+const (
+	DefaultChirpLimit = 50
+	MaxChirpLimit     = 100
+)
+
+func chirpLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultChirpLimit
+	}
+	if limit > MaxChirpLimit {
+		return MaxChirpLimit
+	}
+	return limit
+}
+
+// ErrInvalidCursor is returned by ListChirps for cursors it did not issue.
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// Cursors are opaque to clients; they currently wrap the ID of the last chirp
+// on the previous page.
+func encodeCursor(lastId int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("chirp:" + strconv.Itoa(lastId)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	idStr, found := strings.CutPrefix(string(decoded), "chirp:")
+	lastId, err := strconv.Atoi(idStr)
+	if found == false || err != nil || lastId <= 0 {
+		return 0, ErrInvalidCursor
+	}
+	return lastId, nil
+}
+
+var (
+	// ErrRefreshTokenReused means a refresh token was presented after it had
+	// already been rotated, which only happens if it was stolen.
+	ErrRefreshTokenReused  = errors.New("Refresh token reused")
+	ErrRefreshTokenInvalid = errors.New("Refresh token is invalid")
+)
+
+// ErrOneTimeTokenInvalid covers unknown, expired, used and superseded
+// one-time tokens alike.
+var ErrOneTimeTokenInvalid = errors.New("Token is invalid or has expired")
+
+// ErrOneTimeTokenReused is ErrOneTimeTokenInvalid for a token that was
+// already used, for callers that must undo what its first use did.
+var ErrOneTimeTokenReused = fmt.Errorf("%w", ErrOneTimeTokenInvalid)
+
+var (
+	ErrApiTokenInvalid  = errors.New("API token is invalid or has expired")
+	ErrApiTokenNotFound = errors.New("API token not found")
+)
+
+// ApiTokenMarker starts every API token, so they can be told apart from
+// access tokens and spotted by secret scanners.
+const ApiTokenMarker = "chirpy_pat_"
+
+// apiTokenTouchInterval is how stale LastUsedAt may get before UseApiToken
+// writes it, so busy tokens don't write on every request.
+const apiTokenTouchInterval = time.Minute
+
+func newApiToken(userId int, name string, scopes []string, expiresAt time.Time) (types.ApiToken, error) {
+	random, err := randomToken()
+	if err != nil {
+		return types.ApiToken{}, err
+	}
+	token := ApiTokenMarker + random
+	return types.ApiToken{
+		UserId:      userId,
+		Name:        name,
+		Scopes:      append([]string{}, scopes...),
+		Token:       token,
+		TokenPrefix: apiTokenPrefix(token),
+		TokenHash:   hashToken(token),
+		CreatedAt:   time.Now().UTC(),
+		ExpiresAt:   expiresAt,
+	}, nil
+}
+
+// apiTokenPrefix skips the marker, which every token shares.
+func apiTokenPrefix(token string) string {
+	return tokenPrefix(strings.TrimPrefix(token, ApiTokenMarker))
+}
+
+// canUseApiToken checks stored against a presented token.
+func canUseApiToken(stored types.ApiToken, token string, now time.Time) bool {
+	return stored.RevokedAt.IsZero() && (stored.ExpiresAt.IsZero() || stored.ExpiresAt.After(now)) &&
+		hashMatches(stored.TokenHash, token)
+}
+
+var ErrOAuthClientNotFound = errors.New("OAuth client not found")
+
+// OAuthClientIdMarker starts every OAuth client ID.
+const OAuthClientIdMarker = "chirpy_client_"
+
+func newOAuthClient(ownerId int, name string, redirectURIs []string, confidential bool) (types.OAuthClient, error) {
+	random, err := randomToken()
+	if err != nil {
+		return types.OAuthClient{}, err
+	}
+	client := types.OAuthClient{
+		ClientId:     OAuthClientIdMarker + random[:24],
+		OwnerId:      ownerId,
+		Name:         name,
+		RedirectURIs: append([]string{}, redirectURIs...),
+		CreatedAt:    time.Now().UTC(),
+	}
+	if confidential {
+		secret, err := randomToken()
+		if err != nil {
+			return types.OAuthClient{}, err
+		}
+		client.Secret = secret
+		client.SecretHash = hashToken(secret)
+	}
+	return client, nil
+}
+
+// OAuthClientSecretMatches reports in constant time whether secret is the
+// secret of a confidential client. It is always false for public clients.
+func OAuthClientSecretMatches(client types.OAuthClient, secret string) bool {
+	return client.SecretHash != "" && hashMatches(client.SecretHash, secret)
+}
+
+var ErrDataExportNotFound = errors.New("Data export not found")
+
+func newDataExport(userId int, expiresAt time.Time) types.DataExport {
+	return types.DataExport{
+		UserId:    userId,
+		Status:    types.ExportPending,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt.UTC(),
+	}
+}
+
+var (
+	ErrMFAEnabled     = errors.New("Two-factor authentication is already enabled")
+	ErrMFACodeInvalid = errors.New("Invalid two-factor authentication code")
+)
+
+func hashRecoveryCodes(codes []string) []string {
+	hashes := []string{}
+	for _, code := range codes {
+		hashes = append(hashes, hashToken(totp.NormalizeRecoveryCode(code)))
+	}
+	return hashes
+}
+
+// redeemRecoveryCode returns hashes without the one matching code.
+func redeemRecoveryCode(hashes []string, code string) ([]string, bool) {
+	for i, hash := range hashes {
+		if hashMatches(hash, totp.NormalizeRecoveryCode(code)) {
+			return append(append([]string{}, hashes[:i]...), hashes[i+1:]...), true
+		}
+	}
+	return hashes, false
+}
+
+func randomToken() (string, error) {
+	c := 32
+	rndByteArr := make([]byte, c)
+	_, readErr := rand.Read(rndByteArr)
+	if readErr != nil {
+		return "", readErr
+	}
+	return hex.EncodeToString(rndByteArr), nil
+}
+
+func newOneTimeToken(userId int, purpose string, payload string, ttl time.Duration) (types.OneTimeToken, error) {
+	token, err := randomToken()
+	if err != nil {
+		return types.OneTimeToken{}, err
+	}
+	return types.OneTimeToken{
+		UserId:      userId,
+		Purpose:     purpose,
+		Token:       token,
+		TokenPrefix: tokenPrefix(token),
+		TokenHash:   hashToken(token),
+		ExpiresAt:   time.Now().UTC().Add(ttl),
+		Payload:     payload,
+	}, nil
+}
+
+// checkOneTimeToken reports whether stored is the presented token for
+// purpose, and if so, whether it can still be used or fails with
+// ErrOneTimeTokenInvalid or ErrOneTimeTokenReused.
+func checkOneTimeToken(stored types.OneTimeToken, token string, purpose string) (bool, error) {
+	if stored.Purpose != purpose || hashMatches(stored.TokenHash, token) == false {
+		return false, nil
+	}
+	if stored.UsedAt.IsZero() == false {
+		return true, ErrOneTimeTokenReused
+	}
+	if stored.ExpiresAt.After(time.Now().UTC()) == false {
+		return true, ErrOneTimeTokenInvalid
+	}
+	return true, nil
+}
+
+func newRefreshToken(userId int) (types.RefreshToken, error) {
+	encodedString, readErr := randomToken()
+	if readErr != nil {
+		return types.RefreshToken{}, readErr
+	}
+	now := time.Now().UTC()
+	return types.RefreshToken{
+		Token:      encodedString,
+		UserId:     userId,
+		IsValid:    true,
+		ExpiresAt:  now.Add(time.Hour * 24 * 60),
+		CreatedAt:  now,
+		LastUsedAt: now,
+	}, nil
+}
+
+func newSession(userId int, client types.SessionClient) (types.RefreshToken, error) {
+	refreshToken, err := newRefreshToken(userId)
+	if err != nil {
+		return types.RefreshToken{}, err
+	}
+	refreshToken.DeviceLabel = client.DeviceLabel
+	refreshToken.UserAgent = client.UserAgent
+	refreshToken.IP = client.IP
+	refreshToken.ClientId = client.ClientId
+	refreshToken.Scopes = client.Scopes
+	return refreshToken, nil
+}
+
+// rotatedRefreshToken returns a fresh token continuing token's session.
+func rotatedRefreshToken(token types.RefreshToken) (types.RefreshToken, error) {
+	next, err := newRefreshToken(token.UserId)
+	if err != nil {
+		return types.RefreshToken{}, err
+	}
+	next.FamilyId = token.FamilyId
+	next.DeviceLabel = token.DeviceLabel
+	next.UserAgent = token.UserAgent
+	next.IP = token.IP
+	next.ClientId = token.ClientId
+	next.Scopes = token.Scopes
+	next.CreatedAt = token.CreatedAt
+	return next, nil
+}
+
+// sortSessions orders sessions oldest first. A session's live token gets a
+// new ID on every rotation, so token order is not session order.
+func sortSessions(sessions []types.Session) {
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+}
+
+// sessionFromToken returns the session token is the live token of, if any.
+func sessionFromToken(token types.RefreshToken) (types.Session, bool) {
+	if token.IsValid == false || token.IsExpired() {
+		return types.Session{}, false
+	}
+	return types.Session{
+		ID:          token.FamilyId,
+		DeviceLabel: token.DeviceLabel,
+		UserAgent:   token.UserAgent,
+		IP:          token.IP,
+		CreatedAt:   token.CreatedAt,
+		LastUsedAt:  token.LastUsedAt,
+		ClientId:    token.ClientId,
+	}, true
+}
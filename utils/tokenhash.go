@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+// Refresh tokens are only stored as an HMAC-SHA256 of the token under a
+// server-side key, so a copy of the database is not enough to log in as
+// anyone. The first tokenPrefixLength characters of the token are stored in
+// the clear to find the record to compare against.
+const tokenPrefixLength = 8
+
+var (
+	tokenKeyMu sync.RWMutex
+	tokenKey   []byte
+)
+
+// SetRefreshTokenKey sets the key refresh tokens are hashed with. It has to
+// be called before any store is opened, since opening one may migrate
+// plaintext tokens. Changing the key invalidates every stored token.
+func SetRefreshTokenKey(key []byte) {
+	tokenKeyMu.Lock()
+	defer tokenKeyMu.Unlock()
+	tokenKey = key
+}
+
+func hashToken(token string) string {
+	tokenKeyMu.RLock()
+	defer tokenKeyMu.RUnlock()
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func tokenPrefix(token string) string {
+	if len(token) < tokenPrefixLength {
+		return token
+	}
+	return token[:tokenPrefixLength]
+}
+
+// sealRefreshToken replaces the plaintext token with its prefix and hash.
+func sealRefreshToken(refreshToken types.RefreshToken) types.RefreshToken {
+	if refreshToken.Token == "" {
+		return refreshToken
+	}
+	refreshToken.TokenPrefix = tokenPrefix(refreshToken.Token)
+	refreshToken.TokenHash = hashToken(refreshToken.Token)
+	refreshToken.Token = ""
+	return refreshToken
+}
+
+// tokenMatches reports in constant time whether token is the one stored
+// refreshToken was sealed from.
+func tokenMatches(refreshToken types.RefreshToken, token string) bool {
+	return hashMatches(refreshToken.TokenHash, token)
+}
+
+func hashMatches(tokenHash string, token string) bool {
+	return hmac.Equal([]byte(tokenHash), []byte(hashToken(token)))
+}
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+// Tx is an Update in progress. Reads go straight to the embedded resident
+// database. Writes to its collections must go through Put and Remove, which
+// record the previous version of each record they touch, so that the
+// transaction can be logged, indexed and rolled back by looking at those
+// records only. Assigning to the maps directly would bypass all three.
+type Tx struct {
+	*types.Database
+	// before holds the version of every touched record from before the
+	// transaction, or nothing for records it created.
+	before types.Database
+	// touched lists, per types.Database field index, the IDs Put or Remove
+	// was called with.
+	touched   map[int]map[int]struct{}
+	sequences map[string]int
+	version   int
+}
+
+func newTx(data *types.Database) *Tx {
+	sequences := make(map[string]int, len(data.Sequences))
+	for collection, id := range data.Sequences {
+		sequences[collection] = id
+	}
+	return &Tx{Database: data, touched: map[int]map[int]struct{}{}, sequences: sequences, version: data.Version}
+}
+
+// Put stores value under id in records, which must be one of tx's
+// collections.
+func Put[V any](tx *Tx, records map[int]V, id int, value V) {
+	tx.touch(records, id)
+	records[id] = value
+}
+
+// Remove deletes id from records, which must be one of tx's collections.
+func Remove[V any](tx *Tx, records map[int]V, id int) {
+	tx.touch(records, id)
+	delete(records, id)
+}
+
+// touch remembers the version of records[id] from before the transaction
+// the first time the record is written.
+func (tx *Tx) touch(records interface{}, id int) {
+	field := tx.fieldOf(records)
+	ids, ok := tx.touched[field]
+	if ok == false {
+		ids = map[int]struct{}{}
+		tx.touched[field] = ids
+	}
+	if _, seen := ids[id]; seen {
+		return
+	}
+	ids[id] = struct{}{}
+	previous := reflect.ValueOf(tx.Database).Elem().Field(field).MapIndex(reflect.ValueOf(id))
+	if previous.IsValid() == false {
+		return
+	}
+	before := reflect.ValueOf(&tx.before).Elem().Field(field)
+	if before.IsNil() {
+		before.Set(reflect.MakeMap(before.Type()))
+	}
+	before.SetMapIndex(reflect.ValueOf(id), previous)
+}
+
+// fieldOf returns the index of the types.Database field holding records.
+func (tx *Tx) fieldOf(records interface{}) int {
+	pointer := reflect.ValueOf(records).UnsafePointer()
+	value := reflect.ValueOf(tx.Database).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if field.Kind() == reflect.Map && field.IsNil() == false && field.UnsafePointer() == pointer {
+			return i
+		}
+	}
+	panic(fmt.Sprintf("utils: %T is not a collection of this transaction", records))
+}
+
+// record describes what the transaction changed as a walRecord. Touched
+// records that ended up as they started are left out.
+func (tx *Tx) record() (walRecord, error) {
+	record := walRecord{
+		Set:     map[string]map[string]json.RawMessage{},
+		Delete:  map[string][]string{},
+		Replace: map[string]json.RawMessage{},
+	}
+	value := reflect.ValueOf(tx.Database).Elem()
+	before := reflect.ValueOf(&tx.before).Elem()
+	for field, ids := range tx.touched {
+		name := jsonFieldName(value.Type().Field(field))
+		for id := range ids {
+			key := reflect.ValueOf(id)
+			previous, current := before.Field(field).MapIndex(key), value.Field(field).MapIndex(key)
+			if current.IsValid() == false {
+				if previous.IsValid() {
+					record.Delete[name] = append(record.Delete[name], strconv.Itoa(id))
+				}
+				continue
+			}
+			if previous.IsValid() && reflect.DeepEqual(previous.Interface(), current.Interface()) {
+				continue
+			}
+			raw, err := json.Marshal(current.Interface())
+			if err != nil {
+				return walRecord{}, err
+			}
+			if record.Set[name] == nil {
+				record.Set[name] = map[string]json.RawMessage{}
+			}
+			record.Set[name][strconv.Itoa(id)] = raw
+		}
+	}
+	for collection, id := range tx.Sequences {
+		if previous, ok := tx.sequences[collection]; ok && previous == id {
+			continue
+		}
+		if record.Set["sequences"] == nil {
+			record.Set["sequences"] = map[string]json.RawMessage{}
+		}
+		record.Set["sequences"][collection] = json.RawMessage(strconv.Itoa(id))
+	}
+	if tx.Version != tx.version {
+		record.Replace["version"] = json.RawMessage(strconv.Itoa(tx.Version))
+	}
+	return record, nil
+}
+
+// rollback puts every touched record, the sequences and the version back
+// the way they were.
+func (tx *Tx) rollback() {
+	value := reflect.ValueOf(tx.Database).Elem()
+	before := reflect.ValueOf(&tx.before).Elem()
+	for field, ids := range tx.touched {
+		for id := range ids {
+			key := reflect.ValueOf(id)
+			// A zero Value deletes the key again.
+			value.Field(field).SetMapIndex(key, before.Field(field).MapIndex(key))
+		}
+	}
+	tx.Sequences = tx.sequences
+	tx.Version = tx.version
+}
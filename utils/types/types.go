@@ -3,22 +3,138 @@ package types
 import "time"
 
 type Chirp struct {
-	ID   int    `json:"id"`
-	Body string `json:"body"`
+	ID       int    `json:"id"`
+	Body     string `json:"body"`
+	AuthorId int    `json:"author_id"`
 }
+
+// ChirpQuery selects one page of chirps, see utils.Store.ListChirps.
+type ChirpQuery struct {
+	// AuthorId limits the page to one author's chirps; 0 means every author.
+	AuthorId   int
+	Descending bool
+	Limit      int
+	// Cursor is the NextCursor of the previous page, empty for the first.
+	Cursor string
+}
+
+type ChirpPage struct {
+	Chirps     []Chirp `json:"chirps"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
 type User struct {
 	ID             int    `json:"id"`
 	Email          string `json:"email"`
 	Password       []byte `json:"password,omitempty"`
 	Token          string `json:"token,omitempty"`
 	RefreshTokenId int    `json:"refresh_token_id,omitempty"`
+	IsChirpyRed    bool   `json:"is_chirpy_red"`
+	// IsEmailVerified is set once the user follows the link mailed to Email.
+	IsEmailVerified bool `json:"is_email_verified"`
+	// Role is one of the Role constants and decides what the user may do
+	// beyond their own account, see auth.Can.
+	Role string `json:"role"`
+	// IsSuspended users can't log in or act on the API.
+	IsSuspended bool `json:"is_suspended"`
+	// DeletionScheduledAt is when the user asked for their account to be
+	// deleted for good, zero unless they did. Logging in before then cancels.
+	DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
+	Profile
+}
+
+// UserUpdate changes a user's credentials and profile. Nil fields are left
+// as they are.
+type UserUpdate struct {
+	// Email is the new address, which has to be verified again if it
+	// differs from the current one.
+	Email *string
+	// Password is the bcrypt hash of the new password.
+	Password []byte
+	// The Profile fields to replace, an empty string clears one.
+	Handle      *string
+	DisplayName *string
+	Bio         *string
+	Location    *string
+	Website     *string
+}
+
+// Profile is what a User shows everyone else. Every field is optional.
+type Profile struct {
+	// Handle is unique, lowercase, and names the user in URLs.
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	Location    string `json:"location"`
+	Website     string `json:"website"`
+	// Avatar is the key of the user's avatar thumbnails, empty without one.
+	Avatar string `json:"avatar"`
 }
+
+// Roles a User can have, from least to most privileged.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// ValidRole reports whether role is one of the Role constants.
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleModerator || role == RoleAdmin
+}
+
 type RefreshToken struct {
-	ID        int       `json:"id"`
-	UserId    int       `json:"userId"`
-	Token     string    `json:"token"`
-	ExpiresAt time.Time `json:"expires_at"`
-	IsValid   bool      `json:"is_valid"`
+	ID     int `json:"id"`
+	UserId int `json:"userId"`
+	// Token is the plaintext token. It is only set on tokens a store has
+	// just issued and is never persisted.
+	Token string `json:"-"`
+	// TokenPrefix is the start of the plaintext token, kept to look the
+	// token up by. TokenHash is the keyed hash of the whole token.
+	TokenPrefix string    `json:"token_prefix"`
+	TokenHash   string    `json:"token_hash"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	IsValid     bool      `json:"is_valid"`
+	// FamilyId is the ID of the token issued at login. Every token rotated
+	// out of it shares the family, so a stolen token can be revoked along
+	// with everything issued after it.
+	FamilyId int `json:"family_id"`
+	// ReplacedBy is the ID of the token this one was rotated into, 0 if it
+	// has not been rotated.
+	ReplacedBy int `json:"replaced_by,omitempty"`
+	// The session the token belongs to. Rotation carries these over to the
+	// new token, only LastUsedAt moves.
+	DeviceLabel string    `json:"device_label,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	IP          string    `json:"ip,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+	// ClientId is set on tokens issued to an OAuth client, which can only
+	// trade them for access tokens limited to Scopes.
+	ClientId string   `json:"client_id,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+}
+
+// SessionClient describes the device a user logged in from, or the OAuth
+// client they authorized.
+type SessionClient struct {
+	DeviceLabel string
+	UserAgent   string
+	IP          string
+	ClientId    string
+	Scopes      []string
+}
+
+// Session is one logged-in device: the live refresh token of a token family.
+// Its ID is the family ID.
+type Session struct {
+	ID          int       `json:"id"`
+	DeviceLabel string    `json:"device_label"`
+	UserAgent   string    `json:"user_agent"`
+	IP          string    `json:"ip"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+	ClientId    string    `json:"client_id,omitempty"`
 }
 
 func (token RefreshToken) IsExpired() bool {
@@ -28,10 +144,153 @@ func (token RefreshToken) IsExpired() bool {
 	return false
 }
 
+// Purposes a OneTimeToken can be issued for.
+const (
+	PurposePasswordReset     = "password_reset"
+	PurposeEmailVerification = "email_verification"
+	// PurposeMFAChallenge tokens stand in for a password that was accepted
+	// until the second factor is too.
+	PurposeMFAChallenge = "mfa_challenge"
+	// PurposeOAuthCode is followed by the client ID, so an authorization
+	// code can only be redeemed by the client it was issued to.
+	PurposeOAuthCode = "oauth_code:"
+)
+
+// MFA is a user's second factor. It is kept apart from User so it can never
+// end up in a response that includes the user.
+type MFA struct {
+	UserId int `json:"user_id"`
+	// TOTPSecret is the base32 secret shared with the authenticator app. It
+	// is set from enrollment on, but only checked once TOTPEnabled.
+	TOTPSecret  string `json:"totp_secret"`
+	TOTPEnabled bool   `json:"totp_enabled"`
+	// LastTOTPStep is the time step of the last accepted code. Codes from it
+	// or earlier steps are refused so an observed code can't be replayed.
+	LastTOTPStep int64 `json:"last_totp_step"`
+	// RecoveryCodeHashes are keyed hashes of the unused recovery codes.
+	RecoveryCodeHashes []string `json:"recovery_code_hashes"`
+}
+
+// OneTimeToken is a short-lived token mailed to a user to prove they own
+// their email address. Like refresh tokens, only a keyed hash is stored.
+type OneTimeToken struct {
+	ID      int    `json:"id"`
+	UserId  int    `json:"user_id"`
+	Purpose string `json:"purpose"`
+	// Token is the plaintext token, only set when the token is issued.
+	Token       string    `json:"-"`
+	TokenPrefix string    `json:"token_prefix"`
+	TokenHash   string    `json:"token_hash"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	// UsedAt is when the token was redeemed or superseded, zero while it
+	// can still be used.
+	UsedAt time.Time `json:"used_at"`
+	// Payload is whatever the purpose needs to remember until the token is
+	// redeemed.
+	Payload string `json:"payload,omitempty"`
+	// FamilyId is the refresh token family issued when an OAuth code was
+	// redeemed, revoked if the code is presented again.
+	FamilyId int `json:"family_id,omitempty"`
+}
+
+// OAuthClient is a third-party app registered to act for users who
+// authorize it.
+type OAuthClient struct {
+	ID int `json:"id"`
+	// ClientId is the public identifier the client sends.
+	ClientId string `json:"client_id"`
+	// OwnerId is the user who registered the client.
+	OwnerId int    `json:"owner_id"`
+	Name    string `json:"name"`
+	// RedirectURIs are the only URIs authorization codes are sent to.
+	RedirectURIs []string `json:"redirect_uris"`
+	// Secret is the plaintext secret, only set when a confidential client
+	// is registered.
+	Secret string `json:"-"`
+	// SecretHash is empty for public clients, which only have PKCE to prove
+	// who they are.
+	SecretHash string    `json:"secret_hash,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ApiToken is a long-lived token a user mints for automation. It can only
+// do what its Scopes allow. Like refresh tokens, only a keyed hash is stored.
+type ApiToken struct {
+	ID     int      `json:"id"`
+	UserId int      `json:"user_id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Token is the plaintext token, only set when the token is issued.
+	Token       string    `json:"-"`
+	TokenPrefix string    `json:"token_prefix"`
+	TokenHash   string    `json:"token_hash"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+	// ExpiresAt is zero for tokens that don't expire.
+	ExpiresAt time.Time `json:"expires_at"`
+	// RevokedAt is zero until the token is revoked.
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// Statuses a DataExport goes through.
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// DataExport is an archive of everything stored about a user, built in the
+// background when they ask for it.
+type DataExport struct {
+	ID     int    `json:"id"`
+	UserId int    `json:"user_id"`
+	Status string `json:"status"`
+	// Size is the size of the archive in bytes once it is ready.
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+	CompletedAt time.Time `json:"completed_at"`
+	// ExpiresAt is when the archive is deleted.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Collection names double as the JSON keys in Database and the SQLite table
+// names.
+const (
+	ChirpsCollection        = "chirps"
+	UsersCollection         = "users"
+	RefreshTokensCollection = "refresh_tokens"
+	OneTimeTokensCollection = "one_time_tokens"
+	// MFACollection is keyed by user ID.
+	MFACollection          = "mfa"
+	ApiTokensCollection    = "api_tokens"
+	OAuthClientsCollection = "oauth_clients"
+	DataExportsCollection  = "data_exports"
+)
+
 type Database struct {
+	// Version is the schema version of the persisted file, see
+	// utils.MigrateDB.
+	Version       int                  `json:"version"`
 	Chirps        map[int]Chirp        `json:"chirps"`
 	Users         map[int]User         `json:"users"`
 	RefreshTokens map[int]RefreshToken `json:"refresh_tokens"`
+	OneTimeTokens map[int]OneTimeToken `json:"one_time_tokens"`
+	MFA           map[int]MFA          `json:"mfa"`
+	ApiTokens     map[int]ApiToken     `json:"api_tokens"`
+	OAuthClients  map[int]OAuthClient  `json:"oauth_clients"`
+	DataExports   map[int]DataExport   `json:"data_exports"`
+	// Sequences holds the last ID handed out per collection.
+	Sequences map[string]int `json:"sequences"`
+}
+
+// NextID allocates the next ID for collection. IDs only ever go up, so a
+// deleted record's ID is never handed out again.
+func (data *Database) NextID(collection string) int {
+	if data.Sequences == nil {
+		data.Sequences = map[string]int{}
+	}
+	data.Sequences[collection]++
+	return data.Sequences[collection]
 }
 
 type CustomClaims struct {
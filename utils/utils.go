@@ -1,113 +1,432 @@
 package utils
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/mdwiltfong/chirpy/utils/types"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
+// DataBaseClient keeps the whole database resident in memory. Every Update is
+// committed to a write-ahead log next to Path before it becomes visible, and
+// the log is folded into the snapshot at Path in the background.
 type DataBaseClient struct {
 	Path string
 	Mux  *sync.RWMutex
+	// CompactEvery is how many write-ahead log records are kept before
+	// they are folded into the snapshot at Path.
+	CompactEvery int
+
+	data            types.Database
+	indexes         dbIndexes
+	walRecords      int
+	compactMu       sync.Mutex
+	compactRequests chan struct{}
+	stop            chan struct{}
+	stopped         chan struct{}
+	closeOnce       sync.Once
 }
 
 func NewDB(path string) (*DataBaseClient, error) {
-	// Path towards database file
-	_, err := os.ReadFile(path)
+	db := &DataBaseClient{
+		Path:            path,
+		Mux:             new(sync.RWMutex),
+		CompactEvery:    DefaultCompactEvery,
+		compactRequests: make(chan struct{}, 1),
+		stop:            make(chan struct{}),
+		stopped:         make(chan struct{}),
+	}
+	ensureErr := db.EnsureDB()
+	if ensureErr != nil {
+		return nil, ensureErr
+	}
+	_, migrateErr := MigrateDB(path, MigrateOptions{})
+	if migrateErr != nil {
+		log.Println(migrateErr)
+		return nil, migrateErr
+	}
+	dataStruct, err := db.loadFromDisk()
 	if err != nil {
-		templatePath := GetPath()
-		dbTemplate, _ := os.ReadFile(templatePath)
-		writeError := os.WriteFile(path, dbTemplate, 0644)
-		if writeError != nil {
-			log.Println(writeError)
-			return nil, writeError
-		}
+		log.Println(err)
+		return nil, err
 	}
-	return &DataBaseClient{Path: path, Mux: new(sync.RWMutex)}, nil
+	db.data = dataStruct
+	db.indexes = buildIndexes(&db.data)
+	// Start from a clean snapshot holding anything the previous process
+	// committed to the write-ahead log but never compacted.
+	compactErr := db.Compact()
+	if compactErr != nil {
+		log.Println(compactErr)
+		return nil, compactErr
+	}
+	go db.compactInBackground()
+	return db, nil
 
 }
 
+// LoadDB returns a copy of the database that is safe to modify.
 func (db *DataBaseClient) LoadDB() (types.Database, error) {
-	dataBytes, err := os.ReadFile(db.Path)
-	if err != nil {
-		return types.Database{}, errors.New(err.Error())
+	db.Mux.RLock()
+	defer db.Mux.RUnlock()
+	return cloneDatabase(&db.data), nil
+}
+
+// WriteDB replaces the whole database with dbStructure and compacts the
+// write-ahead log.
+func (db *DataBaseClient) WriteDB(dbStructure types.Database) error {
+	replacement := cloneDatabase(&dbStructure)
+	seedSequences(&replacement)
+	db.Mux.Lock()
+	record, err := diffDatabases(&db.data, &replacement)
+	if err == nil {
+		err = db.commit(record)
 	}
-	tempStruct := types.Database{}
-	unMarshalError := json.Unmarshal(dataBytes, &tempStruct)
-	if unMarshalError != nil {
-		return types.Database{}, errors.New(unMarshalError.Error())
+	if err == nil {
+		db.data = replacement
+		db.indexes = buildIndexes(&db.data)
 	}
-	return tempStruct, nil
+	db.Mux.Unlock()
+	if err != nil {
+		return err
+	}
+	return db.Compact()
 }
 
-func (db *DataBaseClient) WriteDB(dbStructure types.Database) error {
+// View runs fn against the resident database while holding the read lock.
+// fn must not modify data.
+func (db *DataBaseClient) View(fn func(data *types.Database) error) error {
+	db.Mux.RLock()
+	defer db.Mux.RUnlock()
+	return fn(&db.data)
+}
+
+// Update runs fn as a single read-modify-write transaction. The write lock is
+// held for the whole call, so concurrent updates are serialized. fn writes
+// through tx, see Tx: if it returns an error the records it touched are
+// rolled back and the error is returned. Otherwise the changes are durable
+// once they reach the write-ahead log, and only then become visible to
+// readers. Only the touched records are logged and reindexed, so a write
+// costs the same however large the database is.
+func (db *DataBaseClient) Update(fn func(tx *Tx) error) error {
 	db.Mux.Lock()
 	defer db.Mux.Unlock()
-	dataBytes, err := json.Marshal(dbStructure)
+	tx := newTx(&db.data)
+	if fnErr := fn(tx); fnErr != nil {
+		tx.rollback()
+		return fnErr
+	}
+	record, err := tx.record()
+	if err == nil {
+		err = db.commit(record)
+	}
 	if err != nil {
+		tx.rollback()
 		return err
 	}
-	writeError := os.WriteFile(db.Path, dataBytes, 0644)
+	db.indexes.update(&tx.before, &db.data, record)
+	return nil
+}
+
+// commit appends record to the write-ahead log, and asks for a compaction
+// once enough records have piled up. The write lock must be held.
+func (db *DataBaseClient) commit(record walRecord) error {
+	if record.isEmpty() {
+		return nil
+	}
+	if walErr := appendWAL(db.walPath(), record); walErr != nil {
+		return walErr
+	}
+	db.walRecords++
+	if db.walRecords >= db.CompactEvery {
+		select {
+		case db.compactRequests <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Compact folds the write-ahead log into the database.json snapshot. The
+// log is rotated aside while holding the write lock, so updates only wait
+// for the database to be marshalled, not for it to be written out.
+func (db *DataBaseClient) Compact() error {
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+
+	db.Mux.Lock()
+	dataBytes, err := json.Marshal(db.data)
+	if err != nil {
+		db.Mux.Unlock()
+		return err
+	}
+	// If an earlier compaction failed its rotated log is still pending, so
+	// the current log stays put. Its records are replayed again on startup,
+	// which is harmless because they are already in this snapshot.
+	if _, statErr := os.Stat(db.rotatedWALPath()); errors.Is(statErr, os.ErrNotExist) {
+		rotateErr := os.Rename(db.walPath(), db.rotatedWALPath())
+		if rotateErr != nil && errors.Is(rotateErr, os.ErrNotExist) == false {
+			db.Mux.Unlock()
+			return rotateErr
+		}
+	}
+	db.walRecords = 0
+	db.Mux.Unlock()
+
+	writeError := writeFileAtomic(db.Path, dataBytes, 0644)
 	if writeError != nil {
 		return writeError
 	}
-
+	removeErr := os.Remove(db.rotatedWALPath())
+	if removeErr != nil && errors.Is(removeErr, os.ErrNotExist) == false {
+		return removeErr
+	}
 	return nil
 }
 
+// Close stops background compaction and flushes the write-ahead log into
+// the snapshot.
+func (db *DataBaseClient) Close() error {
+	db.closeOnce.Do(func() {
+		close(db.stop)
+		<-db.stopped
+	})
+	return db.Compact()
+}
+
+func (db *DataBaseClient) compactInBackground() {
+	defer close(db.stopped)
+	for {
+		select {
+		case <-db.compactRequests:
+			if err := db.Compact(); err != nil {
+				log.Print(err.Error())
+			}
+		case <-db.stop:
+			return
+		}
+	}
+}
+
+func (db *DataBaseClient) walPath() string {
+	return db.Path + ".wal"
+}
+
+func (db *DataBaseClient) rotatedWALPath() string {
+	return db.Path + ".wal.old"
+}
+
+// loadFromDisk reads the snapshot and replays the write-ahead logs over it.
+func (db *DataBaseClient) loadFromDisk() (types.Database, error) {
+	doc, err := readDocument(db.Path)
+	if err != nil {
+		return types.Database{}, err
+	}
+	dataBytes, err := json.Marshal(doc)
+	if err != nil {
+		return types.Database{}, err
+	}
+	tempStruct := types.Database{}
+	unMarshalError := json.Unmarshal(dataBytes, &tempStruct)
+	if unMarshalError != nil {
+		return types.Database{}, errors.New(unMarshalError.Error())
+	}
+	return tempStruct, nil
+}
+
+// readDocument reads the snapshot at path and replays the rotated and
+// current write-ahead logs next to it, in that order.
+func readDocument(path string) (document, error) {
+	dataBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(err.Error())
+	}
+	doc := document{}
+	if err := json.Unmarshal(dataBytes, &doc); err != nil {
+		return nil, errors.New(err.Error())
+	}
+	for _, walPath := range []string{path + ".wal.old", path + ".wal"} {
+		records, err := readWAL(walPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if err := applyRecord(doc, record); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
+
 func (db *DataBaseClient) EnsureDB() error {
 	_, err := os.ReadFile(db.Path)
 	if err != nil {
-		dbTemplate, _ := os.ReadFile(GetPath())
-		writeError := os.WriteFile(db.Path, dbTemplate, 0644)
+		dbTemplate, err := os.ReadFile(GetPath())
+		if err != nil {
+			return err
+		}
+		// New files start out at the current schema version.
+		doc := document{}
+		if err := json.Unmarshal(dbTemplate, &doc); err != nil {
+			return err
+		}
+		if err := setField(doc, "version", CurrentSchemaVersion); err != nil {
+			return err
+		}
+		if dbTemplate, err = json.Marshal(doc); err != nil {
+			return err
+		}
+		writeError := writeFileAtomic(db.Path, dbTemplate, 0644)
 		if writeError != nil {
 			log.Println(writeError)
 			return writeError
 		}
+		// A log without its snapshot belongs to a database that no
+		// longer exists.
+		os.Remove(db.walPath())
+		os.Remove(db.rotatedWALPath())
 	}
 	return nil
 }
 
+// seedSequences raises the ID counters to the highest ID already in use, for
+// records written through WriteDB without going through NextID.
+func seedSequences(data *types.Database) {
+	if data.Sequences == nil {
+		data.Sequences = map[string]int{}
+	}
+	raise := func(collection string, id int) {
+		if id > data.Sequences[collection] {
+			data.Sequences[collection] = id
+		}
+	}
+	for id := range data.Chirps {
+		raise(types.ChirpsCollection, id)
+	}
+	for id := range data.Users {
+		raise(types.UsersCollection, id)
+	}
+	for id := range data.RefreshTokens {
+		raise(types.RefreshTokensCollection, id)
+	}
+	for id := range data.OneTimeTokens {
+		raise(types.OneTimeTokensCollection, id)
+	}
+	for id := range data.ApiTokens {
+		raise(types.ApiTokensCollection, id)
+	}
+	for id := range data.OAuthClients {
+		raise(types.OAuthClientsCollection, id)
+	}
+	for id := range data.DataExports {
+		raise(types.DataExportsCollection, id)
+	}
+}
+
+// NextID reserves and persists the next ID for collection.
+func (db *DataBaseClient) NextID(collection string) (int, error) {
+	id := 0
+	err := db.Update(func(tx *Tx) error {
+		id = tx.NextID(collection)
+		return nil
+	})
+	return id, err
+}
+
 func (db *DataBaseClient) GetChirps() ([]types.Chirp, error) {
-	data, err := db.LoadDB()
+	chirps := []types.Chirp{}
+	err := db.View(func(data *types.Database) error {
+		for _, id := range db.indexes.chirpIDs {
+			chirps = append(chirps, data.Chirps[id])
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	chirps := []types.Chirp{}
-	for k := range data.Chirps {
-		chirps = append(chirps, data.Chirps[k])
-	}
 	return chirps, nil
 }
 
-func (db *DataBaseClient) CreateChirp(body string) (types.Chirp, error) {
-	dataStruct, _ := db.LoadDB()
-	numOfChirps := len(dataStruct.Chirps)
-	id := numOfChirps + 1
-	newChirp := types.Chirp{ID: id, Body: body}
-	dataStruct.Chirps[id] = newChirp
-	err := db.WriteDB(dataStruct)
+func (db *DataBaseClient) ListChirps(query types.ChirpQuery) (types.ChirpPage, error) {
+	lastId, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return types.ChirpPage{}, err
+	}
+	page := types.ChirpPage{Chirps: []types.Chirp{}}
+	err = db.View(func(data *types.Database) error {
+		ids := db.indexes.chirpIDs
+		if query.AuthorId != 0 {
+			ids = db.indexes.chirpsByAuthor[query.AuthorId]
+		}
+		pageIds, more := ids.page(lastId, query.Descending, chirpLimit(query.Limit))
+		for _, id := range pageIds {
+			page.Chirps = append(page.Chirps, data.Chirps[id])
+		}
+		if more {
+			page.NextCursor = encodeCursor(pageIds[len(pageIds)-1])
+		}
+		return nil
+	})
+	return page, err
+}
+
+func (db *DataBaseClient) GetChirp(id int) (types.Chirp, error) {
+	chirp := types.Chirp{}
+	err := db.View(func(data *types.Database) error {
+		found, ok := data.Chirps[id]
+		if ok == false {
+			return fmt.Errorf("Unable to find chirp: %v", id)
+		}
+		chirp = found
+		return nil
+	})
+	return chirp, err
+}
+
+func (db *DataBaseClient) CreateChirp(body string, authorId int) (types.Chirp, error) {
+	newChirp := types.Chirp{Body: body, AuthorId: authorId}
+	err := db.Update(func(tx *Tx) error {
+		newChirp.ID = tx.NextID(types.ChirpsCollection)
+		Put(tx, tx.Chirps, newChirp.ID, newChirp)
+		return nil
+	})
 	if err != nil {
 		return types.Chirp{}, err
 	}
 	return newChirp, nil
 }
 
+func (db *DataBaseClient) DeleteChirp(id int) error {
+	return db.Update(func(tx *Tx) error {
+		if _, ok := tx.Chirps[id]; ok == false {
+			return fmt.Errorf("Unable to find chirp: %v", id)
+		}
+		Remove(tx, tx.Chirps, id)
+		return nil
+	})
+}
+
 func (db *DataBaseClient) CreateUsers(email string, password []byte) (types.User, error) {
-	dataStruct, _ := db.LoadDB()
-	numOfUsers := len(dataStruct.Users)
-	id := numOfUsers + 1
-	newUser := types.User{ID: id, Email: email, Password: password}
-	dataStruct.Users[id] = newUser
-	err := db.WriteDB(dataStruct)
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return types.User{}, err
+	}
+	newUser := types.User{Email: email, Password: password, Role: types.RoleUser}
+	err = db.Update(func(tx *Tx) error {
+		if _, taken := db.indexes.usersByEmail.first(email); taken {
+			return ErrEmailTaken
+		}
+		newUser.ID = tx.NextID(types.UsersCollection)
+		Put(tx, tx.Users, newUser.ID, newUser)
+		return nil
+	})
 	if err != nil {
 		return types.User{}, err
 	}
@@ -117,142 +436,783 @@ func (db *DataBaseClient) CreateUsers(email string, password []byte) (types.User
 }
 
 func (db *DataBaseClient) GetUserByEmail(email string) (types.User, error) {
-	dataStruct, _ := db.LoadDB()
-	for _, user := range dataStruct.Users {
-		if user.Email == email {
-			return user, nil
+	found := types.User{}
+	err := db.View(func(data *types.Database) error {
+		id, ok := db.indexes.usersByEmail.first(lookupEmail(email))
+		if ok == false {
+			return errors.New("Can't find user")
 		}
-	}
-	return types.User{}, errors.New("Can't find user")
+		found = data.Users[id]
+		return nil
+	})
+	return found, err
 }
 
 func (db *DataBaseClient) GetUserByID(id int) (types.User, error) {
-	datastruct, _ := db.LoadDB()
-	return datastruct.Users[id], nil
+	found := types.User{}
+	err := db.View(func(data *types.Database) error {
+		user, ok := data.Users[id]
+		if ok == false {
+			return errors.New("Can't find user")
+		}
+		found = user
+		return nil
+	})
+	return found, err
+}
+
+func (db *DataBaseClient) UpdateUser(id int, update types.UserUpdate) (types.User, error) {
+	email := ""
+	if update.Email != nil {
+		normalized, err := NormalizeEmail(*update.Email)
+		if err != nil {
+			return types.User{}, err
+		}
+		email = normalized
+	}
+	updated := types.User{}
+	err := db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[id]
+		if ok == false {
+			return errors.New("Can't find user")
+		}
+		if update.Email != nil && email != user.Email {
+			for _, owner := range db.indexes.usersByEmail[email] {
+				if owner != id {
+					return ErrEmailTaken
+				}
+			}
+			user.Email = email
+			user.IsEmailVerified = false
+		}
+		if update.Password != nil {
+			user.Password = update.Password
+		}
+		profile, err := UpdatedProfile(user.Profile, update)
+		if err != nil {
+			return err
+		}
+		if owner, taken := db.indexes.usersByHandle.first(profile.Handle); profile.Handle != "" && taken && owner != id {
+			return ErrHandleTaken
+		}
+		user.Profile = profile
+		Put(tx, tx.Users, id, user)
+		updated = user
+		return nil
+	})
+	return updated, err
+}
+func (db *DataBaseClient) SetChirpyRed(userId int, isChirpyRed bool) (types.User, error) {
+	updated := types.User{}
+	err := db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[userId]
+		if ok == false {
+			return errors.New("Can't find user")
+		}
+		user.IsChirpyRed = isChirpyRed
+		Put(tx, tx.Users, userId, user)
+		updated = user
+		return nil
+	})
+	return updated, err
+}
+
+func (db *DataBaseClient) SetEmailVerified(userId int, isEmailVerified bool) (types.User, error) {
+	updated := types.User{}
+	err := db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[userId]
+		if ok == false {
+			return errors.New("Can't find user")
+		}
+		user.IsEmailVerified = isEmailVerified
+		Put(tx, tx.Users, userId, user)
+		updated = user
+		return nil
+	})
+	return updated, err
+}
+
+func (db *DataBaseClient) SetRole(userId int, role string) (types.User, error) {
+	updated := types.User{}
+	err := db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[userId]
+		if ok == false {
+			return errors.New("Can't find user")
+		}
+		user.Role = role
+		Put(tx, tx.Users, userId, user)
+		updated = user
+		return nil
+	})
+	return updated, err
+}
+
+func (db *DataBaseClient) SetSuspended(userId int, isSuspended bool) (types.User, error) {
+	updated := types.User{}
+	err := db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[userId]
+		if ok == false {
+			return errors.New("Can't find user")
+		}
+		user.IsSuspended = isSuspended
+		Put(tx, tx.Users, userId, user)
+		updated = user
+		return nil
+	})
+	return updated, err
 }
 
-func (db *DataBaseClient) UpdateUser(id int, updateInformation types.User) (types.User, error) {
-	dataStruct, err := db.LoadDB()
+func (db *DataBaseClient) ListUsersByRole(role string) ([]types.User, error) {
+	users := []types.User{}
+	err := db.View(func(data *types.Database) error {
+		for _, user := range data.Users {
+			if user.Role == role {
+				users = append(users, user)
+			}
+		}
+		return nil
+	})
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, err
+}
+
+func (db *DataBaseClient) UpdateProfile(userId int, profile types.Profile) (types.User, error) {
+	profile, err := NormalizeProfile(profile)
 	if err != nil {
 		return types.User{}, err
 	}
-	dataStruct.Users[id] = updateInformation
+	updated := types.User{}
+	err = db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[userId]
+		if ok == false {
+			return errors.New("Can't find user")
+		}
+		if owner, taken := db.indexes.usersByHandle.first(profile.Handle); profile.Handle != "" && taken && owner != userId {
+			return ErrHandleTaken
+		}
+		user.Profile = profile
+		Put(tx, tx.Users, userId, user)
+		updated = user
+		return nil
+	})
+	return updated, err
+}
+
+func (db *DataBaseClient) GetUserByHandle(handle string) (types.User, error) {
+	found := types.User{}
+	err := db.View(func(data *types.Database) error {
+		id, ok := db.indexes.usersByHandle.first(strings.ToLower(strings.TrimSpace(handle)))
+		if ok == false {
+			return errors.New("Can't find user")
+		}
+		found = data.Users[id]
+		return nil
+	})
+	return found, err
+}
 
-	return dataStruct.Users[id], db.WriteDB(dataStruct)
+func (db *DataBaseClient) SetDeletionScheduledAt(userId int, deleteAt time.Time) (types.User, error) {
+	updated := types.User{}
+	err := db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[userId]
+		if ok == false {
+			return errors.New("Can't find user")
+		}
+		user.DeletionScheduledAt = deleteAt.UTC()
+		Put(tx, tx.Users, userId, user)
+		updated = user
+		return nil
+	})
+	return updated, err
+}
+
+func (db *DataBaseClient) ListUsersDueForDeletion(now time.Time) ([]types.User, error) {
+	users := []types.User{}
+	err := db.View(func(data *types.Database) error {
+		for _, user := range data.Users {
+			if user.DeletionScheduledAt.IsZero() == false && user.DeletionScheduledAt.After(now) == false {
+				users = append(users, user)
+			}
+		}
+		return nil
+	})
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, err
+}
 
+func (db *DataBaseClient) DeleteUser(userId int, anonymizeChirps bool) error {
+	return db.Update(func(tx *Tx) error {
+		if _, ok := tx.Users[userId]; ok == false {
+			return errors.New("User not found")
+		}
+		db.deleteUser(tx, userId, anonymizeChirps)
+		return nil
+	})
 }
+
+func (db *DataBaseClient) DeleteUserIfDue(userId int, now time.Time, anonymizeChirps bool) (types.User, bool, error) {
+	found, deleted := types.User{}, false
+	err := db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[userId]
+		if ok == false {
+			return nil
+		}
+		found = user
+		if user.DeletionScheduledAt.IsZero() || user.DeletionScheduledAt.After(now) {
+			return nil
+		}
+		db.deleteUser(tx, userId, anonymizeChirps)
+		deleted = true
+		return nil
+	})
+	return found, deleted, err
+}
+
+// deleteUser removes the user and everything of theirs, see
+// Store.DeleteUser.
+func (db *DataBaseClient) deleteUser(tx *Tx, userId int, anonymizeChirps bool) {
+	now := time.Now().UTC()
+	for _, id := range db.indexes.chirpsByAuthor[userId] {
+		if anonymizeChirps {
+			chirp := tx.Chirps[id]
+			chirp.AuthorId = 0
+			Put(tx, tx.Chirps, id, chirp)
+		} else {
+			Remove(tx, tx.Chirps, id)
+		}
+	}
+	revokeFamily(tx, db.indexes.refreshTokensByUser[userId])
+	for _, id := range db.indexes.apiTokensByUser[userId] {
+		if token := tx.ApiTokens[id]; token.RevokedAt.IsZero() {
+			token.RevokedAt = now
+			Put(tx, tx.ApiTokens, id, token)
+		}
+	}
+	for _, id := range db.indexes.oneTimeTokensByUser[userId] {
+		Remove(tx, tx.OneTimeTokens, id)
+	}
+	for _, id := range db.indexes.oauthClientsByOwner[userId] {
+		Remove(tx, tx.OAuthClients, id)
+	}
+	for _, id := range db.indexes.dataExportsByUser[userId] {
+		Remove(tx, tx.DataExports, id)
+	}
+	Remove(tx, tx.MFA, userId)
+	Remove(tx, tx.Users, userId)
+}
+
 func (db *DataBaseClient) StoreRefreshToken(refreshToken types.RefreshToken) (types.RefreshToken, error) {
-	dataStruct, err := db.LoadDB()
+	err := db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[refreshToken.UserId]
+		if ok == false {
+			return errors.New("Can't find user")
+		}
+		refreshToken.ID = tx.NextID(types.RefreshTokensCollection)
+		if refreshToken.FamilyId == 0 {
+			refreshToken.FamilyId = refreshToken.ID
+		}
+		Put(tx, tx.RefreshTokens, refreshToken.ID, sealRefreshToken(refreshToken))
+		user.RefreshTokenId = refreshToken.ID
+		Put(tx, tx.Users, refreshToken.UserId, user)
+		return nil
+	})
 	if err != nil {
 		log.Print(err.Error())
 		return types.RefreshToken{}, err
 	}
-	numOfTokens := len(dataStruct.RefreshTokens)
-	id := numOfTokens + 1
-	refreshToken.ID = id
-	dataStruct.RefreshTokens[id] = refreshToken
-	user := dataStruct.Users[refreshToken.UserId]
-	user.RefreshTokenId = id
-	dataStruct.Users[refreshToken.UserId] = user
-	writeErr := db.WriteDB(dataStruct)
-	if writeErr != nil {
-		return types.RefreshToken{}, writeErr
-	}
 	return refreshToken, nil
 }
 
 func (db *DataBaseClient) UpdateRefreshToken(updatedRefreshToken types.RefreshToken) (bool, error) {
-	dataStruct, err := db.LoadDB()
+	err := db.Update(func(tx *Tx) error {
+		Put(tx, tx.RefreshTokens, updatedRefreshToken.ID, sealRefreshToken(updatedRefreshToken))
+		return nil
+	})
 	if err != nil {
 		log.Print(err.Error())
 		return false, err
 	}
-	if err != nil {
-		return false, err
-	}
-	dataStruct.RefreshTokens[updatedRefreshToken.ID] = updatedRefreshToken
-	writeErr := db.WriteDB(dataStruct)
-	if writeErr != nil {
-		return false, writeErr
-	}
 	return true, nil
 }
 
 func (db *DataBaseClient) GetRefreshTokenID(tokenId int) (types.RefreshToken, error) {
-	dataStruct, err := db.LoadDB()
+	found := types.RefreshToken{}
+	err := db.View(func(data *types.Database) error {
+		token, ok := data.RefreshTokens[tokenId]
+		if ok == false {
+			return errors.New("Token not found")
+		}
+		found = token
+		return nil
+	})
+	return found, err
+}
+
+func (db *DataBaseClient) GetRefreshTokenByString(token string) (types.RefreshToken, error) {
+	found := types.RefreshToken{}
+	err := db.View(func(data *types.Database) error {
+		for _, id := range db.indexes.refreshTokensByPrefix[tokenPrefix(token)] {
+			if tokenMatches(data.RefreshTokens[id], token) {
+				found = data.RefreshTokens[id]
+				return nil
+			}
+		}
+		return errors.New("Could not find Refresh Token")
+	})
+	return found, err
+}
+
+func (db *DataBaseClient) InvalidateToken(tokenId int) (types.RefreshToken, error) {
+	token := types.RefreshToken{}
+	err := db.Update(func(tx *Tx) error {
+		found, ok := tx.RefreshTokens[tokenId]
+		if ok == false {
+			return errors.New("Token not found")
+		}
+		found.IsValid = false
+		Put(tx, tx.RefreshTokens, tokenId, found)
+		token = found
+		return nil
+	})
 	if err != nil {
-		return types.RefreshToken{}, errors.New("There was an issue loading the db")
-	}
-	if token, ok := dataStruct.RefreshTokens[tokenId]; ok == false {
-		return types.RefreshToken{}, errors.New("Token not found")
-	} else {
-		return token, nil
+		log.Print(err.Error())
+		return types.RefreshToken{}, err
 	}
+	return token, nil
 }
 
-func (db *DataBaseClient) GetRefreshTokenByString(token string) (types.RefreshToken, error) {
-	dataStruct, err := db.LoadDB()
+func (db *DataBaseClient) InvalidateUsersToken(userId int) error {
+	return db.Update(func(tx *Tx) error {
+		if _, ok := tx.Users[userId]; ok == false {
+			return errors.New("User not found")
+		}
+		revokeFamily(tx, db.indexes.refreshTokensByUser[userId])
+		return nil
+	})
+}
+
+func (db *DataBaseClient) RotateRefreshToken(tokenId int) (types.RefreshToken, error) {
+	rotated := types.RefreshToken{}
+	reused := false
+	err := db.Update(func(tx *Tx) error {
+		token, ok := tx.RefreshTokens[tokenId]
+		if ok == false {
+			return errors.New("Token not found")
+		}
+		if token.ReplacedBy != 0 {
+			// The revocation has to be committed, so this is not returned
+			// as an error from the transaction.
+			reused = true
+			revokeFamily(tx, db.indexes.refreshTokensByFamily[token.FamilyId])
+			return nil
+		}
+		if token.IsValid == false || token.IsExpired() {
+			return ErrRefreshTokenInvalid
+		}
+		next, err := rotatedRefreshToken(token)
+		if err != nil {
+			return err
+		}
+		next.ID = tx.NextID(types.RefreshTokensCollection)
+		Put(tx, tx.RefreshTokens, next.ID, sealRefreshToken(next))
+		token.IsValid = false
+		token.ReplacedBy = next.ID
+		Put(tx, tx.RefreshTokens, token.ID, token)
+		if user, ok := tx.Users[token.UserId]; ok {
+			user.RefreshTokenId = next.ID
+			Put(tx, tx.Users, user.ID, user)
+		}
+		rotated = next
+		return nil
+	})
 	if err != nil {
-		return types.RefreshToken{}, errors.New(err.Error())
+		return types.RefreshToken{}, err
 	}
-	for _, refreshToken := range dataStruct.RefreshTokens {
-		if refreshToken.Token == token {
-			return refreshToken, nil
+	if reused {
+		return types.RefreshToken{}, ErrRefreshTokenReused
+	}
+	return rotated, nil
+}
+
+func (db *DataBaseClient) RevokeRefreshTokenFamily(familyId int) error {
+	return db.Update(func(tx *Tx) error {
+		revokeFamily(tx, db.indexes.refreshTokensByFamily[familyId])
+		return nil
+	})
+}
+
+// revokeFamily invalidates every token in tokenIds.
+func revokeFamily(tx *Tx, tokenIds sortedIDs) {
+	for _, id := range tokenIds {
+		token := tx.RefreshTokens[id]
+		if token.IsValid {
+			token.IsValid = false
+			Put(tx, tx.RefreshTokens, id, token)
 		}
 	}
-	return types.RefreshToken{}, errors.New("Could not find Refresh Token")
 }
 
-func (db *DataBaseClient) InvalidateToken(tokenId int) (types.RefreshToken, error) {
-	token, err := db.GetRefreshTokenID(tokenId)
+func (db *DataBaseClient) ListSessions(userId int) ([]types.Session, error) {
+	sessions := []types.Session{}
+	err := db.View(func(data *types.Database) error {
+		for _, id := range db.indexes.refreshTokensByUser[userId] {
+			if session, ok := sessionFromToken(data.RefreshTokens[id]); ok {
+				sessions = append(sessions, session)
+			}
+		}
+		sortSessions(sessions)
+		return nil
+	})
+	return sessions, err
+}
+
+func (db *DataBaseClient) CreateSession(userId int, client types.SessionClient) (types.RefreshToken, error) {
+	refreshToken, err := newSession(userId, client)
 	if err != nil {
 		return types.RefreshToken{}, err
 	}
-	if token.IsValid == false {
-		return token, nil
-	} else {
-		token.IsValid = false
-		isUpdated, updateErr := db.UpdateRefreshToken(token)
-		if isUpdated != true && updateErr != nil {
-			log.Print(updateErr.Error())
-			return types.RefreshToken{}, updateErr
+	return db.StoreRefreshToken(refreshToken)
+}
+
+func (db *DataBaseClient) CreateOneTimeToken(userId int, purpose string, ttl time.Duration) (types.OneTimeToken, error) {
+	return db.CreateOneTimeTokenWithPayload(userId, purpose, "", ttl)
+}
+
+func (db *DataBaseClient) CreateOneTimeTokenWithPayload(userId int, purpose string, payload string, ttl time.Duration) (types.OneTimeToken, error) {
+	token, err := newOneTimeToken(userId, purpose, payload, ttl)
+	if err != nil {
+		return types.OneTimeToken{}, err
+	}
+	err = db.Update(func(tx *Tx) error {
+		if _, ok := tx.Users[userId]; ok == false {
+			return errors.New("User not found")
+		}
+		now := time.Now().UTC()
+		for _, id := range db.indexes.oneTimeTokensByUser[userId] {
+			earlier := tx.OneTimeTokens[id]
+			if earlier.Purpose == purpose && earlier.UsedAt.IsZero() {
+				earlier.UsedAt = now
+				Put(tx, tx.OneTimeTokens, id, earlier)
+			}
+		}
+		token.ID = tx.NextID(types.OneTimeTokensCollection)
+		stored := token
+		stored.Token = ""
+		Put(tx, tx.OneTimeTokens, token.ID, stored)
+		return nil
+	})
+	if err != nil {
+		return types.OneTimeToken{}, err
+	}
+	return token, nil
+}
+
+func (db *DataBaseClient) UseOneTimeToken(token string, purpose string) (types.OneTimeToken, error) {
+	used := types.OneTimeToken{}
+	err := db.Update(func(tx *Tx) error {
+		for _, id := range db.indexes.oneTimeTokensByPrefix[tokenPrefix(token)] {
+			stored := tx.OneTimeTokens[id]
+			matches, err := checkOneTimeToken(stored, token, purpose)
+			if matches == false {
+				continue
+			}
+			used = stored
+			if err != nil {
+				return err
+			}
+			used.UsedAt = time.Now().UTC()
+			Put(tx, tx.OneTimeTokens, id, used)
+			return nil
+		}
+		return ErrOneTimeTokenInvalid
+	})
+	return used, err
+}
+
+func (db *DataBaseClient) SetOneTimeTokenFamily(tokenId int, familyId int) error {
+	return db.Update(func(tx *Tx) error {
+		token, ok := tx.OneTimeTokens[tokenId]
+		if ok == false {
+			return ErrOneTimeTokenInvalid
 		}
-		return token, nil
+		token.FamilyId = familyId
+		Put(tx, tx.OneTimeTokens, tokenId, token)
+		return nil
+	})
+}
+
+func (db *DataBaseClient) CreateApiToken(userId int, name string, scopes []string, expiresAt time.Time) (types.ApiToken, error) {
+	token, err := newApiToken(userId, name, scopes, expiresAt)
+	if err != nil {
+		return types.ApiToken{}, err
 	}
+	err = db.Update(func(tx *Tx) error {
+		if _, ok := tx.Users[userId]; ok == false {
+			return errors.New("User not found")
+		}
+		token.ID = tx.NextID(types.ApiTokensCollection)
+		stored := token
+		stored.Token = ""
+		Put(tx, tx.ApiTokens, token.ID, stored)
+		return nil
+	})
+	if err != nil {
+		return types.ApiToken{}, err
+	}
+	return token, nil
+}
 
-	return types.RefreshToken{}, nil
+func (db *DataBaseClient) ListApiTokens(userId int) ([]types.ApiToken, error) {
+	tokens := []types.ApiToken{}
+	err := db.View(func(data *types.Database) error {
+		for _, id := range db.indexes.apiTokensByUser[userId] {
+			if token := data.ApiTokens[id]; token.RevokedAt.IsZero() {
+				tokens = append(tokens, token)
+			}
+		}
+		return nil
+	})
+	return tokens, err
 }
 
-func (db *DataBaseClient) InvalidateUsersToken(userId int) error {
-	foundUser, err := db.GetUserByID(userId)
+func (db *DataBaseClient) RevokeApiToken(userId int, tokenId int) error {
+	return db.Update(func(tx *Tx) error {
+		token, ok := tx.ApiTokens[tokenId]
+		if ok == false || token.UserId != userId || token.RevokedAt.IsZero() == false {
+			return ErrApiTokenNotFound
+		}
+		token.RevokedAt = time.Now().UTC()
+		Put(tx, tx.ApiTokens, tokenId, token)
+		return nil
+	})
+}
+
+func (db *DataBaseClient) UseApiToken(token string) (types.ApiToken, error) {
+	now := time.Now().UTC()
+	found := types.ApiToken{}
+	err := db.View(func(data *types.Database) error {
+		for _, id := range db.indexes.apiTokensByPrefix[apiTokenPrefix(token)] {
+			if stored := data.ApiTokens[id]; canUseApiToken(stored, token, now) {
+				found = stored
+				return nil
+			}
+		}
+		return ErrApiTokenInvalid
+	})
+	if err != nil || now.Sub(found.LastUsedAt) < apiTokenTouchInterval {
+		return found, err
+	}
+	err = db.Update(func(tx *Tx) error {
+		stored, ok := tx.ApiTokens[found.ID]
+		if ok == false || stored.RevokedAt.IsZero() == false {
+			return ErrApiTokenInvalid
+		}
+		stored.LastUsedAt = now
+		Put(tx, tx.ApiTokens, found.ID, stored)
+		found = stored
+		return nil
+	})
+	return found, err
+}
+
+func (db *DataBaseClient) CreateOAuthClient(ownerId int, name string, redirectURIs []string, confidential bool) (types.OAuthClient, error) {
+	client, err := newOAuthClient(ownerId, name, redirectURIs, confidential)
 	if err != nil {
-		log.Print(err.Error())
-		return errors.New("User not found")
+		return types.OAuthClient{}, err
 	}
-	token, getErr := db.GetRefreshTokenID(foundUser.RefreshTokenId)
-	if getErr != nil {
-		log.Print(getErr.Error())
-		return errors.New("Couldn't find token")
+	err = db.Update(func(tx *Tx) error {
+		if _, ok := tx.Users[ownerId]; ok == false {
+			return errors.New("User not found")
+		}
+		client.ID = tx.NextID(types.OAuthClientsCollection)
+		stored := client
+		stored.Secret = ""
+		Put(tx, tx.OAuthClients, client.ID, stored)
+		return nil
+	})
+	if err != nil {
+		return types.OAuthClient{}, err
 	}
-	invalidatedToken, invalidateErr := db.InvalidateToken(token.ID)
-	if invalidatedToken.IsValid != false || invalidateErr != nil {
-		log.Print(invalidateErr.Error())
-		return errors.New("Could not invalidate token")
+	return client, nil
+}
+
+func (db *DataBaseClient) GetOAuthClient(clientId string) (types.OAuthClient, error) {
+	found := types.OAuthClient{}
+	err := db.View(func(data *types.Database) error {
+		id, ok := db.indexes.oauthClientsByClientId.first(clientId)
+		if ok == false {
+			return ErrOAuthClientNotFound
+		}
+		found = data.OAuthClients[id]
+		return nil
+	})
+	return found, err
+}
+
+func (db *DataBaseClient) ListOAuthClients(ownerId int) ([]types.OAuthClient, error) {
+	clients := []types.OAuthClient{}
+	err := db.View(func(data *types.Database) error {
+		for _, id := range db.indexes.oauthClientsByOwner[ownerId] {
+			clients = append(clients, data.OAuthClients[id])
+		}
+		return nil
+	})
+	return clients, err
+}
+
+func (db *DataBaseClient) CreateDataExport(userId int, expiresAt time.Time) (types.DataExport, error) {
+	export := newDataExport(userId, expiresAt)
+	err := db.Update(func(tx *Tx) error {
+		if _, ok := tx.Users[userId]; ok == false {
+			return errors.New("User not found")
+		}
+		export.ID = tx.NextID(types.DataExportsCollection)
+		Put(tx, tx.DataExports, export.ID, export)
+		return nil
+	})
+	if err != nil {
+		return types.DataExport{}, err
 	}
-	return nil
+	return export, nil
+}
+
+func (db *DataBaseClient) GetDataExport(id int) (types.DataExport, error) {
+	found := types.DataExport{}
+	err := db.View(func(data *types.Database) error {
+		export, ok := data.DataExports[id]
+		if ok == false {
+			return ErrDataExportNotFound
+		}
+		found = export
+		return nil
+	})
+	return found, err
+}
+
+func (db *DataBaseClient) CompleteDataExport(id int, status string, size int64) (types.DataExport, error) {
+	completed := types.DataExport{}
+	err := db.Update(func(tx *Tx) error {
+		export, ok := tx.DataExports[id]
+		if ok == false || export.Status != types.ExportPending {
+			return ErrDataExportNotFound
+		}
+		export.Status = status
+		export.Size = size
+		export.CompletedAt = time.Now().UTC()
+		Put(tx, tx.DataExports, id, export)
+		completed = export
+		return nil
+	})
+	return completed, err
+}
+
+func (db *DataBaseClient) ListDataExports(userId int) ([]types.DataExport, error) {
+	exports := []types.DataExport{}
+	err := db.View(func(data *types.Database) error {
+		for _, id := range db.indexes.dataExportsByUser[userId] {
+			exports = append(exports, data.DataExports[id])
+		}
+		return nil
+	})
+	return exports, err
+}
+
+func (db *DataBaseClient) DeleteExpiredDataExports(now time.Time) ([]types.DataExport, error) {
+	expired := []types.DataExport{}
+	err := db.Update(func(tx *Tx) error {
+		for id, export := range tx.DataExports {
+			if export.ExpiresAt.After(now) == false {
+				expired = append(expired, export)
+				Remove(tx, tx.DataExports, id)
+			}
+		}
+		return nil
+	})
+	sort.Slice(expired, func(i, j int) bool { return expired[i].ID < expired[j].ID })
+	return expired, err
+}
+
+func (db *DataBaseClient) GetMFA(userId int) (types.MFA, error) {
+	found := types.MFA{UserId: userId}
+	err := db.View(func(data *types.Database) error {
+		if mfa, ok := data.MFA[userId]; ok {
+			found = mfa
+		}
+		return nil
+	})
+	return found, err
+}
+
+// updateMFA runs fn on the user's MFA record, creating it if needed.
+func (db *DataBaseClient) updateMFA(userId int, fn func(mfa *types.MFA) error) error {
+	return db.Update(func(tx *Tx) error {
+		if _, ok := tx.Users[userId]; ok == false {
+			return errors.New("Can't find user")
+		}
+		mfa, ok := tx.MFA[userId]
+		if ok == false {
+			mfa = types.MFA{UserId: userId}
+		}
+		if err := fn(&mfa); err != nil {
+			return err
+		}
+		Put(tx, tx.MFA, userId, mfa)
+		return nil
+	})
+}
+
+func (db *DataBaseClient) EnrollTOTP(userId int, secret string) error {
+	return db.updateMFA(userId, func(mfa *types.MFA) error {
+		if mfa.TOTPEnabled {
+			return ErrMFAEnabled
+		}
+		mfa.TOTPSecret = secret
+		mfa.LastTOTPStep = 0
+		return nil
+	})
+}
+
+func (db *DataBaseClient) EnableTOTP(userId int, recoveryCodes []string) error {
+	return db.updateMFA(userId, func(mfa *types.MFA) error {
+		mfa.TOTPEnabled = true
+		mfa.RecoveryCodeHashes = hashRecoveryCodes(recoveryCodes)
+		return nil
+	})
+}
+
+func (db *DataBaseClient) DisableTOTP(userId int) error {
+	return db.Update(func(tx *Tx) error {
+		Remove(tx, tx.MFA, userId)
+		return nil
+	})
+}
+
+func (db *DataBaseClient) UseTOTPStep(userId int, step int64) error {
+	return db.updateMFA(userId, func(mfa *types.MFA) error {
+		if step <= mfa.LastTOTPStep {
+			return ErrMFACodeInvalid
+		}
+		mfa.LastTOTPStep = step
+		return nil
+	})
+}
+
+func (db *DataBaseClient) UseRecoveryCode(userId int, code string) error {
+	return db.updateMFA(userId, func(mfa *types.MFA) error {
+		remaining, ok := redeemRecoveryCode(mfa.RecoveryCodeHashes, code)
+		if ok == false {
+			return ErrMFACodeInvalid
+		}
+		mfa.RecoveryCodeHashes = remaining
+		return nil
+	})
 }
 
 func (db *DataBaseClient) GenerateRefreshToken(userId int) (types.RefreshToken, error) {
-	// Refresh Token
-	c := 10
-	rndByteArr := make([]byte, c)
-	_, readErr := rand.Read(rndByteArr)
-	if readErr != nil {
-		return types.RefreshToken{}, readErr
-	}
-	encodedString := hex.EncodeToString(rndByteArr)
-	timeNow := time.Now().UTC().Add(time.Hour * 24 * 60)
-	refreshToken := types.RefreshToken{Token: encodedString, UserId: userId, IsValid: true, ExpiresAt: timeNow}
+	refreshToken, err := newRefreshToken(userId)
+	if err != nil {
+		return types.RefreshToken{}, err
+	}
 	refreshToken, storeErr := db.StoreRefreshToken(refreshToken)
 	if storeErr != nil {
 		return types.RefreshToken{}, storeErr
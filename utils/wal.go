@@ -0,0 +1,260 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/mdwiltfong/chirpy/utils/types"
+)
+
+// DefaultCompactEvery is how many write-ahead log records DataBaseClient
+// accumulates before it folds them into the database.json snapshot in the
+// background.
+const DefaultCompactEvery = 100
+
+// document is the generic form of the persisted database: every top-level
+// key of types.Database mapped to its raw JSON. Log records are replayed
+// against it.
+type document map[string]json.RawMessage
+
+// walRecord is one committed Update. Top-level fields holding JSON objects
+// (the collections) are diffed key by key; anything else is replaced whole.
+// Applying a record twice gives the same result, so replaying a log over a
+// snapshot it was already compacted into is harmless.
+type walRecord struct {
+	Set     map[string]map[string]json.RawMessage `json:"set,omitempty"`
+	Delete  map[string][]string                   `json:"delete,omitempty"`
+	Replace map[string]json.RawMessage            `json:"replace,omitempty"`
+}
+
+func (record walRecord) isEmpty() bool {
+	return len(record.Set) == 0 && len(record.Delete) == 0 && len(record.Replace) == 0
+}
+
+func asObject(raw json.RawMessage) (map[string]json.RawMessage, bool) {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, false
+	}
+	object := map[string]json.RawMessage{}
+	if err := json.Unmarshal(trimmed, &object); err != nil {
+		return nil, false
+	}
+	return object, true
+}
+
+// cloneDatabase copies data deeply enough that changes to the copy's
+// collections leave data untouched: every map field gets its own map.
+func cloneDatabase(data *types.Database) types.Database {
+	clone := *data
+	value := reflect.ValueOf(&clone).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if field.Kind() != reflect.Map || field.IsNil() {
+			continue
+		}
+		copied := reflect.MakeMapWithSize(field.Type(), field.Len())
+		iter := field.MapRange()
+		for iter.Next() {
+			copied.SetMapIndex(iter.Key(), iter.Value())
+		}
+		field.Set(copied)
+	}
+	return clone
+}
+
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// diffDatabases describes the change from before to after as a walRecord.
+// Map fields of types.Database are compared entry by entry, every other
+// field as a whole.
+func diffDatabases(before *types.Database, after *types.Database) (walRecord, error) {
+	record := walRecord{
+		Set:     map[string]map[string]json.RawMessage{},
+		Delete:  map[string][]string{},
+		Replace: map[string]json.RawMessage{},
+	}
+	beforeValue := reflect.ValueOf(before).Elem()
+	afterValue := reflect.ValueOf(after).Elem()
+	for i := 0; i < beforeValue.NumField(); i++ {
+		name := jsonFieldName(beforeValue.Type().Field(i))
+		beforeField, afterField := beforeValue.Field(i), afterValue.Field(i)
+		if beforeField.Kind() != reflect.Map {
+			if reflect.DeepEqual(beforeField.Interface(), afterField.Interface()) == false {
+				raw, err := json.Marshal(afterField.Interface())
+				if err != nil {
+					return walRecord{}, err
+				}
+				record.Replace[name] = raw
+			}
+			continue
+		}
+		iter := afterField.MapRange()
+		for iter.Next() {
+			previous := beforeField.MapIndex(iter.Key())
+			if previous.IsValid() && reflect.DeepEqual(previous.Interface(), iter.Value().Interface()) {
+				continue
+			}
+			raw, err := json.Marshal(iter.Value().Interface())
+			if err != nil {
+				return walRecord{}, err
+			}
+			if record.Set[name] == nil {
+				record.Set[name] = map[string]json.RawMessage{}
+			}
+			record.Set[name][fmt.Sprint(iter.Key().Interface())] = raw
+		}
+		iter = beforeField.MapRange()
+		for iter.Next() {
+			if afterField.MapIndex(iter.Key()).IsValid() == false {
+				record.Delete[name] = append(record.Delete[name], fmt.Sprint(iter.Key().Interface()))
+			}
+		}
+	}
+	return record, nil
+}
+
+func applyRecord(doc document, record walRecord) error {
+	for field, value := range record.Replace {
+		doc[field] = value
+	}
+	fields := map[string]struct{}{}
+	for field := range record.Set {
+		fields[field] = struct{}{}
+	}
+	for field := range record.Delete {
+		fields[field] = struct{}{}
+	}
+	for field := range fields {
+		object, ok := asObject(doc[field])
+		if ok == false {
+			object = map[string]json.RawMessage{}
+		}
+		for key, value := range record.Set[field] {
+			object[key] = value
+		}
+		for _, key := range record.Delete[field] {
+			delete(object, key)
+		}
+		encoded, err := json.Marshal(object)
+		if err != nil {
+			return err
+		}
+		doc[field] = encoded
+	}
+	return nil
+}
+
+// appendWAL durably appends record to the log at path. Each line is the
+// CRC-32 of the JSON payload followed by the payload, so a record torn by a
+// crash mid-append is detected and discarded on replay.
+func appendWAL(path string, record walRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(payload), payload)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(line); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readWAL returns every intact record in the log at path, stopping at the
+// first torn or corrupt line. A missing log has no records.
+func readWAL(path string) ([]walRecord, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	records := []walRecord{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		checksum, payload, found := strings.Cut(scanner.Text(), " ")
+		if found == false {
+			break
+		}
+		expected, parseErr := strconv.ParseUint(checksum, 16, 32)
+		if parseErr != nil || uint32(expected) != crc32.ChecksumIEEE([]byte(payload)) {
+			break
+		}
+		record := walRecord{}
+		if err := json.Unmarshal([]byte(payload), &record); err != nil {
+			break
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// writeFileAtomic replaces path with data so that readers, and the file
+// left behind after a crash, only ever see the old or the new contents.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	handle, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	// Not every platform supports fsync on a directory. The rename has
+	// already happened by now, so a failure here is not fatal.
+	handle.Sync()
+	return nil
+}